@@ -0,0 +1,117 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/kardianos/imapdown/list"
+)
+
+// accountConfig is one mailbox in a -config file. Flags other than the
+// account ones apply to every account.
+type accountConfig struct {
+	Name      string // Shown in logs, defaults to User.
+	Host      string // host:port
+	User      string
+	PassFile  string // File containing the password.
+	PassEnv   string // Environment variable containing the password.
+	TokenFile string // File containing an OAuth2 access token, for XOAUTH2.
+	Store     string // Directory under -store, defaults to Name.
+	Include   []string
+	Exclude   []string
+}
+
+type config struct {
+	Accounts []accountConfig
+}
+
+func loadConfig(fn string) (*config, error) {
+	b, err := os.ReadFile(fn)
+	if err != nil {
+		return nil, fmt.Errorf("read config: %w", err)
+	}
+	cfg := &config{}
+	d := json.NewDecoder(bytes.NewReader(b))
+	d.DisallowUnknownFields()
+	if err := d.Decode(cfg); err != nil {
+		return nil, fmt.Errorf("parse config %s: %w", fn, err)
+	}
+	if len(cfg.Accounts) == 0 {
+		return nil, fmt.Errorf("config %s has no accounts", fn)
+	}
+	stores := map[string]bool{}
+	for i := range cfg.Accounts {
+		a := &cfg.Accounts[i]
+		if len(a.Name) == 0 {
+			a.Name = a.User
+		}
+		if len(a.Store) == 0 {
+			a.Store = a.Name
+		}
+		switch {
+		case len(a.Host) == 0:
+			return nil, fmt.Errorf("account %d: missing Host", i+1)
+		case len(a.Name) == 0:
+			return nil, fmt.Errorf("account %d: missing Name or User", i+1)
+		case !filepath.IsLocal(a.Store):
+			return nil, fmt.Errorf("account %s: Store %q must be a relative path inside -store", a.Name, a.Store)
+		case stores[filepath.Clean(a.Store)]:
+			return nil, fmt.Errorf("account %s: Store %q is used by another account", a.Name, a.Store)
+		}
+		stores[filepath.Clean(a.Store)] = true
+	}
+	return cfg, nil
+}
+
+// runAccounts backs up each account into its own directory under base. A
+// failed account is logged and the rest still run; the returned error joins
+// every failure.
+func runAccounts(ctx context.Context, cfg *config, base string, opts []list.Option) error {
+	var errs []error
+	for _, a := range cfg.Accounts {
+		if err := ctx.Err(); err != nil {
+			errs = append(errs, err)
+			break
+		}
+		if err := runAccount(ctx, a, base, opts); err != nil {
+			log.Printf("account %s: %v", a.Name, err)
+			errs = append(errs, fmt.Errorf("account %s: %w", a.Name, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func runAccount(ctx context.Context, a accountConfig, base string, opts []list.Option) error {
+	opts = append([]list.Option(nil), opts...)
+	var secret string
+	if len(a.TokenFile) > 0 {
+		b, err := os.ReadFile(a.TokenFile)
+		if err != nil {
+			return fmt.Errorf("read token: %w", err)
+		}
+		secret = strings.TrimSpace(string(b))
+		opts = append(opts, list.WithAuthMethod(list.AuthXOAuth2))
+	} else {
+		var err error
+		secret, err = readPassword("", a.PassFile, a.PassEnv, false)
+		if err != nil {
+			return err
+		}
+		opts = append(opts, list.WithAuthMethod(list.AuthLogin))
+	}
+	if len(a.Include) > 0 || len(a.Exclude) > 0 {
+		opts = append(opts, list.WithFolders(a.Include, a.Exclude))
+	}
+	// The Worker creates the directory with its DirMode.
+	w := list.New(filepath.Join(base, a.Store), opts...)
+	sum, err := w.List(ctx, a.Host, a.User, secret)
+	log.Printf("account %s: %v", a.Name, sum)
+	return err
+}
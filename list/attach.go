@@ -0,0 +1,104 @@
+package list
+
+import (
+	"encoding/base32"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/emersion/go-message"
+	"github.com/emersion/go-message/mail"
+	"golang.org/x/crypto/blake2b"
+)
+
+// attachDir holds extracted attachments under the store root, each named by
+// the hash of its content so identical attachments share one file.
+const attachDir = "attachments"
+
+// Attachment describes an attachment of a stored message. Its decoded
+// content is in Store/attachments/<File>.
+type Attachment struct {
+	Filename    string
+	ContentType string
+	Size        int64
+	Hash        []byte // blake2b of the decoded content.
+	File        string
+}
+
+// extractAttachments writes each attachment in the message read from r to
+// the attachments directory and returns them. A message that can't be
+// parsed is logged and has no attachments; the body is stored either way.
+func (w *Worker) extractAttachments(key string, r io.Reader) ([]Attachment, error) {
+	mr, err := mail.CreateReader(r)
+	if err != nil && !message.IsUnknownCharset(err) {
+		w.log("\t%s: attachments: %v", key, err)
+		return nil, nil
+	}
+	dir := filepath.Join(w.Store, attachDir)
+	var list []Attachment
+	for {
+		p, err := mr.NextPart()
+		if errors.Is(err, io.EOF) {
+			return list, nil
+		}
+		if err != nil && !message.IsUnknownCharset(err) && !message.IsUnknownEncoding(err) {
+			w.log("\t%s: attachments: %v", key, err)
+			return list, nil
+		}
+		ah, ok := p.Header.(*mail.AttachmentHeader)
+		if !ok {
+			continue
+		}
+		if err := w.mkdirAll(dir); err != nil {
+			return nil, err
+		}
+		a, err := w.writeAttachment(dir, p.Body)
+		if err != nil {
+			return nil, fmt.Errorf("attachment: %w", err)
+		}
+		a.Filename, _ = ah.Filename()
+		a.ContentType, _, _ = ah.ContentType()
+		list = append(list, a)
+	}
+}
+
+func (w *Worker) writeAttachment(dir string, r io.Reader) (Attachment, error) {
+	a := Attachment{}
+	f, err := os.CreateTemp(dir, ".attach-*.tmp")
+	if err != nil {
+		return a, err
+	}
+	tmpName := f.Name()
+	defer os.Remove(tmpName)
+	if err := f.Chmod(w.fileMode()); err != nil {
+		f.Close()
+		return a, err
+	}
+
+	hasher, err := blake2b.New256(nil)
+	if err != nil {
+		f.Close()
+		return a, err
+	}
+	a.Size, err = io.Copy(f, io.TeeReader(r, hasher))
+	if err == nil {
+		err = f.Sync()
+	}
+	if err != nil {
+		f.Close()
+		return a, err
+	}
+	if err := f.Close(); err != nil {
+		return a, err
+	}
+	a.Hash = hasher.Sum(nil)
+	a.File = base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(a.Hash)
+
+	final := filepath.Join(dir, a.File)
+	if _, err := os.Stat(final); err == nil {
+		return a, nil
+	}
+	return a, os.Rename(tmpName, final)
+}
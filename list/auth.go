@@ -0,0 +1,79 @@
+package list
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/client"
+	"github.com/emersion/go-sasl"
+)
+
+// Authentication methods for Worker.AuthMethod.
+const (
+	AuthLogin   = "login"   // IMAP LOGIN with a password.
+	AuthXOAuth2 = "xoauth2" // SASL XOAUTH2 with an OAuth2 access token.
+)
+
+func (w *Worker) login(c *client.Client, server, username, secret string) error {
+	switch w.AuthMethod {
+	default:
+		return fmt.Errorf("unknown auth method %q", w.AuthMethod)
+	case "", AuthLogin:
+		if err := c.Login(username, secret); err != nil {
+			return fmt.Errorf("login to %v: %w", server, authErr(c, err))
+		}
+		return nil
+	case AuthXOAuth2:
+		ok, err := c.SupportAuth("XOAUTH2")
+		if err != nil {
+			return fmt.Errorf("capability: %w", err)
+		}
+		if !ok {
+			return fmt.Errorf("server %v does not advertise AUTH=XOAUTH2", server)
+		}
+		sc := &xoauth2Client{username: username, token: secret}
+		if err := c.Authenticate(sc); err != nil {
+			if len(sc.serverErr) > 0 {
+				return fmt.Errorf("xoauth2 to %v: %w: %s", server, authErr(c, err), sc.serverErr)
+			}
+			return fmt.Errorf("xoauth2 to %v: %w", server, authErr(c, err))
+		}
+		return nil
+	}
+}
+
+// authErr marks err as an authentication failure unless the connection was
+// lost, which is a transport failure that may be retried.
+func authErr(c *client.Client, err error) error {
+	if c.State() == imap.LogoutState {
+		return fmt.Errorf("%w: %w", ErrConnect, err)
+	}
+	return fmt.Errorf("%w: %w", ErrAuth, err)
+}
+
+// xoauth2Client implements the XOAUTH2 mechanism used by Gmail and
+// Office 365. On failure the server sends a JSON error as a challenge, which
+// is kept so the caller can tell an expired token from a wrong scope.
+type xoauth2Client struct {
+	username  string
+	token     string
+	serverErr []byte
+}
+
+var _ sasl.Client = &xoauth2Client{}
+
+func (a *xoauth2Client) Start() (mech string, ir []byte, err error) {
+	ir = []byte("user=" + a.username + "\x01auth=Bearer " + a.token + "\x01\x01")
+	return "XOAUTH2", ir, nil
+}
+
+func (a *xoauth2Client) Next(challenge []byte) ([]byte, error) {
+	if len(a.serverErr) > 0 {
+		return nil, errors.New("xoauth2: unexpected server challenge")
+	}
+	a.serverErr = challenge
+	// An empty response acknowledges the error and lets the server finish
+	// with a tagged NO.
+	return []byte{}, nil
+}
@@ -0,0 +1,143 @@
+package list
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// Store holds message files in place of the store directory, such as in an
+// object store. Keys are slash separated paths relative to the store root,
+// the same names the files have in the directory.
+type Store interface {
+	Exists(key string) (bool, error)
+	// Write stores all of r under key, replacing any value. A failed Write
+	// must not leave a partial value behind.
+	Write(key string, r io.Reader) error
+	// Open returns an error matching os.ErrNotExist for a missing key.
+	Open(key string) (io.ReadCloser, error)
+}
+
+// DirStore is a Store in a local directory, laid out as the store directory
+// is when Worker.Backend is unset.
+type DirStore struct {
+	Dir string
+
+	// FileMode and DirMode are the modes of the files and directories
+	// created. A Worker writing to the DirStore fills in its own for those
+	// unset, otherwise they default to 0600 and 0700.
+	FileMode os.FileMode
+	DirMode  os.FileMode
+}
+
+func (s DirStore) path(key string) string {
+	return filepath.Join(s.Dir, filepath.FromSlash(key))
+}
+
+func (s DirStore) Exists(key string) (bool, error) {
+	_, err := os.Stat(s.path(key))
+	if errors.Is(err, os.ErrNotExist) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (s DirStore) Write(key string, r io.Reader) error {
+	p := s.path(key)
+	dir, name := filepath.Split(p)
+	fileMode, dirMode := s.FileMode, s.DirMode
+	if fileMode == 0 {
+		fileMode = defaultFileMode
+	}
+	if dirMode == 0 {
+		dirMode = defaultDirMode
+	}
+	if err := mkdirAllMode(dir, dirMode); err != nil {
+		return err
+	}
+	tmp, err := writeTemp(dir, name, fileMode, func(f *os.File) error {
+		_, err := io.Copy(f, r)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, p); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return nil
+}
+
+func (s DirStore) Open(key string) (io.ReadCloser, error) {
+	return os.Open(s.path(key))
+}
+
+// checkBackend rejects options that need the message files on local disk.
+func (w *Worker) checkBackend() error {
+	if w.Backend == nil {
+		return nil
+	}
+	switch {
+	case len(w.Format) > 0 && w.Format != FormatNative:
+		return fmt.Errorf("a Backend only supports the %s format", FormatNative)
+	case w.Mirror:
+		return fmt.Errorf("mirror is not supported with a Backend")
+	}
+	return nil
+}
+
+// backendKey returns the Backend key of the file name in dir.
+func (w *Worker) backendKey(dir, name string) (string, error) {
+	rel, err := filepath.Rel(w.Store, filepath.Join(dir, name))
+	if err != nil {
+		return "", err
+	}
+	return filepath.ToSlash(rel), nil
+}
+
+// openBackend opens a native message file in the Backend, decrypting and
+// decompressing it if needed.
+func (w *Worker) openBackend(key string) (io.ReadCloser, error) {
+	rc, err := w.Backend.Open(key)
+	if err != nil {
+		return nil, err
+	}
+	return w.decodeStored(rc, key)
+}
+
+// backend returns Backend, with the FileMode and DirMode of the Worker for
+// a DirStore that does not set its own.
+func (w *Worker) backend() Store {
+	ds, ok := w.Backend.(DirStore)
+	if !ok {
+		return w.Backend
+	}
+	if ds.FileMode == 0 {
+		ds.FileMode = w.fileMode()
+	}
+	if ds.DirMode == 0 {
+		ds.DirMode = w.dirMode()
+	}
+	return ds
+}
+
+// writeBackend stores the complete file tmpName in the Backend as name in
+// dir.
+func (w *Worker) writeBackend(dir, name, tmpName string) error {
+	key, err := w.backendKey(dir, name)
+	if err != nil {
+		return err
+	}
+	f, err := os.Open(tmpName)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if err := w.backend().Write(key, f); err != nil {
+		return fmt.Errorf("backend: %w", err)
+	}
+	return nil
+}
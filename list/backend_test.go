@@ -0,0 +1,86 @@
+package list
+
+import (
+	"context"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// modes returns the permission bits of every file and directory below dir.
+func modes(t *testing.T, dir string) (files, dirs []os.FileMode) {
+	t.Helper()
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || path == dir {
+			return err
+		}
+		fi, err := d.Info()
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			dirs = append(dirs, fi.Mode().Perm())
+		} else {
+			files = append(files, fi.Mode().Perm())
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return files, dirs
+}
+
+func TestDirStoreModes(t *testing.T) {
+	addr := testServer(t)
+	for _, tc := range []struct {
+		name      string
+		ds        DirStore
+		opts      []Option
+		file, dir os.FileMode
+	}{
+		{name: "default", file: 0600, dir: 0700},
+		{name: "worker", opts: []Option{WithModes(0640, 0750, false)}, file: 0640, dir: 0750},
+		{name: "own", ds: DirStore{FileMode: 0644, DirMode: 0755}, opts: []Option{WithModes(0640, 0750, false)}, file: 0644, dir: 0755},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			ds := tc.ds
+			ds.Dir = filepath.Join(t.TempDir(), "backend")
+			w := testWorker(t, append(tc.opts, WithBackend(ds), WithLayout(LayoutFolder))...)
+			sum, err := w.List(context.Background(), addr, "username", "password")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if sum.Fetched != 1 {
+				t.Fatalf("fetched %d, want 1", sum.Fetched)
+			}
+			files, dirs := modes(t, ds.Dir)
+			if len(files) == 0 || len(dirs) == 0 {
+				t.Fatalf("backend holds %d files and %d directories", len(files), len(dirs))
+			}
+			for _, m := range files {
+				if m != tc.file {
+					t.Errorf("file mode %v, want %v", m, tc.file)
+				}
+			}
+			for _, m := range dirs {
+				if m != tc.dir {
+					t.Errorf("directory mode %v, want %v", m, tc.dir)
+				}
+			}
+		})
+	}
+}
+
+func TestDirStoreWrite(t *testing.T) {
+	ds := DirStore{Dir: t.TempDir()}
+	if err := ds.Write("a/b/key", strings.NewReader("body")); err != nil {
+		t.Fatal(err)
+	}
+	files, dirs := modes(t, ds.Dir)
+	if len(files) != 1 || files[0] != 0600 || len(dirs) != 2 || dirs[0] != 0700 || dirs[1] != 0700 {
+		t.Fatalf("file modes %v, directory modes %v", files, dirs)
+	}
+}
@@ -0,0 +1,99 @@
+package list
+
+import (
+	"bufio"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+)
+
+// objectsDir holds the bodies of the cas format, each named by the hex
+// body hash under a directory of its first two digits.
+const objectsDir = "objects"
+
+// headerFiles reports whether messages are stored as files starting with a
+// Header, as in the native and cas formats.
+func (w *Worker) headerFiles() bool {
+	return len(w.Format) == 0 || w.Format == FormatNative || w.Format == FormatCAS
+}
+
+func (w *Worker) checkCAS() error {
+	if w.Format != FormatCAS {
+		return nil
+	}
+	switch {
+	case w.SkipBodyHash:
+		return fmt.Errorf("the %s format names bodies by their hash and can't skip it", FormatCAS)
+	case w.Backend != nil:
+		return fmt.Errorf("the %s format is not supported with a Backend", FormatCAS)
+	}
+	return nil
+}
+
+// objectNames returns the store relative paths the body with hash may be
+// stored under.
+func objectNames(hash []byte) []string {
+	sum := hex.EncodeToString(hash)
+	name := path.Join(objectsDir, sum[:2], sum)
+	return []string{name, name + gzSuffix}
+}
+
+// writeObject stores the body in spool, hashed into h, as an object unless
+// one with its hash is already stored, and sets h.Object. Objects are gzip
+// compressed with Compress.
+func (w *Worker) writeObject(spool *os.File, h *Header) error {
+	names := objectNames(h.Hash)
+	for _, name := range names {
+		if _, err := os.Stat(filepath.Join(w.Store, filepath.FromSlash(name))); err == nil {
+			h.Object = name
+			return nil
+		}
+	}
+	name := names[0]
+	if w.Compress {
+		name = names[1]
+	}
+	p := filepath.Join(w.Store, filepath.FromSlash(name))
+	if err := w.mkdirAll(filepath.Dir(p)); err != nil {
+		return err
+	}
+	if _, err := spool.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	tmp, err := writeTemp(filepath.Dir(p), filepath.Base(p), w.fileMode(), func(f *os.File) error {
+		bw := bufio.NewWriter(f)
+		out, err := w.storedWriter(bw, name)
+		if err != nil {
+			return err
+		}
+		if _, err := io.Copy(out, spool); err != nil {
+			return err
+		}
+		if err := out.Close(); err != nil {
+			return err
+		}
+		return bw.Flush()
+	})
+	if err != nil {
+		return fmt.Errorf("object: %w", err)
+	}
+	if err := os.Rename(tmp, p); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("object: %w", err)
+	}
+	h.Object = name
+	return nil
+}
+
+// openObject opens the body of the cas message file at path, the object
+// named by rel within Store.
+func (w *Worker) openObject(path, rel string) (io.ReadCloser, error) {
+	p, err := storePath(w.Store, path, rel)
+	if err != nil {
+		return nil, fmt.Errorf("object %s: %w", rel, err)
+	}
+	return w.openStored(p)
+}
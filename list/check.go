@@ -0,0 +1,40 @@
+package list
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/emersion/go-imap/client"
+)
+
+// Check connects to server with the connection settings of the Worker, logs
+// in, and asks for the capabilities of the server, without retries. It then
+// opens INBOX read-only, which every server has, and logs out. Nothing is
+// downloaded or written. The error tells which step failed; see ErrConnect,
+// ErrTLS, and ErrAuth.
+func (w *Worker) Check(ctx context.Context, server, username, password string) error {
+	c, err := w.connect(ctx, server, username, password)
+	if err != nil {
+		return err
+	}
+	if err := w.checkConn(c); err != nil {
+		c.Logout()
+		return err
+	}
+	if err := c.Logout(); err != nil {
+		return fmt.Errorf("logout: %w", err)
+	}
+	return nil
+}
+
+func (w *Worker) checkConn(c *client.Client) error {
+	if err := w.logCapabilities(c, "check"); err != nil {
+		return err
+	}
+	status, err := c.Select("INBOX", true)
+	if err != nil {
+		return fmt.Errorf("select INBOX: %w", err)
+	}
+	w.log("INBOX: %d messages", status.Messages)
+	return nil
+}
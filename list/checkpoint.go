@@ -0,0 +1,65 @@
+package list
+
+// checkpoint records the progress of fetching a folder's bodies in the
+// incremental state after each batch, so a run that fails part way through
+// a large folder resumes after the last complete batch instead of scanning
+// the whole folder again.
+type checkpoint struct {
+	w           *Worker
+	folder      string
+	uidValidity uint32
+	uids        []uint32 // UIDs to fetch, ascending.
+	batch       int
+	limit       uint32 // Highest UID that may be recorded.
+
+	done  map[uint32]bool // Handled out of order, see handled.
+	next  int             // uids[:next] are handled.
+	saved int             // next when last saved.
+}
+
+func (w *Worker) newCheckpoint(folder string, uidValidity uint32, uids []uint32, batch int, limit uint32) *checkpoint {
+	return &checkpoint{
+		w:           w,
+		folder:      folder,
+		uidValidity: uidValidity,
+		uids:        uids,
+		batch:       batch,
+		limit:       limit,
+		done:        map[uint32]bool{},
+	}
+}
+
+// handled records that uid was written or found gone. Batches fetched in
+// parallel finish out of order, so progress is only recorded up to the
+// first uid not yet handled.
+func (cp *checkpoint) handled(uid uint32) error {
+	cp.done[uid] = true
+	n := cp.next
+	for n < len(cp.uids) && cp.done[cp.uids[n]] {
+		delete(cp.done, cp.uids[n])
+		n++
+	}
+	if n-cp.saved < cp.batch {
+		cp.next = n
+		return nil
+	}
+	return cp.through(n)
+}
+
+// through records that uids[:n] are handled. Every message below uids[n] is
+// then in the store, so the next run may start there. The end of the folder
+// is left to finish.
+func (cp *checkpoint) through(n int) error {
+	if n > cp.next {
+		cp.next = n
+	}
+	if n <= cp.saved || n >= len(cp.uids) {
+		return nil
+	}
+	cp.saved = n
+	last := cp.uids[n] - 1
+	if last > cp.limit {
+		last = cp.limit
+	}
+	return cp.w.saveFolderState(cp.folder, cp.uidValidity, last)
+}
@@ -0,0 +1,130 @@
+package list
+
+import (
+	"bytes"
+	"compress/flate"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/client"
+)
+
+// deflateConn is the connection under the IMAP client when Compression is
+// set. It passes data through until start is called after the server
+// accepts COMPRESS DEFLATE (RFC 4978), then deflates both directions.
+//
+// go-imap offers no way to pause its reader goroutine, which is already
+// blocked in Read when the server replies OK. Bytes returned by that read
+// arrive after the switch and so are compressed; they are fed to the
+// inflater instead of being returned as is.
+type deflateConn struct {
+	net.Conn
+
+	mu sync.Mutex
+	fr io.ReadCloser
+	fw *flate.Writer
+
+	pending bytes.Buffer // Read by the inflater before Conn, reader goroutine only.
+}
+
+func (d *deflateConn) reader() io.Reader {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.fr
+}
+
+func (d *deflateConn) writer() *flate.Writer {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.fw
+}
+
+func (d *deflateConn) Read(p []byte) (int, error) {
+	if r := d.reader(); r != nil {
+		return r.Read(p)
+	}
+	n, err := d.Conn.Read(p)
+	r := d.reader()
+	if n == 0 || r == nil {
+		return n, err
+	}
+	d.pending.Write(p[:n])
+	return r.Read(p)
+}
+
+func (d *deflateConn) Write(p []byte) (int, error) {
+	if fw := d.writer(); fw != nil {
+		return fw.Write(p)
+	}
+	return d.Conn.Write(p)
+}
+
+// Flush is called by go-imap after each command, which must reach the server
+// before it can reply.
+func (d *deflateConn) Flush() error {
+	if fw := d.writer(); fw != nil {
+		return fw.Flush()
+	}
+	return nil
+}
+
+func (d *deflateConn) start() error {
+	fw, err := flate.NewWriter(d.Conn, flate.DefaultCompression)
+	if err != nil {
+		return err
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.fr = flate.NewReader(deflateSource{d})
+	d.fw = fw
+	return nil
+}
+
+// deflateSource is the compressed stream: bytes already read, then Conn.
+type deflateSource struct {
+	d *deflateConn
+}
+
+func (s deflateSource) Read(p []byte) (int, error) {
+	if s.d.pending.Len() > 0 {
+		return s.d.pending.Read(p)
+	}
+	return s.d.Conn.Read(p)
+}
+
+type compressCmd struct{}
+
+func (compressCmd) Command() *imap.Command {
+	return &imap.Command{Name: "COMPRESS", Arguments: []interface{}{imap.RawString("DEFLATE")}}
+}
+
+// compress enables COMPRESS=DEFLATE on a logged in client if the server
+// supports it. dc is nil when the connection can't be compressed.
+func (w *Worker) compress(c *client.Client, dc *deflateConn) error {
+	if dc == nil {
+		return nil
+	}
+	ok, err := c.Support("COMPRESS=DEFLATE")
+	if err != nil {
+		return fmt.Errorf("capability: %w", err)
+	}
+	if !ok {
+		w.log("Server does not support COMPRESS=DEFLATE")
+		return nil
+	}
+	status, err := c.Execute(compressCmd{}, nil)
+	if err == nil {
+		err = status.Err()
+	}
+	if err != nil {
+		return fmt.Errorf("compress: %w", err)
+	}
+	if err := dc.start(); err != nil {
+		return fmt.Errorf("compress: %w", err)
+	}
+	w.log("Compression enabled")
+	return nil
+}
@@ -0,0 +1,202 @@
+package list
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-imap/client"
+)
+
+// TLS modes for Worker.TLSMode.
+const (
+	TLSImplicit = "implicit" // TLS from the first byte, usually port 993.
+	TLSStartTLS = "starttls" // Plaintext connect then upgrade, usually port 143.
+	TLSPlain    = "plain"    // No encryption.
+)
+
+// Errors from connecting and logging in, for use with errors.Is. The
+// returned error also includes the underlying cause, such as the text the
+// server sent with a rejected login.
+var (
+	ErrAuth    = errors.New("authentication failed") // Credentials rejected, never retried.
+	ErrConnect = errors.New("connection failed")     // Server unreachable, connection lost, or no greeting.
+	ErrTLS     = errors.New("tls failed")            // Handshake or certificate failure.
+)
+
+// greetTimeout bounds the TLS handshake and server greeting so a mode that
+// does not match the port fails instead of hanging.
+const greetTimeout = time.Second * 15
+
+// account is a server and the credentials to log in to it.
+type account struct {
+	server, username, secret string
+}
+
+// connect dials server, or calls Dial, and logs in.
+func (w *Worker) connect(ctx context.Context, server, username, secret string) (*client.Client, error) {
+	var c *client.Client
+	var dc *deflateConn
+	var err error
+	if w.Dial != nil {
+		c, err = w.Dial(ctx, server)
+		if err != nil {
+			return nil, fmt.Errorf("%w: dial %v: %w", ErrConnect, server, err)
+		}
+	} else {
+		c, dc, err = w.dial(ctx, server)
+		if err != nil {
+			return nil, err
+		}
+	}
+	c.Timeout = w.OpTimeout
+	if err := w.login(c, server, username, secret); err != nil {
+		c.Logout()
+		return nil, err
+	}
+	if err := w.logCapabilities(c, "after login"); err != nil {
+		c.Logout()
+		return nil, err
+	}
+	if err := w.compress(c, dc); err != nil {
+		c.Logout()
+		return nil, err
+	}
+	return c, nil
+}
+
+// logCapabilities records the server capabilities in LastCapabilities and
+// logs them. They may change after STARTTLS and login.
+func (w *Worker) logCapabilities(c *client.Client, when string) error {
+	caps, err := c.Capability()
+	if err != nil {
+		return fmt.Errorf("capability: %w", err)
+	}
+	list := make([]string, 0, len(caps))
+	for name := range caps {
+		list = append(list, name)
+	}
+	sort.Strings(list)
+	w.mu.Lock()
+	w.LastCapabilities = list
+	w.mu.Unlock()
+	w.log("Capabilities %s: %s", when, strings.Join(list, " "))
+	return nil
+}
+
+// connectRetry is connect with retries for transient failures.
+func (w *Worker) connectRetry(ctx context.Context, server, username, secret string) (*client.Client, error) {
+	var c *client.Client
+	err := w.withRetry(ctx, "connect "+server, func() error {
+		var err error
+		c, err = w.connect(ctx, server, username, secret)
+		return err
+	})
+	return c, err
+}
+
+func (w *Worker) dial(ctx context.Context, server string) (*client.Client, *deflateConn, error) {
+	host, _, err := net.SplitHostPort(server)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid server address %q: %w", server, err)
+	}
+	mode := w.TLSMode
+	if len(mode) == 0 {
+		mode = TLSImplicit
+	}
+	switch mode {
+	default:
+		return nil, nil, fmt.Errorf("unknown TLS mode %q", mode)
+	case TLSImplicit, TLSStartTLS, TLSPlain:
+	}
+	tlsConfig := &tls.Config{}
+	if w.TLSConfig != nil {
+		tlsConfig = w.TLSConfig.Clone()
+	}
+	if len(tlsConfig.ServerName) == 0 {
+		tlsConfig.ServerName = host
+	}
+
+	d, err := w.dialer()
+	if err != nil {
+		return nil, nil, err
+	}
+	conn, err := d.DialContext(ctx, "tcp", server)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%w: dial %v: %w", ErrConnect, server, err)
+	}
+	err = conn.SetDeadline(time.Now().Add(greetTimeout))
+	if err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	if l := w.limiter(); l != nil {
+		conn = &throttledConn{Conn: conn, l: l}
+	}
+	raw := conn
+
+	if mode == TLSImplicit {
+		tc := tls.Client(conn, tlsConfig)
+		if err := tc.HandshakeContext(ctx); err != nil {
+			conn.Close()
+			return nil, nil, fmt.Errorf("%w: handshake with %v (if this is a plaintext port try -tls %s): %w", ErrTLS, server, TLSStartTLS, err)
+		}
+		conn = tc
+	}
+	var dc *deflateConn
+	if w.Compression {
+		// Compression must run inside TLS, and go-imap adds STARTTLS below
+		// the connection it was given.
+		if mode == TLSStartTLS {
+			w.log("Compression is not supported with STARTTLS")
+		} else {
+			dc = &deflateConn{Conn: conn}
+			conn = dc
+		}
+	}
+
+	c, err := client.New(conn)
+	if err != nil {
+		conn.Close()
+		if mode != TLSImplicit {
+			return nil, nil, fmt.Errorf("%w: greeting from %v (if this is an implicit TLS port try -tls %s): %w", ErrConnect, server, TLSImplicit, err)
+		}
+		return nil, nil, fmt.Errorf("%w: greeting from %v: %w", ErrConnect, server, err)
+	}
+	err = raw.SetDeadline(time.Time{})
+	if err != nil {
+		c.Terminate()
+		return nil, nil, err
+	}
+
+	if err := w.logCapabilities(c, "on connect"); err != nil {
+		c.Logout()
+		return nil, nil, err
+	}
+
+	if mode == TLSStartTLS {
+		ok, err := c.SupportStartTLS()
+		if err != nil {
+			c.Logout()
+			return nil, nil, fmt.Errorf("capability: %w", err)
+		}
+		if !ok {
+			c.Logout()
+			return nil, nil, fmt.Errorf("server %v does not advertise STARTTLS", server)
+		}
+		if err := c.StartTLS(tlsConfig); err != nil {
+			c.Logout()
+			return nil, nil, fmt.Errorf("%w: starttls: %w", ErrTLS, err)
+		}
+		if err := w.logCapabilities(c, "after STARTTLS"); err != nil {
+			c.Logout()
+			return nil, nil, err
+		}
+	}
+	return c, dc, nil
+}
@@ -0,0 +1,87 @@
+package list
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"testing"
+
+	"github.com/emersion/go-imap/backend/memory"
+	"github.com/emersion/go-imap/client"
+	"github.com/emersion/go-imap/server"
+)
+
+// pipeListener hands a server the far ends of net.Pipe connections, so it
+// runs in process without a socket.
+type pipeListener struct {
+	conns chan net.Conn
+	done  chan struct{}
+}
+
+func (l *pipeListener) Accept() (net.Conn, error) {
+	select {
+	case c := <-l.conns:
+		return c, nil
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *pipeListener) Close() error {
+	select {
+	case <-l.done:
+	default:
+		close(l.done)
+	}
+	return nil
+}
+
+func (l *pipeListener) Addr() net.Addr { return pipeAddr{} }
+
+type pipeAddr struct{}
+
+func (pipeAddr) Network() string { return "pipe" }
+func (pipeAddr) String() string  { return "pipe" }
+
+func TestDial(t *testing.T) {
+	l := &pipeListener{conns: make(chan net.Conn), done: make(chan struct{})}
+	s := server.New(memory.New())
+	s.AllowInsecureAuth = true
+	// Replies after LOGOUT hit the closed pipe; don't log those.
+	s.ErrorLog = log.New(io.Discard, "", 0)
+	go s.Serve(l)
+	t.Cleanup(func() { s.Close() })
+
+	var addrs []string
+	w := New(t.TempDir(), WithDial(func(ctx context.Context, addr string) (*client.Client, error) {
+		addrs = append(addrs, addr)
+		cc, sc := net.Pipe()
+		select {
+		case l.conns <- sc:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		return client.New(cc)
+	}))
+	sum, err := w.List(context.Background(), "in-process", "username", "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sum.Fetched != 1 {
+		t.Fatalf("fetched %d messages, want 1", sum.Fetched)
+	}
+	if len(addrs) == 0 || addrs[0] != "in-process" {
+		t.Fatalf("Dial called with %q", addrs)
+	}
+
+	dialErr := errors.New("no route")
+	w.Dial = func(ctx context.Context, addr string) (*client.Client, error) {
+		return nil, dialErr
+	}
+	err = w.Check(context.Background(), "in-process", "username", "password")
+	if !errors.Is(err, ErrConnect) || !errors.Is(err, dialErr) {
+		t.Fatalf("Check with a failing Dial: %v, want %v wrapping %v", err, ErrConnect, dialErr)
+	}
+}
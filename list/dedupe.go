@@ -0,0 +1,154 @@
+package list
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// Dedupe finds stored messages with the same body Hash and keeps the first
+// file of each group in store order. Every other file is replaced with just
+// its header, with DuplicateOf naming the kept file, or deleted if remove is
+// set. A deleted message is downloaded again by the next List while it is
+// still on the server. With DryRun the duplicates are only reported.
+//
+// Dedupe only reads and writes the store; the server is never contacted.
+// Mirror may later trash a kept file that duplicates point to, which Verify
+// reports.
+func (w *Worker) Dedupe(ctx context.Context, remove bool) error {
+	if len(w.Format) > 0 && w.Format != FormatNative {
+		return fmt.Errorf("dedupe only supports the %s format", FormatNative)
+	}
+	if w.Backend != nil {
+		return fmt.Errorf("dedupe is not supported with a Backend")
+	}
+	if err := w.checkModes(); err != nil {
+		return err
+	}
+	kept := map[string]string{} // Body hash, with its algorithm, to the kept file.
+	var total, dups int
+	var reclaimed int64
+	err := w.walkStore(ctx, func(path string) error {
+		sf, err := w.openStored(path)
+		if err != nil {
+			return err
+		}
+		h, err := readHeader(bufio.NewReader(sf))
+		sf.Close()
+		if err != nil {
+			w.print("dedupe: skip %s: %v", path, err)
+			return nil
+		}
+		if h.Skipped || len(h.DuplicateOf) > 0 || len(h.Hash) == 0 {
+			return nil
+		}
+		total++
+		rel, err := filepath.Rel(w.Store, path)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		sum := contentKey(&h)
+		first, ok := kept[sum]
+		if !ok {
+			kept[sum] = rel
+			return nil
+		}
+		dups++
+		fi, err := os.Stat(path)
+		if err != nil {
+			return err
+		}
+		w.log("duplicate %s of %s", rel, first)
+		switch {
+		case w.DryRun:
+			reclaimed += fi.Size()
+		case remove:
+			if err := os.Remove(path); err != nil {
+				return err
+			}
+			reclaimed += fi.Size()
+		default:
+			_, err := w.rewriteHeader(path, true, func(h *Header) bool {
+				h.DuplicateOf = first
+				return true
+			})
+			if err != nil {
+				return fmt.Errorf("%s: %w", rel, err)
+			}
+			nfi, err := os.Stat(path)
+			if err != nil {
+				return err
+			}
+			reclaimed += fi.Size() - nfi.Size()
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if w.DryRun {
+		w.print("dry-run: %d duplicates of %d messages, would reclaim %d bytes", dups, total, reclaimed)
+		return nil
+	}
+	w.print("dedupe: %d duplicates of %d messages, reclaimed %d bytes", dups, total, reclaimed)
+	if dups == 0 {
+		return nil
+	}
+	if _, err := os.Stat(filepath.Join(w.Store, indexFile)); err == nil {
+		return w.RebuildIndex(ctx)
+	}
+	return nil
+}
+
+// contentKey identifies the body of h by its Hash and HashAlgo.
+func contentKey(h *Header) string {
+	algo := h.HashAlgo
+	if len(algo) == 0 {
+		algo = HashBlake2b256
+	}
+	return algo + ":" + string(h.Hash)
+}
+
+// contentOriginal returns the store relative path of a message file already
+// holding the body recorded in h, for DedupeByContent.
+func (w *Worker) contentOriginal(h *Header) (string, bool, error) {
+	if len(h.Hash) == 0 {
+		return "", false, nil
+	}
+	w.idxMu.Lock()
+	orig, ok := w.idxBody[contentKey(h)]
+	w.idxMu.Unlock()
+	if !ok {
+		return "", false, nil
+	}
+	path, err := w.storedPath(&orig)
+	if errors.Is(err, os.ErrNotExist) {
+		return "", false, nil
+	}
+	if err != nil {
+		return "", false, err
+	}
+	rel, err := filepath.Rel(w.Store, path)
+	if err != nil {
+		return "", false, err
+	}
+	return filepath.ToSlash(rel), true, nil
+}
+
+// indexBody records h as holding its body, unless it is not stored or only
+// refers to another file.
+func (w *Worker) indexBody(h *Header) {
+	if w.idxBody == nil || h.Skipped || len(h.DuplicateOf) > 0 || len(h.Hash) == 0 {
+		return
+	}
+	if _, ok := w.idxBody[contentKey(h)]; ok {
+		return
+	}
+	ih := *h
+	ih.RawHeader = ""
+	w.idxBody[contentKey(h)] = ih
+}
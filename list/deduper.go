@@ -0,0 +1,155 @@
+package list
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+)
+
+// DeduperFile is where the -dedupe-message-id flag keeps its Deduper, under
+// the store root.
+const DeduperFile = ".message-ids.jsonl"
+
+// Deduper is a set of the Message-IDs stored, kept in a file of JSON lines
+// so it lasts across runs. It is safe for concurrent use and may be shared
+// by Workers, such as those of several accounts. See Worker.Deduper.
+type Deduper struct {
+	path string
+	mode os.FileMode
+
+	mu      sync.Mutex
+	keys    map[string]string // Message-ID to the key it is stored under.
+	claimed map[string]bool   // Message-IDs being fetched, not yet marked.
+	f       *os.File
+}
+
+type dedupeRecord struct {
+	MessageID string
+	Key       string
+}
+
+// OpenDeduper reads the Deduper kept in the file at path, which need not
+// exist yet. It is created with mode, 0600 if zero, on the first Mark. A
+// last line cut short by a crash is ignored.
+func OpenDeduper(path string, mode os.FileMode) (*Deduper, error) {
+	if mode == 0 {
+		mode = defaultFileMode
+	}
+	d := &Deduper{
+		path:    path,
+		mode:    mode,
+		keys:    map[string]string{},
+		claimed: map[string]bool{},
+	}
+	b, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return d, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("deduper: %w", err)
+	}
+	lines := bytes.Split(b, []byte("\n"))
+	for i, line := range lines {
+		if len(line) == 0 {
+			continue
+		}
+		var r dedupeRecord
+		if err := json.Unmarshal(line, &r); err != nil {
+			if i == len(lines)-1 {
+				break
+			}
+			return nil, fmt.Errorf("deduper %s line %d: %w", path, i+1, err)
+		}
+		d.keys[r.MessageID] = r.Key
+	}
+	return d, nil
+}
+
+// Seen reports whether a message with messageID was marked, or is being
+// fetched. An empty messageID is never seen.
+func (d *Deduper) Seen(messageID string) bool {
+	if len(messageID) == 0 {
+		return false
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	_, ok := d.keys[messageID]
+	return ok || d.claimed[messageID]
+}
+
+// Mark records that the message with messageID is stored under key. An
+// empty messageID is not recorded.
+func (d *Deduper) Mark(messageID, key string) error {
+	if len(messageID) == 0 {
+		return nil
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	delete(d.claimed, messageID)
+	if _, ok := d.keys[messageID]; ok {
+		return nil
+	}
+	if d.f == nil {
+		f, err := os.OpenFile(d.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, d.mode)
+		if err != nil {
+			return fmt.Errorf("deduper: %w", err)
+		}
+		d.f = f
+	}
+	b, err := json.Marshal(dedupeRecord{MessageID: messageID, Key: key})
+	if err != nil {
+		return err
+	}
+	if _, err := d.f.Write(append(b, '\n')); err != nil {
+		return fmt.Errorf("deduper: %w", err)
+	}
+	d.keys[messageID] = key
+	return nil
+}
+
+// claim is Seen, and if not seen notes that messageID is being fetched, so
+// the message is fetched once even by folders processed in parallel.
+func (d *Deduper) claim(messageID string) bool {
+	if len(messageID) == 0 {
+		return true
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if _, ok := d.keys[messageID]; ok || d.claimed[messageID] {
+		return false
+	}
+	d.claimed[messageID] = true
+	return true
+}
+
+// release drops the claims of messageIDs that were not marked, such as
+// after a failed fetch, so they are fetched again.
+func (d *Deduper) release(messageIDs []string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for _, id := range messageIDs {
+		delete(d.claimed, id)
+	}
+}
+
+// Close syncs and closes the file of the Deduper. It may still be used
+// after, reopening the file.
+func (d *Deduper) Close() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.f == nil {
+		return nil
+	}
+	err := d.f.Sync()
+	if cerr := d.f.Close(); err == nil {
+		err = cerr
+	}
+	d.f = nil
+	if err != nil {
+		return fmt.Errorf("deduper: %w", err)
+	}
+	return nil
+}
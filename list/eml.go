@@ -0,0 +1,115 @@
+package list
+
+import (
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// File suffixes of the eml format: the raw message and its Header.
+const (
+	emlSuffix  = ".eml"
+	metaSuffix = ".json"
+)
+
+// emlExists reports whether both files of a message are in dir.
+func emlExists(dir, key string) (bool, error) {
+	for _, suffix := range []string{emlSuffix, metaSuffix} {
+		_, err := os.Stat(filepath.Join(dir, key+suffix))
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+		if err != nil {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+// emlKey returns the key of an eml format file name.
+func emlKey(name string) (string, bool) {
+	for _, suffix := range []string{emlSuffix, metaSuffix} {
+		if strings.HasSuffix(name, suffix) {
+			return strings.TrimSuffix(name, suffix), true
+		}
+	}
+	return "", false
+}
+
+// writeEML writes the body unchanged to dir/<key>.eml and h, with the body
+// Size and Hash filled in, to dir/<key>.json. The message file is renamed into
+// place first, so a message only counts as stored once both are.
+func (w *Worker) writeEML(dir string, h *Header, date time.Time, body io.Reader, hasher hash.Hash) error {
+	emlTmp, err := writeTemp(dir, h.Key, w.fileMode(), func(f *os.File) error {
+		if err := w.copyBody(f, body, h, hasher); err != nil {
+			return fmt.Errorf("body copy: %w", err)
+		}
+		if !w.StoreRawHeaders {
+			return nil
+		}
+		if _, err := f.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+		var err error
+		h.RawHeader, err = readRawHeader(f)
+		if err != nil {
+			return fmt.Errorf("raw header: %w", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	defer os.Remove(emlTmp)
+	if err := w.setModTime(emlTmp, h.Key, date); err != nil {
+		return err
+	}
+
+	metaTmp, err := writeTemp(dir, h.Key, w.fileMode(), func(f *os.File) error {
+		e := json.NewEncoder(f)
+		e.SetEscapeHTML(false)
+		e.SetIndent("", "\t")
+		if err := e.Encode(h); err != nil {
+			return fmt.Errorf("marshal header: %w", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	defer os.Remove(metaTmp)
+
+	if err := os.Rename(emlTmp, filepath.Join(dir, h.Key+emlSuffix)); err != nil {
+		return err
+	}
+	return os.Rename(metaTmp, filepath.Join(dir, h.Key+metaSuffix))
+}
+
+// writeTemp creates a temporary file in dir with mode, fills it with write,
+// and syncs it. It returns the name of the complete file.
+func writeTemp(dir, key string, mode os.FileMode, write func(f *os.File) error) (string, error) {
+	f, err := os.CreateTemp(dir, key+".*.tmp")
+	if err != nil {
+		return "", err
+	}
+	err = f.Chmod(mode)
+	if err == nil {
+		err = write(f)
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return "", err
+	}
+	return f.Name(), nil
+}
@@ -0,0 +1,163 @@
+package list
+
+import (
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strings"
+
+	"filippo.io/age"
+)
+
+// ageSuffix marks a native message file encrypted with age
+// (age-encryption.org/v1). It follows gzSuffix, as the file is compressed
+// before it is encrypted.
+const ageSuffix = ".age"
+
+var errNoIdentity = errors.New("file is encrypted; set Identity to read it")
+
+// storedNames returns the names a native message file of key may have.
+func storedNames(key string) []string {
+	return []string{key, key + gzSuffix, key + ageSuffix, key + gzSuffix + ageSuffix}
+}
+
+// storedKey returns the key of a native message file name.
+func storedKey(name string) string {
+	return strings.TrimSuffix(strings.TrimSuffix(name, ageSuffix), gzSuffix)
+}
+
+// storedSuffix returns the compression and encryption suffixes of path.
+func storedSuffix(path string) string {
+	name := filepath.Base(path)
+	return name[len(storedKey(name)):]
+}
+
+// nativeSuffix returns the suffixes of the native message files written.
+func (w *Worker) nativeSuffix() string {
+	s := ""
+	// The files of the cas format only hold a header; Compress applies to
+	// the objects.
+	if w.Compress && w.Format != FormatCAS {
+		s += gzSuffix
+	}
+	if len(w.Encrypt) > 0 {
+		s += ageSuffix
+	}
+	return s
+}
+
+func (w *Worker) checkEncrypt() error {
+	if len(w.Encrypt) == 0 {
+		return nil
+	}
+	if _, err := w.recipients(); err != nil {
+		return err
+	}
+	switch {
+	case len(w.Format) > 0 && w.Format != FormatNative:
+		return fmt.Errorf("encryption only supports the %s format", FormatNative)
+	case w.Sink != nil:
+		return fmt.Errorf("encryption can't be used with a sink")
+	case w.ExtractAttachments:
+		return fmt.Errorf("encryption can't be used with ExtractAttachments, which stores attachments in the clear")
+	case !w.PlainIndex && (w.DetectMoves || w.DedupeByContent):
+		return fmt.Errorf("DetectMoves and DedupeByContent need the index; set PlainIndex to keep it with encryption")
+	}
+	return nil
+}
+
+func (w *Worker) recipients() ([]age.Recipient, error) {
+	r, err := age.ParseX25519Recipient(strings.TrimSpace(w.Encrypt))
+	if err != nil {
+		return nil, fmt.Errorf("encrypt: %w", err)
+	}
+	return []age.Recipient{r}, nil
+}
+
+func (w *Worker) identities() ([]age.Identity, error) {
+	if len(w.Identity) == 0 {
+		return nil, errNoIdentity
+	}
+	ids, err := age.ParseIdentities(strings.NewReader(w.Identity))
+	if err != nil {
+		return nil, fmt.Errorf("identity: %w", err)
+	}
+	return ids, nil
+}
+
+// storedWriter returns a writer to out that compresses and encrypts as the
+// suffixes of the native message file name call for. Close finishes the
+// file but does not close out.
+func (w *Worker) storedWriter(out io.Writer, name string) (io.WriteCloser, error) {
+	sw := &stackWriter{Writer: out}
+	if strings.HasSuffix(name, ageSuffix) {
+		if len(w.Encrypt) == 0 {
+			return nil, fmt.Errorf("%s is encrypted; set Encrypt to write it", filepath.Base(name))
+		}
+		rs, err := w.recipients()
+		if err != nil {
+			return nil, err
+		}
+		ew, err := age.Encrypt(sw.Writer, rs...)
+		if err != nil {
+			return nil, fmt.Errorf("encrypt: %w", err)
+		}
+		sw.push(ew)
+		name = strings.TrimSuffix(name, ageSuffix)
+	}
+	if strings.HasSuffix(name, gzSuffix) {
+		sw.push(gzip.NewWriter(sw.Writer))
+	}
+	return sw, nil
+}
+
+// stackWriter writes through a stack of writers, closing the outermost
+// first.
+type stackWriter struct {
+	io.Writer
+	closers []io.Closer
+}
+
+func (s *stackWriter) push(wc io.WriteCloser) {
+	s.Writer = wc
+	s.closers = append(s.closers, wc)
+}
+
+func (s *stackWriter) Close() error {
+	for i := len(s.closers) - 1; i >= 0; i-- {
+		if err := s.closers[i].Close(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// decodeStored undoes the encryption and compression of the native message
+// file name read from rc.
+func (w *Worker) decodeStored(rc io.ReadCloser, name string) (io.ReadCloser, error) {
+	var r io.Reader = rc
+	if strings.HasSuffix(name, ageSuffix) {
+		ids, err := w.identities()
+		if err != nil {
+			rc.Close()
+			return nil, err
+		}
+		r, err = age.Decrypt(rc, ids...)
+		if err != nil {
+			rc.Close()
+			return nil, fmt.Errorf("decrypt: %w", err)
+		}
+		name = strings.TrimSuffix(name, ageSuffix)
+	}
+	if strings.HasSuffix(name, gzSuffix) {
+		gz, err := gzip.NewReader(r)
+		if err != nil {
+			rc.Close()
+			return nil, fmt.Errorf("gzip: %w", err)
+		}
+		return &gzipFile{Reader: gz, f: rc}, nil
+	}
+	return storedBody{Reader: r, Closer: rc}, nil
+}
@@ -0,0 +1,171 @@
+package list
+
+import (
+	"context"
+	"sync"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/client"
+)
+
+// defaultMaxConnections is used when MaxConnections is unset. Common servers
+// allow about ten connections per user.
+const defaultMaxConnections = 10
+
+func (w *Worker) maxConnections() int {
+	if w.MaxConnections > 0 {
+		return w.MaxConnections
+	}
+	return defaultMaxConnections
+}
+
+// fetchConns opens up to n more connections to fetch bodies from mailbox in
+// parallel, each with the mailbox selected read-only. Each takes a slot from
+// connSlots and is not opened if none is free. A connection that fails is
+// logged and left out, so fewer, or none, may be returned.
+func (w *Worker) fetchConns(ctx context.Context, mailbox string, n int) []*client.Client {
+	if w.reconnect == nil {
+		return nil
+	}
+	var list []*client.Client
+	for i := 0; i < n; i++ {
+		select {
+		default:
+			w.log("\tconnection limit reached, %d extra fetch connections", len(list))
+			return list
+		case w.connSlots <- struct{}{}:
+		}
+		c, err := w.reconnect(ctx)
+		if err == nil {
+			_, err = c.Select(mailbox, true)
+			if err != nil {
+				c.Logout()
+			}
+		}
+		if err != nil {
+			<-w.connSlots
+			w.log("\textra fetch connection: %v", err)
+			return list
+		}
+		list = append(list, c)
+	}
+	return list
+}
+
+// closeFetchConns logs out of connections from fetchConns and frees their
+// slots.
+func (w *Worker) closeFetchConns(list []*client.Client) {
+	for _, c := range list {
+		if c.State() != imap.LogoutState {
+			c.Logout()
+		}
+		<-w.connSlots
+	}
+}
+
+// fetched is a message from fetchParallel, or the UIDs of a finished batch
+// that the server did not return because they were expunged since the
+// envelope fetch.
+type fetched struct {
+	msg  *imap.Message
+	gone []uint32
+}
+
+// fetchParallel fetches the messages with the given UIDs, batch per command,
+// over c and the extra connections at once, sending each to msgC. A batch's
+// gone UIDs are sent after its messages. msgC is closed when every
+// connection is done. The first error stops the rest.
+func (w *Worker) fetchParallel(ctx context.Context, ka *keepalive, c *client.Client, extra []*client.Client, uids []uint32, batch int, items []imap.FetchItem, msgC chan fetched) error {
+	defer close(msgC)
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	jobs := make(chan []uint32)
+	go func() {
+		defer close(jobs)
+		for _, b := range batches(uids, batch) {
+			select {
+			case <-ctx.Done():
+				return
+			case jobs <- b:
+			}
+		}
+	}()
+
+	// A command blocked on a cancelled run can only be stopped by closing
+	// its connection.
+	stop := make(chan struct{})
+	watched := make(chan struct{})
+	defer func() {
+		close(stop)
+		<-watched
+	}()
+	go func() {
+		defer close(watched)
+		select {
+		case <-stop:
+		case <-ctx.Done():
+			for _, ec := range extra {
+				ec.Terminate()
+			}
+		}
+	}()
+
+	var errOnce sync.Once
+	var firstErr error
+	wg := &sync.WaitGroup{}
+	run := func(fetch func(ss *imap.SeqSet, ch chan *imap.Message) error) {
+		defer wg.Done()
+		for job := range jobs {
+			ss := &imap.SeqSet{}
+			ss.AddNum(job...)
+			// Only the client closes ch, so each batch gets its own.
+			ch := make(chan *imap.Message, 10)
+			got := map[uint32]bool{}
+			done := make(chan struct{})
+			go func() {
+				defer close(done)
+				for msg := range ch {
+					got[msg.Uid] = true
+					msgC <- fetched{msg: msg}
+				}
+			}()
+			err := fetch(ss, ch)
+			<-done
+			if isNoMessages(err) {
+				// Expunged since the envelope fetch.
+				err = nil
+			}
+			if err != nil {
+				errOnce.Do(func() {
+					firstErr = err
+				})
+				cancel()
+				return
+			}
+			var gone []uint32
+			for _, uid := range job {
+				if !got[uid] {
+					gone = append(gone, uid)
+				}
+			}
+			if len(gone) > 0 {
+				msgC <- fetched{gone: gone}
+			}
+		}
+	}
+	wg.Add(1 + len(extra))
+	go run(func(ss *imap.SeqSet, ch chan *imap.Message) error {
+		return ka.do(func() error {
+			return c.UidFetch(ss, items, ch)
+		})
+	})
+	for _, ec := range extra {
+		ec := ec
+		go run(func(ss *imap.SeqSet, ch chan *imap.Message) error {
+			return ec.UidFetch(ss, items, ch)
+		})
+	}
+	wg.Wait()
+	return firstErr
+}
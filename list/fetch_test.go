@@ -0,0 +1,58 @@
+package list
+
+import (
+	"context"
+	"testing"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/client"
+)
+
+// TestFetchParallelGone checks that UIDs expunged between the envelope and
+// body fetches are reported, so the checkpoint moves past them.
+func TestFetchParallelGone(t *testing.T) {
+	addr := testServer(t)
+	testAppend(t, addr, "Big", 12)
+	testExpunge(t, addr, "Big", "5")
+
+	w := testWorker(t)
+	c := testConnect(t, addr)
+	ec := testConnect(t, addr)
+	for _, c := range []*client.Client{c, ec} {
+		if _, err := c.Select("Big", true); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ka := w.startKeepalive(c)
+	defer ka.stop()
+
+	var uids []uint32
+	for uid := uint32(1); uid <= 12; uid++ {
+		uids = append(uids, uid)
+	}
+	cp := w.newCheckpoint("Big", 1, uids, 3, 12)
+	msgC := make(chan fetched, 10)
+	errC := make(chan error, 1)
+	go func() {
+		errC <- w.fetchParallel(context.Background(), ka, c, []*client.Client{ec}, uids, 3, []imap.FetchItem{imap.FetchUid}, msgC)
+	}()
+	var gone []uint32
+	for f := range msgC {
+		if f.msg != nil {
+			cp.handled(f.msg.Uid)
+		}
+		for _, uid := range f.gone {
+			gone = append(gone, uid)
+			cp.handled(uid)
+		}
+	}
+	if err := <-errC; err != nil {
+		t.Fatal(err)
+	}
+	if len(gone) != 1 || gone[0] != 5 {
+		t.Errorf("gone %v, want [5]", gone)
+	}
+	if cp.next != len(uids) {
+		t.Errorf("checkpoint at %d of %d", cp.next, len(uids))
+	}
+}
@@ -0,0 +1,239 @@
+package list
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"strings"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/client"
+)
+
+// folders lists the mailboxes on the server that pass the folder filters.
+//
+// go-imap decodes names from modified UTF-7 (RFC 3501 5.1.3) when listing
+// and encodes them again in SELECT, STATUS, and APPEND, so names are already
+// readable in logs, Header.Folder, and folder directories. Decoding them
+// again would corrupt names containing "&".
+func (w *Worker) folders(ctx context.Context, c *client.Client) ([]*imap.MailboxInfo, error) {
+	miList := make([]*imap.MailboxInfo, 0, 100)
+
+	pattern, root, delim := "*", "", ""
+	if len(w.RootFolder) > 0 {
+		var err error
+		delim, err = delimiter(c)
+		if err != nil {
+			return nil, fmt.Errorf("list delimiter: %w", err)
+		}
+		root = w.RootFolder
+		if len(delim) > 0 {
+			root = strings.TrimSuffix(root, delim)
+		}
+		pattern = root + "*"
+	}
+
+	errC := make(chan error, 1)
+	ch := make(chan *imap.MailboxInfo, 10)
+
+	go func() {
+		if len(w.Folders) > 0 {
+			errC <- w.listFolders(c, ch)
+			return
+		}
+		errC <- listMailboxes(c, "", pattern, ch)
+	}()
+	use := map[string]string{}
+	for mi := range ch {
+		// The pattern also matches siblings such as "INBOX2" for "INBOX".
+		if len(root) > 0 && mi.Name != root && (len(delim) == 0 || !strings.HasPrefix(mi.Name, root+delim)) {
+			continue
+		}
+		use[mi.Name] = specialUseOf(mi)
+		if w.FolderFilter != nil && !w.FolderFilter(mi) {
+			continue
+		}
+		miList = append(miList, mi)
+	}
+	w.mu.Lock()
+	w.folderUse = use
+	w.mu.Unlock()
+	select {
+	case <-ctx.Done():
+	case err := <-errC:
+		if err != nil {
+			return nil, fmt.Errorf("list: %w", err)
+		}
+	}
+	for _, fs := range w.Folders {
+		if _, ok := use[fs.Name]; !ok {
+			w.print("Folder %s: not on the server, skipped", fs.Name)
+			w.addSummary(func(s *RunSummary) {
+				s.Errors = append(s.Errors, fmt.Sprintf("%s: not on the server", fs.Name))
+			})
+		}
+	}
+	filtered := miList[:0]
+	for _, mi := range miList {
+		ok, err := w.includeFolder(mi.Name)
+		if err != nil {
+			return nil, err
+		}
+		if ok && w.excludedUse(use[mi.Name]) {
+			w.log("Skip folder: %s, %s", mi.Name, use[mi.Name])
+			continue
+		}
+		if ok {
+			filtered = append(filtered, mi)
+			continue
+		}
+		w.log("Skip folder: %s", mi.Name)
+	}
+	miList = filtered
+	if w.PreferAllMail {
+		miList = w.preferAllMail(miList)
+	}
+	return miList, nil
+}
+
+// delimiter returns the hierarchy delimiter of the server, or "" if it has
+// a flat namespace.
+func delimiter(c *client.Client) (string, error) {
+	errC := make(chan error, 1)
+	ch := make(chan *imap.MailboxInfo, 1)
+	go func() {
+		errC <- c.List("", "", ch)
+	}()
+	delim := ""
+	for mi := range ch {
+		delim = mi.Delimiter
+	}
+	return delim, <-errC
+}
+
+// dropNoSelect removes folders that only hold other folders, such as
+// "[Gmail]", and can't be selected.
+func (w *Worker) dropNoSelect(miList []*imap.MailboxInfo) []*imap.MailboxInfo {
+	list := miList[:0]
+	for _, mi := range miList {
+		if hasAttr(mi, imap.NoSelectAttr) {
+			w.log("Skip folder: %s, not selectable", mi.Name)
+			continue
+		}
+		list = append(list, mi)
+	}
+	return list
+}
+
+// dropEmpty removes folders whose STATUS reports no messages.
+func (w *Worker) dropEmpty(c *client.Client, miList []*imap.MailboxInfo) ([]*imap.MailboxInfo, error) {
+	list := miList[:0]
+	for _, mi := range miList {
+		st, err := c.Status(mi.Name, []imap.StatusItem{imap.StatusMessages})
+		if err != nil {
+			return nil, fmt.Errorf("status %s: %w", mi.Name, err)
+		}
+		if st.Messages == 0 {
+			w.log("Skip folder: %s, empty", mi.Name)
+			continue
+		}
+		list = append(list, mi)
+	}
+	return list, nil
+}
+
+// includeFolder reports whether a folder passes IncludeFolders and
+// ExcludeFolders. Excludes win over includes.
+func (w *Worker) includeFolder(name string) (bool, error) {
+	for _, p := range w.ExcludeFolders {
+		ok, err := path.Match(p, name)
+		if err != nil {
+			return false, fmt.Errorf("exclude pattern %q: %w", p, err)
+		}
+		if ok {
+			return false, nil
+		}
+	}
+	if len(w.IncludeFolders) == 0 {
+		return true, nil
+	}
+	for _, p := range w.IncludeFolders {
+		ok, err := path.Match(p, name)
+		if err != nil {
+			return false, fmt.Errorf("include pattern %q: %w", p, err)
+		}
+		if ok {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// flagTerm is a SearchFlags name: the flag it tests and whether the flag
+// must be set or clear.
+type flagTerm struct {
+	flag string
+	set  bool
+}
+
+var flagTerms = map[string]flagTerm{
+	"seen":       {imap.SeenFlag, true},
+	"unseen":     {imap.SeenFlag, false},
+	"flagged":    {imap.FlaggedFlag, true},
+	"unflagged":  {imap.FlaggedFlag, false},
+	"answered":   {imap.AnsweredFlag, true},
+	"unanswered": {imap.AnsweredFlag, false},
+	"draft":      {imap.DraftFlag, true},
+	"undraft":    {imap.DraftFlag, false},
+	"deleted":    {imap.DeletedFlag, true},
+	"undeleted":  {imap.DeletedFlag, false},
+}
+
+func (w *Worker) checkSearchFlags() error {
+	for _, name := range w.SearchFlags {
+		if _, ok := flagTerms[name]; !ok {
+			return fmt.Errorf("unknown search flag %q", name)
+		}
+		if name == "deleted" && w.SkipDeleted {
+			return fmt.Errorf("search flag %q can't be used with SkipDeleted", name)
+		}
+	}
+	return nil
+}
+
+func hasFlag(flags []string, flag string) bool {
+	for _, f := range flags {
+		if f == flag {
+			return true
+		}
+	}
+	return false
+}
+
+// searchCriteria returns the server side SEARCH that narrows which messages
+// of a folder with settings s are fetched, or nil to fetch everything.
+func (w *Worker) searchCriteria(s FolderSettings) *imap.SearchCriteria {
+	since := s.Since
+	if w.lastRun.After(since) {
+		since = w.lastRun
+	}
+	if since.IsZero() && s.Before.IsZero() && len(w.SearchFlags) == 0 && !w.SkipDeleted {
+		return nil
+	}
+	c := &imap.SearchCriteria{
+		Since:  since,
+		Before: s.Before,
+	}
+	for _, name := range w.SearchFlags {
+		t := flagTerms[name]
+		if t.set {
+			c.WithFlags = append(c.WithFlags, t.flag)
+		} else {
+			c.WithoutFlags = append(c.WithoutFlags, t.flag)
+		}
+	}
+	if w.SkipDeleted && !hasFlag(c.WithoutFlags, imap.DeletedFlag) {
+		c.WithoutFlags = append(c.WithoutFlags, imap.DeletedFlag)
+	}
+	return c
+}
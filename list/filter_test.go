@@ -0,0 +1,51 @@
+package list
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-imap"
+)
+
+func TestSearchCriteriaDeleted(t *testing.T) {
+	w := &Worker{}
+	if c := w.searchCriteria(w.folderSettings("INBOX")); c != nil {
+		t.Fatalf("zero Worker searches %v, want everything", c)
+	}
+	w.SkipDeleted = true
+	c := w.searchCriteria(w.folderSettings("INBOX"))
+	if c == nil || !hasFlag(c.WithoutFlags, imap.DeletedFlag) {
+		t.Fatalf("SkipDeleted searches %v, want without %s", c, imap.DeletedFlag)
+	}
+	w.SearchFlags = []string{"deleted"}
+	if err := w.checkSearchFlags(); err == nil {
+		t.Fatal(`"deleted" accepted with SkipDeleted`)
+	}
+}
+
+func TestSkipDeleted(t *testing.T) {
+	addr := testServer(t)
+	c := testConnect(t, addr)
+	msg := "Message-Id: <deleted@test>\r\nSubject: deleted\r\n\r\nbody\r\n"
+	err := c.Append("INBOX", []string{imap.DeletedFlag}, time.Now(), sizedReader{Reader: strings.NewReader(msg), n: len(msg)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		skip    bool
+		fetched int
+	}{
+		{false, 2},
+		{true, 1},
+	} {
+		sum, err := testWorker(t, WithSkipDeleted(tc.skip)).List(context.Background(), addr, "username", "password")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if sum.Fetched != tc.fetched {
+			t.Errorf("SkipDeleted %t: fetched %d, want %d", tc.skip, sum.Fetched, tc.fetched)
+		}
+	}
+}
@@ -0,0 +1,156 @@
+package list
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/client"
+)
+
+// FolderSettings names a folder of Worker.Folders and the settings that
+// override the Worker's for it. Zero fields keep the Worker's.
+type FolderSettings struct {
+	Name           string
+	Since          time.Time
+	Before         time.Time
+	MaxMessageSize int64
+	MinMessageSize int64
+}
+
+// ReadFolderSettings reads a folders file: a folder name per line,
+// optionally followed by key=value overrides, since= and before= as
+// 2006-01-02 dates and max-size= and min-size= in bytes. The name is the
+// rest of the line, so it may hold spaces. Empty lines and lines starting
+// with "#" are skipped.
+func ReadFolderSettings(r io.Reader) ([]FolderSettings, error) {
+	var list []FolderSettings
+	sc := bufio.NewScanner(r)
+	for n := 1; sc.Scan(); n++ {
+		line := strings.TrimSpace(sc.Text())
+		if len(line) == 0 || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fs, err := parseFolderLine(line)
+		if err != nil {
+			return nil, fmt.Errorf("folders line %d: %w", n, err)
+		}
+		list = append(list, fs)
+	}
+	if err := sc.Err(); err != nil {
+		return nil, fmt.Errorf("folders: %w", err)
+	}
+	return list, nil
+}
+
+// parseFolderLine takes key=value overrides from the end of line until a
+// field that is not one; the rest is the folder name.
+func parseFolderLine(line string) (FolderSettings, error) {
+	fs := FolderSettings{}
+	for {
+		i := strings.LastIndexAny(line, " \t")
+		if i < 0 {
+			break
+		}
+		k, v, ok := strings.Cut(line[i+1:], "=")
+		if !ok {
+			break
+		}
+		var err error
+		switch k {
+		default:
+			return fs, fmt.Errorf("unknown setting %q", k)
+		case "since":
+			fs.Since, err = time.Parse("2006-01-02", v)
+		case "before":
+			fs.Before, err = time.Parse("2006-01-02", v)
+		case "max-size":
+			fs.MaxMessageSize, err = strconv.ParseInt(v, 10, 64)
+		case "min-size":
+			fs.MinMessageSize, err = strconv.ParseInt(v, 10, 64)
+		}
+		if err != nil {
+			return fs, fmt.Errorf("%s: %w", k, err)
+		}
+		line = strings.TrimSpace(line[:i])
+	}
+	fs.Name = line
+	return fs, nil
+}
+
+func (w *Worker) checkFolders() error {
+	seen := map[string]bool{}
+	for _, fs := range w.Folders {
+		switch {
+		case len(fs.Name) == 0:
+			return fmt.Errorf("folder settings without a name")
+		case seen[fs.Name]:
+			return fmt.Errorf("folder %q is listed twice", fs.Name)
+		case fs.MaxMessageSize < 0 || fs.MinMessageSize < 0:
+			return fmt.Errorf("folder %q: negative message size", fs.Name)
+		case (fs.MaxMessageSize > 0 || fs.MinMessageSize > 0) && !w.headerFiles():
+			return fmt.Errorf("message size limits require the %s or %s format", FormatNative, FormatCAS)
+		}
+		seen[fs.Name] = true
+	}
+	return nil
+}
+
+// folderSettings returns the settings of folder: the Worker's, with the
+// overrides of its Folders entry.
+func (w *Worker) folderSettings(folder string) FolderSettings {
+	s := FolderSettings{
+		Name:           folder,
+		Since:          w.Since,
+		Before:         w.Before,
+		MaxMessageSize: w.MaxMessageSize,
+		MinMessageSize: w.MinMessageSize,
+	}
+	for _, fs := range w.Folders {
+		if fs.Name != folder {
+			continue
+		}
+		if !fs.Since.IsZero() {
+			s.Since = fs.Since
+		}
+		if !fs.Before.IsZero() {
+			s.Before = fs.Before
+		}
+		if fs.MaxMessageSize > 0 {
+			s.MaxMessageSize = fs.MaxMessageSize
+		}
+		if fs.MinMessageSize > 0 {
+			s.MinMessageSize = fs.MinMessageSize
+		}
+		break
+	}
+	return s
+}
+
+// listFolders sends the mailboxes named by Folders to ch, in their order,
+// and closes it. Names not on the server are left out.
+func (w *Worker) listFolders(c *client.Client, ch chan *imap.MailboxInfo) error {
+	defer close(ch)
+	for _, fs := range w.Folders {
+		name := fs.Name
+		one := make(chan *imap.MailboxInfo, 1)
+		errC := make(chan error, 1)
+		go func() {
+			errC <- listMailboxes(c, "", name, one)
+		}()
+		for mi := range one {
+			// A name holding "*" or "%" matches others as well.
+			if mi.Name == name {
+				ch <- mi
+			}
+		}
+		if err := <-errC; err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,88 @@
+package list
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/client"
+)
+
+// FolderInfo describes a mailbox on the server.
+type FolderInfo struct {
+	Name        string
+	NoSelect    bool   // Holds only other folders; the counts are zero.
+	SpecialUse  string // Role such as \Sent or \Trash, see Header.SpecialUse.
+	Messages    uint32
+	Unseen      uint32
+	UIDValidity uint32
+	Size        int64 // Sum of the message sizes reported by the server.
+}
+
+// ListFolders returns the mailboxes List would back up, with their message
+// counts, without downloading anything. Folders are opened read-only to sum
+// message sizes.
+func (w *Worker) ListFolders(ctx context.Context, server, username, password string) ([]FolderInfo, error) {
+	c, err := w.connectRetry(ctx, server, username, password)
+	if err != nil {
+		return nil, err
+	}
+	defer c.Logout()
+
+	miList, err := w.folders(ctx, c)
+	if err != nil {
+		return nil, err
+	}
+	list := make([]FolderInfo, 0, len(miList))
+	for _, mi := range miList {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		fi := FolderInfo{Name: mi.Name, SpecialUse: specialUseOf(mi)}
+		for _, a := range mi.Attributes {
+			if a == imap.NoSelectAttr {
+				fi.NoSelect = true
+			}
+		}
+		if fi.NoSelect {
+			list = append(list, fi)
+			continue
+		}
+		status, err := c.Status(mi.Name, []imap.StatusItem{imap.StatusMessages, imap.StatusUnseen, imap.StatusUidValidity})
+		if err != nil {
+			return nil, fmt.Errorf("status %s: %w", mi.Name, err)
+		}
+		fi.Messages = status.Messages
+		fi.Unseen = status.Unseen
+		fi.UIDValidity = status.UidValidity
+		if fi.Messages > 0 {
+			fi.Size, err = folderSize(c, mi.Name)
+			if err != nil {
+				return nil, fmt.Errorf("size %s: %w", mi.Name, err)
+			}
+		}
+		list = append(list, fi)
+	}
+	return list, nil
+}
+
+// folderSize sums the sizes of the messages in a mailbox.
+func folderSize(c *client.Client, name string) (int64, error) {
+	if _, err := c.Select(name, true); err != nil {
+		return 0, err
+	}
+	seqset, err := imap.ParseSeqSet("1:*")
+	if err != nil {
+		return 0, err
+	}
+	msgC := make(chan *imap.Message, 10)
+	fetchErr := make(chan error, 1)
+	go func() {
+		fetchErr <- c.Fetch(seqset, []imap.FetchItem{imap.FetchRFC822Size}, msgC)
+	}()
+	var size int64
+	for msg := range msgC {
+		size += int64(msg.Size)
+	}
+	return size, <-fetchErr
+}
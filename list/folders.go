@@ -0,0 +1,228 @@
+package list
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+)
+
+// sharedKeys reports whether every folder stores to the same files, so a
+// message in several folders is stored once. That is the native and cas
+// formats in the flat layout.
+func (w *Worker) sharedKeys() bool {
+	return w.headerFiles() && w.Layout != LayoutFolder
+}
+
+// seenKey records that a message key is in folder and reports whether it
+// was already seen in another folder during this run. Such a message is
+// stored or being stored and need not be checked again.
+func (w *Worker) seenKey(key, folder string) bool {
+	if !w.sharedKeys() || w.DryRun {
+		return false
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.keyFolders == nil {
+		w.keyFolders = map[string][]string{}
+	}
+	list, ok := w.keyFolders[key]
+	for _, f := range list {
+		if f == folder {
+			return ok
+		}
+	}
+	w.keyFolders[key] = append(list, folder)
+	return ok
+}
+
+// forgetFolder removes what seenKey recorded for folder, so the folder can be
+// processed again.
+func (w *Worker) forgetFolder(folder string) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for key, list := range w.keyFolders {
+		kept := list[:0]
+		for _, f := range list {
+			if f != folder {
+				kept = append(kept, f)
+			}
+		}
+		if len(kept) == 0 {
+			delete(w.keyFolders, key)
+			continue
+		}
+		w.keyFolders[key] = kept
+	}
+}
+
+// updateFolders adds the folders each message was seen in during the run to
+// Header.Folders of its file. Files already listing them are left alone.
+// Without DetectMoves only messages seen in several folders are checked.
+func (w *Worker) updateFolders(ctx context.Context) error {
+	w.mu.Lock()
+	kf := w.keyFolders
+	w.keyFolders = nil
+	w.mu.Unlock()
+	if w.Backend != nil || w.Sink != nil {
+		return nil
+	}
+
+	updated := 0
+	for key, folders := range kf {
+		if len(folders) < 2 && !w.DetectMoves {
+			continue
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		path := ""
+		for _, name := range storedNames(key) {
+			p := filepath.Join(w.Store, name)
+			if _, err := os.Stat(p); err == nil {
+				path = p
+				break
+			}
+		}
+		if len(path) == 0 {
+			// Not written, such as when the run failed.
+			continue
+		}
+		changed, err := w.addHeaderFolders(path, folders)
+		if err != nil {
+			return fmt.Errorf("%s: %w", key, err)
+		}
+		if changed {
+			updated++
+		}
+	}
+	if updated > 0 {
+		w.log("recorded more folders for %d messages", updated)
+		w.idxMu.Lock()
+		w.idxStale = true
+		w.idxMu.Unlock()
+	}
+	return nil
+}
+
+// addHeaderFolders rewrites the header of the message file at path so
+// Folders includes folders, keeping the body and file time.
+func (w *Worker) addHeaderFolders(path string, folders []string) (bool, error) {
+	return w.rewriteHeader(path, false, func(h *Header) bool {
+		all := h.Folders
+		if len(all) == 0 {
+			all = []string{h.Folder}
+		}
+		n := len(all)
+		for _, f := range folders {
+			found := false
+			for _, a := range all {
+				if a == f {
+					found = true
+					break
+				}
+			}
+			if !found {
+				all = append(all, f)
+			}
+		}
+		if len(all) == n {
+			return false
+		}
+		h.Folders = all
+		return true
+	})
+}
+
+// rewriteHeader replaces the header of the native message file at path with
+// the one update makes, keeping the file time, compression, and encryption.
+// The body is kept unless dropBody is set. Nothing is written if update
+// returns false.
+func (w *Worker) rewriteHeader(path string, dropBody bool, update func(h *Header) bool) (bool, error) {
+	return w.rewriteFile(path, path, dropBody, update)
+}
+
+// rewriteFile is rewriteHeader writing to dst, which must have the same
+// compression and encryption suffixes as path.
+func (w *Worker) rewriteFile(path, dst string, dropBody bool, update func(h *Header) bool) (bool, error) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return false, err
+	}
+	sf, err := w.openStored(path)
+	if err != nil {
+		return false, err
+	}
+	defer sf.Close()
+	br := bufio.NewReader(sf)
+	h, err := readHeader(br)
+	if err != nil {
+		return false, err
+	}
+	if !update(&h) {
+		return false, nil
+	}
+
+	dir, name := filepath.Split(dst)
+	f, err := os.CreateTemp(dir, storedKey(name)+".*.tmp")
+	if err != nil {
+		return false, err
+	}
+	tmpName := f.Name()
+	defer os.Remove(tmpName)
+	if err := f.Chmod(w.fileMode()); err != nil {
+		f.Close()
+		return false, err
+	}
+
+	bw := bufio.NewWriter(f)
+	out, err := w.storedWriter(bw, path)
+	if err == nil {
+		err = writeHeader(out, &h)
+	}
+	if err == nil && !dropBody {
+		_, err = io.Copy(out, br)
+	}
+	if err == nil {
+		err = out.Close()
+	}
+	if err == nil {
+		err = bw.Flush()
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return false, err
+	}
+	if err := os.Chtimes(tmpName, fi.ModTime(), fi.ModTime()); err != nil {
+		return false, err
+	}
+	if err := os.Rename(tmpName, dst); err != nil {
+		return false, err
+	}
+	return true, syncDir(filepath.Dir(dst))
+}
+
+// syncDir flushes the entries of dir to disk, so a file renamed into it is
+// still there after a crash. Windows can't sync a directory.
+func syncDir(dir string) error {
+	if runtime.GOOS == "windows" {
+		return nil
+	}
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	err = d.Sync()
+	if cerr := d.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
@@ -0,0 +1,54 @@
+package list
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestAddHeaderFolders(t *testing.T) {
+	addr := testServer(t)
+	w := testWorker(t)
+	if _, err := w.List(context.Background(), addr, "username", "password"); err != nil {
+		t.Fatal(err)
+	}
+	hs, _, err := w.readIndex()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(hs) != 1 {
+		t.Fatalf("%d messages stored, want 1", len(hs))
+	}
+	path := filepath.Join(w.Store, hs[0].Key)
+	before, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	changed, err := w.addHeaderFolders(path, []string{"Archive"})
+	if err != nil || !changed {
+		t.Fatalf("changed %t, err %v", changed, err)
+	}
+	h, err := w.readStoredHeader(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(h.Folders, " ") != "INBOX Archive" {
+		t.Errorf("folders %q, want INBOX and Archive", h.Folders)
+	}
+	after, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !after.ModTime().Equal(before.ModTime()) || after.Mode() != before.Mode() || after.Size() <= before.Size() {
+		t.Errorf("rewritten file %v %v %d, was %v %v %d", after.ModTime(), after.Mode(), after.Size(), before.ModTime(), before.Mode(), before.Size())
+	}
+	tmp, err := filepath.Glob(filepath.Join(w.Store, "*.tmp"))
+	if err != nil || len(tmp) > 0 {
+		t.Errorf("temporary files left: %q %v", tmp, err)
+	}
+	if changed, err := w.addHeaderFolders(path, []string{"Archive"}); err != nil || changed {
+		t.Errorf("adding a listed folder again: changed %t, err %v", changed, err)
+	}
+}
@@ -0,0 +1,72 @@
+package list
+
+import (
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/client"
+	"github.com/emersion/go-imap/utf7"
+)
+
+// gmailLabels is the Gmail extension fetch item listing a message's labels.
+const gmailLabels imap.FetchItem = "X-GM-LABELS"
+
+func hasAttr(mi *imap.MailboxInfo, attr string) bool {
+	for _, a := range mi.Attributes {
+		if a == attr {
+			return true
+		}
+	}
+	return false
+}
+
+// preferAllMail reduces a Gmail folder list to "All Mail" plus the Trash and
+// Spam folders, which are not part of All Mail. Every other Gmail folder is a
+// label whose messages are already in All Mail. Lists without an \All
+// folder are returned unchanged.
+func (w *Worker) preferAllMail(miList []*imap.MailboxInfo) []*imap.MailboxInfo {
+	found := false
+	for _, mi := range miList {
+		if hasAttr(mi, imap.AllAttr) {
+			found = true
+			break
+		}
+	}
+	if !found {
+		return miList
+	}
+	keep := make([]*imap.MailboxInfo, 0, 3)
+	for _, mi := range miList {
+		if hasAttr(mi, imap.AllAttr) || hasAttr(mi, imap.TrashAttr) || hasAttr(mi, imap.JunkAttr) {
+			keep = append(keep, mi)
+			continue
+		}
+		w.log("Skip label folder: %s", mi.Name)
+	}
+	return keep
+}
+
+// supportsLabels reports whether the server is Gmail and can fetch labels.
+func supportsLabels(c *client.Client) bool {
+	ok, _ := c.Support("X-GM-EXT-1")
+	return ok
+}
+
+// messageLabels returns the Gmail labels of a message fetched with gmailLabels.
+func messageLabels(msg *imap.Message) []string {
+	raw, ok := msg.Items[gmailLabels].([]interface{})
+	if !ok {
+		return nil
+	}
+	labels := make([]string, 0, len(raw))
+	for _, v := range raw {
+		s, err := imap.ParseString(v)
+		if err != nil {
+			continue
+		}
+		// Labels are mailbox names, so use the same modified UTF-7.
+		if d, err := utf7.Encoding.NewDecoder().String(s); err == nil {
+			s = d
+		}
+		labels = append(labels, s)
+	}
+	return labels
+}
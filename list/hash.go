@@ -0,0 +1,61 @@
+package list
+
+import (
+	"crypto/sha256"
+	"crypto/sha512"
+	"fmt"
+	"hash"
+	"io"
+	"strconv"
+
+	"golang.org/x/crypto/blake2b"
+)
+
+// Body hash algorithms for Worker.HashAlgo and Header.HashAlgo.
+const (
+	HashBlake2b256 = "blake2b256"
+	HashSHA256     = "sha256"
+	HashSHA512_256 = "sha512_256"
+)
+
+func (w *Worker) hashAlgo() string {
+	if len(w.HashAlgo) == 0 {
+		return HashBlake2b256
+	}
+	return w.HashAlgo
+}
+
+// newHasher returns a hash for algo. An empty algo, as in headers written
+// before HashAlgo was recorded, is HashBlake2b256.
+func newHasher(algo string) (hash.Hash, error) {
+	switch algo {
+	case "", HashBlake2b256:
+		return blake2b.New256(nil)
+	case HashSHA256:
+		return sha256.New(), nil
+	case HashSHA512_256:
+		return sha512.New512_256(), nil
+	}
+	return nil, fmt.Errorf("unknown hash algorithm %q", algo)
+}
+
+// copyBody copies body to dst and records its Size in h. Unless hasher is
+// nil, as with SkipBodyHash, the Hash and HashAlgo are recorded too.
+func (w *Worker) copyBody(dst io.Writer, body io.Reader, h *Header, hasher hash.Hash) error {
+	if hasher != nil {
+		hasher.Reset()
+		body = io.TeeReader(body, hasher)
+	}
+	n, err := io.Copy(dst, body)
+	if err != nil {
+		return err
+	}
+	h.Size = strconv.FormatInt(n, 10)
+	h.Hash = nil
+	h.HashAlgo = ""
+	if hasher != nil {
+		h.Hash = hasher.Sum(nil)
+		h.HashAlgo = w.hashAlgo()
+	}
+	return nil
+}
@@ -0,0 +1,261 @@
+package list
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// indexFile lists the Header of every native message file, one JSON object
+// per line, so the store can be searched without opening each file. Lines
+// are only appended; RebuildIndex rewrites it from the files.
+const indexFile = "index.jsonl"
+
+func indexKey(h *Header) string {
+	return h.Folder + "\x00" + h.Key
+}
+
+// openIndex opens the index for appending and loads the entries already in
+// it. A store without an index, such as one from before it existed, is
+// indexed first. The index is only kept for the native and cas formats, and
+// not with a Sink or with Encrypt unless PlainIndex is set.
+func (w *Worker) openIndex(ctx context.Context) error {
+	if !w.headerFiles() || w.DryRun || w.Sink != nil {
+		return nil
+	}
+	if len(w.Encrypt) > 0 && !w.PlainIndex {
+		return nil
+	}
+	hs, ok, err := w.readIndex()
+	if err != nil {
+		return err
+	}
+	if !ok && w.Backend == nil {
+		if err := w.mkdirAll(w.Store); err != nil {
+			return err
+		}
+		if err := w.RebuildIndex(ctx); err != nil {
+			return err
+		}
+		if hs, _, err = w.readIndex(); err != nil {
+			return err
+		}
+	}
+	seen := make(map[string]bool, len(hs))
+	var byID map[string][]Header
+	if w.DetectMoves {
+		byID = map[string][]Header{}
+	}
+	w.idxMu.Lock()
+	w.idxBody = nil
+	if w.DedupeByContent {
+		w.idxBody = map[string]Header{}
+		for i := range hs {
+			w.indexBody(&hs[i])
+		}
+	}
+	w.idxMu.Unlock()
+	for i := range hs {
+		seen[indexKey(&hs[i])] = true
+		if byID != nil && len(hs[i].MessageID) > 0 {
+			byID[hs[i].MessageID] = append(byID[hs[i].MessageID], hs[i])
+		}
+	}
+	f, err := w.openFile(filepath.Join(w.Store, indexFile), os.O_CREATE|os.O_RDWR|os.O_APPEND)
+	if err != nil {
+		return fmt.Errorf("index: %w", err)
+	}
+	// A run that was killed mid-write leaves a partial last line; start a
+	// new one so the next entry is readable.
+	if fi, err := f.Stat(); err == nil && fi.Size() > 0 {
+		last := make([]byte, 1)
+		if _, err := f.ReadAt(last, fi.Size()-1); err == nil && last[0] != '\n' {
+			f.Write([]byte{'\n'})
+		}
+	}
+	w.idxMu.Lock()
+	w.idx = f
+	w.idxSeen = seen
+	w.idxStale = false
+	w.idxByID = byID
+	w.idxMu.Unlock()
+	return nil
+}
+
+func (w *Worker) closeIndex() error {
+	w.idxMu.Lock()
+	defer w.idxMu.Unlock()
+	if w.idx == nil {
+		return nil
+	}
+	err := w.idx.Close()
+	w.idx = nil
+	return err
+}
+
+// appendIndex records a written message in the index once.
+func (w *Worker) appendIndex(h *Header) error {
+	w.idxMu.Lock()
+	defer w.idxMu.Unlock()
+	if w.idx == nil || w.idxSeen[indexKey(h)] {
+		return nil
+	}
+	line, err := marshalIndexLine(h)
+	if err != nil {
+		return err
+	}
+	if _, err := w.idx.Write(line); err != nil {
+		return fmt.Errorf("index: %w", err)
+	}
+	w.idxSeen[indexKey(h)] = true
+	if w.idxByID != nil && len(h.MessageID) > 0 {
+		ih := *h
+		ih.RawHeader = ""
+		w.idxByID[h.MessageID] = append(w.idxByID[h.MessageID], ih)
+	}
+	w.indexBody(h)
+	return nil
+}
+
+func marshalIndexLine(h *Header) ([]byte, error) {
+	ih := *h
+	ih.RawHeader = ""
+	buf := &bytes.Buffer{}
+	e := json.NewEncoder(buf)
+	e.SetEscapeHTML(false)
+	if err := e.Encode(&ih); err != nil {
+		return nil, fmt.Errorf("marshal header: %w", err)
+	}
+	return buf.Bytes(), nil
+}
+
+// readIndex returns the indexed headers. ok is false if there is no index.
+// Lines that don't parse, such as one cut short by a crash, are skipped.
+func (w *Worker) readIndex() (hs []Header, ok bool, err error) {
+	f, err := os.Open(filepath.Join(w.Store, indexFile))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, fmt.Errorf("index: %w", err)
+	}
+	defer f.Close()
+	r := bufio.NewReader(f)
+	for {
+		line, err := r.ReadBytes('\n')
+		if len(bytes.TrimSpace(line)) > 0 {
+			h := Header{}
+			if json.Unmarshal(line, &h) == nil {
+				hs = append(hs, h)
+			}
+		}
+		if err == io.EOF {
+			return hs, true, nil
+		}
+		if err != nil {
+			return nil, false, fmt.Errorf("index: %w", err)
+		}
+	}
+}
+
+// storedPath returns the file of an indexed message, or its key with a
+// Backend.
+func (w *Worker) storedPath(h *Header) (string, error) {
+	dir := w.folderPath(h.Folder)
+	for _, name := range storedNames(h.Key) {
+		if w.Backend != nil {
+			key, err := w.backendKey(dir, name)
+			if err != nil {
+				return "", err
+			}
+			ok, err := w.Backend.Exists(key)
+			if err != nil {
+				return "", err
+			}
+			if ok {
+				return key, nil
+			}
+			continue
+		}
+		p := filepath.Join(dir, name)
+		_, err := os.Stat(p)
+		if err == nil {
+			return p, nil
+		}
+		if !os.IsNotExist(err) {
+			return "", err
+		}
+	}
+	return "", fmt.Errorf("%s (folder %q): %w", h.Key, h.Folder, os.ErrNotExist)
+}
+
+// RebuildIndex rewrites the index from the message files in the store. Files
+// that can't be read as messages are reported and left out.
+func (w *Worker) RebuildIndex(ctx context.Context) error {
+	if !w.headerFiles() {
+		return fmt.Errorf("the index only supports the %s and %s formats", FormatNative, FormatCAS)
+	}
+	if w.Backend != nil {
+		return fmt.Errorf("the index can't be rebuilt from a Backend")
+	}
+	if err := w.checkModes(); err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(w.Store, "."+indexFile+".*.tmp")
+	if err != nil {
+		return err
+	}
+	tmpName := f.Name()
+	defer os.Remove(tmpName)
+	if err := f.Chmod(w.fileMode()); err != nil {
+		f.Close()
+		return err
+	}
+
+	bw := bufio.NewWriter(f)
+	seen := map[string]bool{}
+	err = w.walkStore(ctx, func(path string) error {
+		sf, err := w.openStored(path)
+		if err != nil {
+			return err
+		}
+		h, err := readHeader(bufio.NewReader(sf))
+		sf.Close()
+		if err != nil {
+			w.print("index: skip %s: %v", path, err)
+			return nil
+		}
+		if seen[indexKey(&h)] {
+			return nil
+		}
+		seen[indexKey(&h)] = true
+		line, err := marshalIndexLine(&h)
+		if err != nil {
+			return err
+		}
+		_, err = bw.Write(line)
+		return err
+	})
+	if err != nil {
+		f.Close()
+		return err
+	}
+	if err := bw.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmpName, filepath.Join(w.Store, indexFile)); err != nil {
+		return err
+	}
+	w.log("indexed %d messages", len(seen))
+	return nil
+}
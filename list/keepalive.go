@@ -0,0 +1,68 @@
+package list
+
+import (
+	"sync"
+	"time"
+
+	"github.com/emersion/go-imap/client"
+)
+
+// keepalive sends NOOP on a connection that has been idle for the Keepalive
+// interval so the server does not drop it. Commands run through do, which
+// holds the lock, so a NOOP is never sent while another command is in flight.
+type keepalive struct {
+	mu   sync.Mutex
+	c    *client.Client
+	last time.Time
+
+	done chan struct{}
+	once sync.Once
+	wg   sync.WaitGroup
+}
+
+func (w *Worker) startKeepalive(c *client.Client) *keepalive {
+	ka := &keepalive{c: c, last: time.Now(), done: make(chan struct{})}
+	if w.Keepalive <= 0 {
+		return ka
+	}
+	ka.wg.Add(1)
+	go func() {
+		defer ka.wg.Done()
+		t := time.NewTicker(w.Keepalive)
+		defer t.Stop()
+		for {
+			select {
+			case <-ka.done:
+				return
+			case <-t.C:
+			}
+			ka.mu.Lock()
+			if time.Since(ka.last) >= w.Keepalive {
+				if err := c.Noop(); err != nil {
+					w.log("\tkeepalive: %v", err)
+				}
+				ka.last = time.Now()
+			}
+			ka.mu.Unlock()
+		}
+	}()
+	return ka
+}
+
+// do runs a command on the connection.
+func (ka *keepalive) do(f func() error) error {
+	ka.mu.Lock()
+	defer ka.mu.Unlock()
+	err := f()
+	ka.last = time.Now()
+	return err
+}
+
+// stop ends the keepalive and waits for a NOOP in progress. It may be called
+// more than once.
+func (ka *keepalive) stop() {
+	ka.once.Do(func() {
+		close(ka.done)
+	})
+	ka.wg.Wait()
+}
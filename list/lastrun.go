@@ -0,0 +1,43 @@
+package list
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// lastRunFile holds the start time of the last List that completed without
+// errors.
+const lastRunFile = ".last-run"
+
+// readLastRun returns the recorded start of the last successful run, or the
+// zero time if there is none.
+func readLastRun(store string) (time.Time, error) {
+	b, err := os.ReadFile(filepath.Join(store, lastRunFile))
+	if errors.Is(err, os.ErrNotExist) {
+		return time.Time{}, nil
+	}
+	if err != nil {
+		return time.Time{}, fmt.Errorf("read last run: %w", err)
+	}
+	t, err := time.Parse(time.RFC3339, strings.TrimSpace(string(b)))
+	if err != nil {
+		return time.Time{}, fmt.Errorf("parse last run: %w", err)
+	}
+	return t, nil
+}
+
+func writeLastRun(store string, t time.Time, mode os.FileMode) error {
+	fn := filepath.Join(store, lastRunFile)
+	tmp := fn + ".tmp"
+	if err := writeFile(tmp, []byte(t.Format(time.RFC3339)+"\n"), mode); err != nil {
+		return fmt.Errorf("write last run: %w", err)
+	}
+	if err := os.Rename(tmp, fn); err != nil {
+		return fmt.Errorf("write last run: %w", err)
+	}
+	return nil
+}
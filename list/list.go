@@ -1,95 +1,905 @@
 package list
 
 import (
-	"bytes"
+	"bufio"
 	"context"
+	"crypto/tls"
 	"encoding/base32"
-	"encoding/json"
+	"errors"
 	"fmt"
+	"hash"
 	"io"
-	"log"
+	"math"
+	"net/mail"
 	"os"
-	"path/filepath"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
+	"unicode"
 
 	"github.com/emersion/go-imap"
 	"github.com/emersion/go-imap/client"
 	"golang.org/x/crypto/blake2b"
+	"golang.org/x/time/rate"
 )
 
 type Worker struct {
 	Verbose bool
 	Store   string
+	TLSMode string // One of TLSImplicit (default), TLSStartTLS, TLSPlain.
+
+	Logger Logger // Defaults to StdLogger(nil), the standard logger.
+
+	// LogFormat is LogText (default) or LogJSON. JSON records are written
+	// one per line to LogOutput, which defaults to stderr.
+	LogFormat string
+	LogOutput io.Writer
+
+	TLSConfig *tls.Config // Defaults to system roots and the server host name.
+
+	// Dial, when set, is called for every connection instead of dialing
+	// the server address, for example to use an in-process server in tests.
+	// It returns a client that has read the greeting and is not logged in.
+	// TLSMode, TLSConfig, Proxy, Compression, and MaxBytesPerSec are then
+	// up to Dial.
+	Dial func(ctx context.Context, addr string) (*client.Client, error)
+
+	// Proxy, when set, is a socks5:// or http:// URL that connections are
+	// made through. TLS is still with the server itself.
+	Proxy string
+
+	// FolderFilter, when set, skips folders for which it returns false.
+	FolderFilter func(mi *imap.MailboxInfo) bool
+
+	// Folders, when set, are the only folders backed up, listed by name in
+	// this order instead of listing every folder, each with its own
+	// settings. A folder not on the server is skipped and reported. Other
+	// folder filters still apply. See ReadFolderSettings.
+	Folders []FolderSettings
+
+	// IncludeFolders and ExcludeFolders are path.Match patterns for folder
+	// names; "*" does not match the "/" delimiter. An empty include list
+	// means all folders. Excludes win over includes.
+	IncludeFolders []string
+	ExcludeFolders []string
+
+	// RootFolder, when set, only backs up that folder and those below it in
+	// the server's hierarchy, such as INBOX and INBOX/* for "INBOX" on a
+	// server using "/" as its delimiter. Other folder filters still apply.
+	RootFolder string
+
+	// ExcludeSpecialUse skips folders with these special-use roles, such as
+	// `\Trash` or `\Junk`. Roles come from the server where it reports them
+	// and are otherwise guessed from common folder names.
+	ExcludeSpecialUse []string
+
+	// AuthMethod is AuthLogin (default) or AuthXOAuth2. With AuthXOAuth2
+	// the password passed to List is the OAuth2 access token.
+	AuthMethod string
+
+	// Backend, when set, stores message files instead of the Store
+	// directory, under keys matching their paths in it. Store still holds
+	// the index, state, and other files of a run, and must be kept with the
+	// Backend. Only the native format is supported; Mirror, Restore,
+	// Dedupe, and RebuildIndex are not, and updated Header.Folders are not
+	// written back. See DirStore.
+	Backend Store
+
+	// Layout is LayoutFlat (default) or LayoutFolder.
+	Layout string
+	// Format is FormatNative (default), FormatMaildir, FormatMbox,
+	// FormatEML, or FormatCAS.
+	// Maildir always uses a directory per folder, mbox a file per folder.
+	// CAS stores each distinct body once under Store/objects, gzip
+	// compressed with Compress; objects no file refers to are not removed.
+	Format string
+
+	// Compression negotiates COMPRESS=DEFLATE when the server supports it.
+	// It is not used with TLSStartTLS.
+	Compression bool
+
+	// ExtractAttachments also writes each attachment of a native message
+	// to Store/attachments, named by the hash of its content, and lists
+	// them in the Header. The stored body is still the whole message.
+	ExtractAttachments bool
+
+	// ExtractText also writes the text of each message, for searching
+	// bodies with tools such as grep, to <key>.txt next to its file: the
+	// text/plain parts, or the text/html ones without their markup if there
+	// are none, decoded to UTF-8. Messages without text get no file. Native
+	// and cas formats in Store only, without encryption.
+	ExtractText bool
+
+	// HashAlgo is the algorithm of the body Hash: HashBlake2b256 (default),
+	// HashSHA256, or HashSHA512_256. It is recorded in each Header. File
+	// names always use blake2b.
+	HashAlgo string
+
+	// SkipBodyHash leaves Header.Hash empty, saving the CPU of hashing each
+	// body. Verify can't check such files, and Dedupe ignores them.
+	SkipBodyHash bool
+
+	// StoreRawHeaders also records the complete header block of each
+	// message, including those the envelope omits such as List-Id or
+	// DKIM-Signature, in Header.RawHeader. It is taken from the body, so
+	// nothing more is downloaded. Native and eml formats only.
+	StoreRawHeaders bool
+
+	// ReHashExisting also fetches the body of each message already stored
+	// and rewrites its file if the body's hash changed, such as for an
+	// edited draft. The old hash is logged in Store/.history. Every body is
+	// downloaded on every run, so this is much slower. Native format only.
+	ReHashExisting bool
+
+	// Compress gzips native message files, stored as <key>.gz. The Hash is
+	// always of the uncompressed body.
+	Compress bool
+
+	// Encrypt, an age X25519 recipient ("age1..."), encrypts each native
+	// message file as a whole, header included, stored as <key>.age after
+	// any compression. The Hash is still of the plaintext body. The index is
+	// not written unless PlainIndex is set, which keeps the headers there in
+	// the clear so the store can be searched without the key. Reading the
+	// files back, as Verify, Search, and Restore do, needs Identity.
+	Encrypt    string
+	PlainIndex bool
+
+	// Identity holds the age identities ("AGE-SECRET-KEY-1..."), as written
+	// by age-keygen, that read encrypted message files.
+	Identity string
+
+	// FileMode and DirMode are the permissions of files and directories
+	// written to the store, 0600 and 0700 if unset; 0640 and 0750 make a
+	// group-readable archive. They are set as given rather than masked by
+	// the umask, and directories that already exist are left alone. A
+	// world-writable mode is refused unless AllowWorldWritable is set.
+	FileMode           os.FileMode
+	DirMode            os.FileMode
+	AllowWorldWritable bool
+
+	// Incremental records each folder's UIDVALIDITY and highest UID in the
+	// store and on the next run only fetches envelopes for newer UIDs. A
+	// changed UIDVALIDITY falls back to a full scan. Progress is also recorded
+	// after each batch of bodies, so a run that fails part way through a
+	// folder resumes after the last complete batch. Messages are still
+	// skipped if their file exists, so the state file is only an optimization.
+	Incremental bool
+
+	// OnlyNewFolders, with Incremental, checks each folder of a List with
+	// STATUS before any is processed, and skips it without selecting it when
+	// its UIDVALIDITY, UIDNEXT, and message count are those recorded when it
+	// was last processed to the end: no message was added or removed. This
+	// saves the SELECT and SEARCH of every folder that did not change.
+	OnlyNewFolders bool
+
+	// OnFolder is called after a folder is selected with its message count.
+	OnFolder func(name string, total int)
+	// OnMessage is called after each message is written, with the count
+	// written so far and the count of messages the folder's search found.
+	// The total is known before the first message and does not change, but
+	// messages already stored or skipped are not written, so done may end
+	// below it.
+	//
+	// Callbacks are never invoked concurrently.
+	OnMessage func(folder string, done, total int)
+
+	// Since and Before, when set, only fetch messages whose internal date
+	// (the date the server received it, not the Date header) falls within
+	// the range. Dates have day granularity.
+	Since  time.Time
+	Before time.Time
+
+	// SearchFlags, when set, only fetch messages matching every term, each
+	// a flag name such as "unseen", "flagged", or "answered", or its
+	// opposite ("seen", "unflagged", "unanswered"); "draft" and "deleted"
+	// work the same. They are sent in the same SEARCH as the date range.
+	SearchFlags []string
+
+	// SkipDeleted leaves out messages flagged \Deleted but not yet
+	// expunged: they are left out of the SEARCH and skipped if flagged by
+	// the time their envelope is fetched; with Incremental they are not
+	// fetched later if the flag is cleared. Flags, \Deleted among them, are
+	// recorded in each Header either way.
+	SkipDeleted bool
+
+	// SinceLastRun only fetches messages received since the start of the
+	// last run that completed without errors, recorded in Store/.last-run
+	// after every such run. Without a recorded run everything is fetched.
+	// The search starts a day early, as SINCE ignores the time and servers
+	// may use another time zone; messages already stored are skipped.
+	// Deletions are not tracked.
+	SinceLastRun bool
+
+	// SkipEmptyFolders checks each folder with STATUS first and skips the
+	// empty ones without selecting them. Mirror then leaves the stored
+	// files of a folder that was emptied alone. Folders that can't be
+	// selected, such as "[Gmail]", are always skipped.
+	SkipEmptyFolders bool
+
+	// PreferAllMail, on Gmail, only downloads "All Mail" (plus Trash and
+	// Spam) and records each message's labels instead of visiting every
+	// label folder.
+	PreferAllMail bool
+
+	// Concurrency is the number of connections used to process folders in
+	// parallel. Values below 2 process folders one at a time.
+	Concurrency int
+
+	// FetchConnections is the number of extra connections opened for each
+	// folder with more than one batch to fetch, so batches are fetched in
+	// parallel. Each selects the folder read-only. With MarkSeen, messages
+	// are then marked after the whole folder is stored.
+	FetchConnections int
+
+	// MaxBytesPerSec, when set, limits how fast data is read from the
+	// server, shared by all connections.
+	MaxBytesPerSec int64
+
+	// MaxConnections caps the connections open to the server at once,
+	// counting Concurrency and FetchConnections; defaultMaxConnections if
+	// unset. Concurrency is lowered to fit, and extra fetch connections are
+	// only opened while below the cap.
+	MaxConnections int
+
+	// FolderTimeout, when set, limits the time spent on one folder. A folder
+	// that times out is logged and skipped. OpTimeout limits each IMAP
+	// command such as SELECT or FETCH.
+	FolderTimeout time.Duration
+	OpTimeout     time.Duration
+
+	// MaxRetries is how many times connecting or processing a folder is
+	// retried after a transport failure, reconnecting if needed. Each
+	// retry waits twice as long as the last. Login failures are not retried.
+	MaxRetries int
+
+	// NameFunc, when set, returns the stored name of a message instead of
+	// the default hash of its Message-ID. It is given the envelope fields
+	// of the header, and its UIDValidity and UID, only, and must return the
+	// same name for a message on every run. See NameByDateSubject.
+	NameFunc func(h Header) (string, error)
+
+	// Keepalive, when set, sends NOOP on a folder's connection after it has
+	// been idle this long, so slow runs are not dropped by the server.
+	Keepalive time.Duration
+
+	// BatchSize is the number of message bodies requested per FETCH,
+	// defaultBatchSize if unset. Each batch is written before the next is
+	// requested.
+	BatchSize int
+
+	// EnvelopeWindow is the number of envelopes fetched and decided at a
+	// time, defaultEnvelopeWindow if unset. The bodies of a window are
+	// written before the next is fetched, so memory use does not grow with
+	// the folder beyond its list of UIDs.
+	EnvelopeWindow int
+
+	// LastCapabilities is set to the capabilities of the server each time
+	// a connection logs in. Read it after List or Restore returns.
+	LastCapabilities []string
+
+	// Mirror moves stored files of messages no longer on the server to
+	// Store/.trash after each folder is fetched. It needs a folder per
+	// mailbox: the folder layout or the maildir format.
+	//
+	// Files are matched by key, which is derived from the Message-ID, so a
+	// changed UIDVALIDITY does not orphan them. Messages without a
+	// Message-ID are keyed by UID; after a renumber they are downloaded
+	// again under new keys and the old files are trashed. A folder that
+	// fails or times out is never pruned.
+	Mirror bool
+
+	// WriteSummary writes the RunSummary of each List to
+	// .imapdown-summary.json in the store.
+	WriteSummary bool
+
+	// WatchFolders are the folders Watch keeps in sync, INBOX if unset.
+	// WatchInterval is how often they are checked on a server without
+	// IDLE, defaultWatchInterval if unset.
+	WatchFolders  []string
+	WatchInterval time.Duration
+
+	// MarkSeen selects folders read-write and sets \Seen on the server for
+	// each message after it is stored. This changes the mailbox: other mail
+	// clients will show those messages as read, and which messages were
+	// unread before the backup is lost. Leave it off unless that is wanted;
+	// by default folders are opened read-only and nothing is changed.
+	MarkSeen bool
+
+	// WriteManifest writes Store/manifest.csv at the end of each List that
+	// succeeds. Native format only. See Manifest.
+	WriteManifest bool
+
+	// MaxMessageSize and MinMessageSize, when set, skip messages whose
+	// server reported size is above or below them. Each skipped message is
+	// recorded as a file with only its header, with Skipped set, so it is
+	// not considered again; delete those files to fetch them after changing
+	// the limits. Native format only.
+	MaxMessageSize int64
+	MinMessageSize int64
+
+	// DetectMoves finds messages new to a folder that are stored for
+	// another folder by Message-ID and size, such as after a move on the
+	// server, and copies the stored file rather than downloading the body.
+	// The copy is also taken from the trash if Mirror already pruned it.
+	// In the flat layout, where folders share files, the folder is added to
+	// Header.Folders instead. Native format without a Backend only.
+	DetectMoves bool
+
+	// DedupeByContent checks each downloaded body against those already
+	// stored, by Hash, and for a match writes a file with just the header,
+	// with DuplicateOf naming the file holding the body, as Dedupe does.
+	// The Hash covers the whole message, headers included, so this finds
+	// the same message stored under another key, such as in another folder
+	// with LayoutFolder. Open and Verify follow the reference. Native format
+	// without a Backend only.
+	DedupeByContent bool
+
+	// Deduper, when set, skips messages whose Message-ID it has seen, such
+	// as a message in several folders with LayoutFolder or one stored by an
+	// earlier run, and marks each message stored or found stored. Folders
+	// processed in parallel fetch such a message once. Messages without a
+	// Message-ID are always fetched. See OpenDeduper.
+	Deduper *Deduper
+
+	// RequireAttachment skips messages whose BODYSTRUCTURE shows no
+	// attachment, recording them the same way as messages outside the size
+	// limits. Native format only.
+	RequireAttachment bool
+
+	// MaxFolders and MaxMessages, when set, stop the run after that many
+	// folders or downloaded messages, such as to try settings on a large
+	// account. The run still succeeds, with RunSummary.Limited set, but is
+	// not recorded as the last run for SinceLastRun.
+	MaxFolders  int
+	MaxMessages int
+
+	// Sink, when set, receives each message as one line of JSON instead of
+	// a file in the store: the Header fields and the whole message as a
+	// base64 Body. Messages are only skipped if this Worker already wrote
+	// them, so a new Worker writes every message again. Store still holds
+	// the state and last run files. Native format in the flat layout only;
+	// options that rewrite stored files can't be used.
+	Sink io.Writer
+
+	// DryRun lists folders and checks which messages are new, but does not
+	// fetch bodies or write anything. Counts and sizes are always printed.
+	DryRun bool
+
+	cbMu  sync.Mutex
+	logMu sync.Mutex
+
+	idxMu    sync.Mutex // Guards the index fields.
+	idx      *os.File
+	idxSeen  map[string]bool
+	idxStale bool
+	idxByID  map[string][]Header // Message-ID to headers, for DetectMoves.
+	idxBody  map[string]Header   // Body to a file holding it, for DedupeByContent.
+
+	// Set before folders are processed.
+	lastRun    time.Time
+	reconnect  func(ctx context.Context) (*client.Client, error)
+	connSlots  chan struct{}                                     // Holds a value for each extra fetch connection.
+	statusDial func(ctx context.Context) (*client.Client, error) // Connects without UTF-8, see folderStatus.
+
+	statusMu sync.Mutex // Guards statusC.
+	statusC  *client.Client
+
+	mu         sync.Mutex // Guards the fields below.
+	state      *syncState
+	summary    RunSummary
+	keyFolders map[string][]string     // Folders each key was seen in this run, see seenKey.
+	folderUse  map[string]string       // Special-use role of each listed folder.
+	msgBudget  int                     // Messages left to fetch under MaxMessages.
+	sinkKeys   map[string]bool         // Keys written to Sink by this Worker.
+	utf8Conns  map[*client.Client]bool // Connections enableUTF8 enabled.
+	rate       *rate.Limiter
 }
 
-func (w *Worker) log(f string, v ...interface{}) {
-	if !w.Verbose {
-		return
+// List backs up every folder. A folder that fails is logged and the rest
+// are still backed up; the error then joins each folder's failure. The
+// summary covers the work completed even when the run fails part way.
+func (w *Worker) List(ctx context.Context, server, username, password string) (RunSummary, error) {
+	return w.run(ctx, nil, &account{server: server, username: username, secret: password})
+}
+
+// ListWithClient is List over c, a client that is already logged in. The
+// caller keeps ownership of c and logs out; it is left with a folder
+// selected. Lacking a way to connect again, folders are processed one at a
+// time without extra fetch connections, and a lost connection or a folder
+// timeout fails the run.
+func (w *Worker) ListWithClient(ctx context.Context, c *client.Client) (RunSummary, error) {
+	switch c.State() {
+	case imap.AuthenticatedState, imap.SelectedState:
+	default:
+		return RunSummary{}, fmt.Errorf("client is not logged in")
 	}
-	log.Printf(f, v...)
+	return w.run(ctx, c, nil)
 }
-func (w *Worker) List(ctx context.Context, server, username, password string) error {
+
+// run runs listAll with the summary and the files written after a run.
+func (w *Worker) run(ctx context.Context, c *client.Client, acct *account) (RunSummary, error) {
+	w.startSummary()
+	err := w.listAll(ctx, c, acct)
+	if err == nil && w.WriteManifest && !w.DryRun {
+		err = w.Manifest(ctx)
+	}
+	if serr := w.finishSummary(err); serr != nil && err == nil {
+		err = serr
+	}
+	sum := w.snapshotSummary()
+	if err == nil && len(sum.Errors) == 0 && !w.DryRun && !sum.Limited {
+		err = writeLastRun(w.Store, sum.Start, w.fileMode())
+	}
+	return sum, err
+}
+
+// listAll backs up every folder over c, or a connection to acct if c is
+// nil. Connections to acct are logged out; c is not. Without acct a lost
+// connection can't be replaced.
+func (w *Worker) listAll(ctx context.Context, c *client.Client, acct *account) error {
 	ctx, cancel := context.WithCancel(ctx)
 	defer cancel()
 
-	c, err := client.DialTLS(server, nil)
-	if err != nil {
+	switch w.Layout {
+	default:
+		return fmt.Errorf("unknown layout %q", w.Layout)
+	case "", LayoutFlat, LayoutFolder:
+	}
+	switch w.LogFormat {
+	default:
+		return fmt.Errorf("unknown log format %q", w.LogFormat)
+	case "", LogText, LogJSON:
+	}
+	switch w.Format {
+	default:
+		return fmt.Errorf("unknown format %q", w.Format)
+	case "", FormatNative, FormatMaildir, FormatMbox, FormatEML, FormatCAS:
+	}
+	if err := w.checkCAS(); err != nil {
 		return err
 	}
-
-	if err := c.Login(username, password); err != nil {
-		return fmt.Errorf("login to %v: %w", server, err)
+	if err := w.checkMirror(); err != nil {
+		return err
+	}
+	if err := w.checkBackend(); err != nil {
+		return err
+	}
+	if err := w.checkMoves(); err != nil {
+		return err
+	}
+	if err := w.checkSink(); err != nil {
+		return err
+	}
+	if err := w.checkModes(); err != nil {
+		return err
+	}
+	if err := w.checkEncrypt(); err != nil {
+		return err
+	}
+	if w.OnlyNewFolders && !w.Incremental {
+		return fmt.Errorf("skipping unchanged folders needs incremental state")
+	}
+	if err := w.checkText(); err != nil {
+		return err
+	}
+	if err := w.checkFolders(); err != nil {
+		return err
+	}
+	if err := w.checkSearchFlags(); err != nil {
+		return err
+	}
+	if _, err := newHasher(w.HashAlgo); err != nil {
+		return err
+	}
+	if w.ExtractAttachments && len(w.Format) > 0 && w.Format != FormatNative {
+		return fmt.Errorf("attachments can only be extracted with the %s format", FormatNative)
+	}
+	if (w.MaxMessageSize > 0 || w.MinMessageSize > 0) && !w.headerFiles() {
+		return fmt.Errorf("message size limits require the %s or %s format", FormatNative, FormatCAS)
+	}
+	if w.RequireAttachment && !w.headerFiles() {
+		return fmt.Errorf("requiring attachments needs the %s or %s format", FormatNative, FormatCAS)
+	}
+	if w.StoreRawHeaders && len(w.Format) > 0 && w.Format != FormatNative && w.Format != FormatEML {
+		return fmt.Errorf("raw headers can only be stored with the %s and %s formats", FormatNative, FormatEML)
+	}
+	if w.ReHashExisting && (len(w.Format) > 0 && w.Format != FormatNative || w.Backend != nil) {
+		return fmt.Errorf("rehashing needs the %s format without a Backend", FormatNative)
+	}
+	if w.ReHashExisting && w.SkipBodyHash {
+		return fmt.Errorf("rehashing needs body hashes")
+	}
+	if w.DedupeByContent && (len(w.Format) > 0 && w.Format != FormatNative || w.Backend != nil) {
+		return fmt.Errorf("deduplicating by content needs the %s format without a Backend", FormatNative)
+	}
+	if w.DedupeByContent && w.SkipBodyHash {
+		return fmt.Errorf("deduplicating by content needs body hashes")
+	}
+	if w.WriteManifest && !w.headerFiles() {
+		return fmt.Errorf("a manifest can only be written for the %s and %s formats", FormatNative, FormatCAS)
 	}
-	defer c.Logout()
 
-	miList := make([]*imap.MailboxInfo, 0, 100)
+	if err := w.prepareStore(); err != nil {
+		return err
+	}
+	w.lastRun = time.Time{}
+	w.mu.Lock()
+	w.keyFolders = nil
+	w.mu.Unlock()
+	if w.SinceLastRun {
+		t, err := readLastRun(w.Store)
+		if err != nil {
+			return err
+		}
+		if t.IsZero() {
+			w.log("No recorded last run, fetching everything")
+		} else {
+			w.lastRun = t.AddDate(0, 0, -1)
+			w.log("Fetching messages since the last run at %s", t.Format(time.RFC3339))
+		}
+	}
+	if w.Incremental {
+		st, err := loadState(w.Store)
+		if err != nil {
+			return err
+		}
+		w.state = st
+	}
+	if !w.DryRun {
+		if err := w.sweepTemp(); err != nil {
+			return err
+		}
+	}
+	if err := w.openIndex(ctx); err != nil {
+		return err
+	}
+	defer w.closeIndex()
 
-	errC := make(chan error)
-	ch := make(chan *imap.MailboxInfo, 10)
+	ownC := c == nil
+	// Logout is sent once: at the end of a run that gets there, so its
+	// error is returned, or on the way out of any other.
+	loggedOut := !ownC
+	if ownC {
+		var err error
+		c, err = w.connectRetry(ctx, acct.server, acct.username, acct.secret)
+		if err != nil {
+			return err
+		}
+		defer func() {
+			if !loggedOut {
+				c.Logout()
+			}
+		}()
+	}
+	w.reportQuota(c)
 
-	go func() {
-		errC <- c.List("*", "*", ch)
-	}()
-	for mi := range ch {
-		miList = append(miList, mi)
+	miList, err := w.folders(ctx, c)
+	if err != nil {
+		return err
 	}
-	select {
-	case <-ctx.Done():
-	case err := <-errC:
+	miList = w.dropNoSelect(miList)
+	if w.SkipEmptyFolders {
+		miList, err = w.dropEmpty(c, miList)
 		if err != nil {
-			return fmt.Errorf("list: %w", err)
+			return err
+		}
+	}
+	if w.OnlyNewFolders {
+		miList, err = w.dropUnchanged(c, miList)
+		if err != nil {
+			return err
+		}
+	}
+
+	var reconnect func(ctx context.Context) (*client.Client, error)
+	if ownC {
+		reconnect = func(ctx context.Context) (*client.Client, error) {
+			return w.connect(ctx, acct.server, acct.username, acct.secret)
+		}
+	}
+	// Folders are listed and their STATUS taken, so connections may now
+	// receive UTF-8 envelopes. The caller's own client is left alone, and so
+	// is a run allowed a single connection, as folderStatus needs another.
+	utf8 := ownC && w.maxConnections() > 1
+	if utf8 {
+		connect := reconnect
+		w.statusDial = connect
+		defer func() {
+			w.closeStatusConn()
+			w.statusDial = nil
+			w.mu.Lock()
+			w.utf8Conns = nil
+			w.mu.Unlock()
+		}()
+		w.enableUTF8(c)
+		reconnect = func(ctx context.Context) (*client.Client, error) {
+			c, err := connect(ctx)
+			if err == nil {
+				w.enableUTF8(c)
+			}
+			return c, err
+		}
+	}
+
+	if w.MaxFolders > 0 && len(miList) > w.MaxFolders {
+		w.log("Folder limit: processing %d of %d folders", w.MaxFolders, len(miList))
+		miList = miList[:w.MaxFolders]
+		w.addSummary(func(s *RunSummary) {
+			s.Limited = true
+		})
+	}
+	w.mu.Lock()
+	w.msgBudget = w.MaxMessages
+	w.mu.Unlock()
+
+	n := w.Concurrency
+	if n < 1 || reconnect == nil {
+		n = 1
+	}
+	if n > len(miList) {
+		n = len(miList)
+	}
+	max := w.maxConnections()
+	if w.utf8Conn(c) {
+		// One is kept for folderStatus.
+		max--
+	}
+	if n > max {
+		w.log("Concurrency %d is above the connection limit, using %d", n, max)
+		n = max
+	}
+	w.connSlots = nil
+	if slots := max - n; slots > 0 {
+		w.connSlots = make(chan struct{}, slots)
+	}
+	w.reconnect = reconnect
+	defer func() {
+		w.reconnect = nil
+	}()
+
+	// A failed folder is recorded and the next one processed. Only a done
+	// ctx or failing to connect, which would fail every folder, stops the
+	// run.
+	var errMu sync.Mutex
+	var errList []error
+	fail := func(err error, stop bool) {
+		errMu.Lock()
+		defer errMu.Unlock()
+		// Once the run stops the rest are cancelled; don't report those.
+		if len(errList) > 0 && errors.Is(err, context.Canceled) {
+			return
+		}
+		errList = append(errList, err)
+		w.addSummary(func(s *RunSummary) {
+			s.Errors = append(s.Errors, err.Error())
+		})
+		if stop {
+			cancel()
 		}
 	}
 
+	folders := make(chan *imap.MailboxInfo)
+	wg := &sync.WaitGroup{}
+	for i := 0; i < n; i++ {
+		var wc *client.Client
+		if i == 0 {
+			wc = c
+		}
+		wg.Add(1)
+		go func(wc *client.Client) {
+			defer wg.Done()
+			// A selected mailbox is per connection, so every worker beyond
+			// the first needs its own. A connection closed by a folder
+			// timeout is replaced before the next folder.
+			owned := false
+			defer func() {
+				if owned {
+					wc.Logout()
+				}
+			}()
+			for mi := range folders {
+				if ctx.Err() != nil {
+					return
+				}
+				err := w.withRetry(ctx, "folder "+mi.Name, func() error {
+					if wc == nil || wc.State() == imap.LogoutState {
+						if owned {
+							wc.Logout()
+						}
+						if acct == nil {
+							return fmt.Errorf("connection lost, the client given can't be replaced")
+						}
+						var err error
+						wc, err = w.connectRetry(ctx, acct.server, acct.username, acct.secret)
+						if err != nil {
+							return err
+						}
+						if utf8 {
+							w.enableUTF8(wc)
+						}
+						owned = true
+					}
+					err := w.iterFolder(ctx, wc, mi)
+					if err != nil && wc.State() == imap.LogoutState && !errors.Is(err, errFolderTimeout) {
+						return transientError{err}
+					}
+					return err
+				})
+				if errors.Is(err, errFolderTimeout) {
+					w.event(logEvent{Event: "folder_timeout", Folder: mi.Name, Error: err.Error()})
+					w.print("Folder %s: %v, skipped", mi.Name, err)
+					w.addSummary(func(s *RunSummary) {
+						s.Errors = append(s.Errors, fmt.Sprintf("%s: %v", mi.Name, err))
+					})
+					continue
+				}
+				if err != nil {
+					w.event(logEvent{Event: "folder_error", Folder: mi.Name, Error: err.Error()})
+					if ctx.Err() != nil || errors.Is(err, ErrAuth) || errors.Is(err, ErrConnect) {
+						fail(fmt.Errorf("iter %s: %w", mi.Name, err), true)
+						return
+					}
+					w.print("Folder %s failed, continuing with the next: %v", mi.Name, err)
+					fail(fmt.Errorf("iter %s: %w", mi.Name, err), false)
+				}
+			}
+		}(wc)
+	}
+feed:
 	for _, mi := range miList {
-		if err := ctx.Err(); err != nil {
-			return err
+		if w.MaxMessages > 0 && w.messagesLeft() == 0 {
+			w.log("Message limit of %d reached, stopping", w.MaxMessages)
+			break
 		}
-		err := w.Iter(ctx, c, mi)
-		if err != nil {
-			return fmt.Errorf("iter: %w", err)
+		select {
+		case <-ctx.Done():
+			break feed
+		case folders <- mi:
+		}
+	}
+	close(folders)
+	wg.Wait()
+
+	folderErr := errors.Join(errList...)
+	if err := ctx.Err(); err != nil {
+		if folderErr != nil {
+			return folderErr
+		}
+		return err
+	}
+	if w.DryRun {
+		s := w.snapshotSummary()
+		w.print("dry-run: would fetch %d messages, %d bytes", s.New, s.NewBytes)
+	}
+	if err := w.updateFolders(ctx); err != nil {
+		return errors.Join(folderErr, err)
+	}
+	if w.idxStale {
+		// Mirror moved indexed files to the trash, or headers changed.
+		if err := w.closeIndex(); err != nil {
+			return errors.Join(folderErr, err)
 		}
+		if err := w.RebuildIndex(ctx); err != nil {
+			return errors.Join(folderErr, err)
+		}
+	}
+	if loggedOut || c.State() == imap.LogoutState {
+		// The caller's, or closed by a folder timeout and replaced.
+		return folderErr
 	}
-	return c.Logout()
+	loggedOut = true
+	return errors.Join(folderErr, c.Logout())
 }
 
+var errFolderTimeout = errors.New("folder timed out")
+
+// errUIDValidityChanged is returned by iter when the folder was renumbered
+// after its envelopes were fetched.
+var errUIDValidityChanged = errors.New("uidvalidity changed")
+
+// isNoMessages reports whether err is a server's reply to a FETCH of a set
+// that matched nothing, such as when every message was expunged first.
+func isNoMessages(err error) bool {
+	return err != nil && strings.Contains(err.Error(), "No matching messages")
+}
+
+const (
+	defaultBatchSize      = 200
+	defaultEnvelopeWindow = 5000
+)
+
+// batches splits uids, in order, into runs of at most n for one FETCH each.
+func batches(uids []uint32, n int) [][]uint32 {
+	var list [][]uint32
+	for len(uids) > n {
+		list = append(list, uids[:n])
+		uids = uids[n:]
+	}
+	if len(uids) > 0 {
+		list = append(list, uids)
+	}
+	return list
+}
+
+// iterFolder runs Iter bounded by FolderTimeout. A blocked command can't be
+// cancelled, so on timeout the connection is closed and must be replaced.
+func (w *Worker) iterFolder(ctx context.Context, c *client.Client, mi *imap.MailboxInfo) error {
+	if w.FolderTimeout <= 0 {
+		return w.Iter(ctx, c, mi)
+	}
+	fctx, cancel := context.WithTimeout(ctx, w.FolderTimeout)
+	defer cancel()
+
+	stop := make(chan struct{})
+	go func() {
+		select {
+		case <-stop:
+		case <-fctx.Done():
+			if errors.Is(fctx.Err(), context.DeadlineExceeded) {
+				c.Terminate()
+			}
+		}
+	}()
+	err := w.Iter(fctx, c, mi)
+	close(stop)
+	if err != nil && ctx.Err() == nil && errors.Is(fctx.Err(), context.DeadlineExceeded) {
+		return fmt.Errorf("%w after %v", errFolderTimeout, w.FolderTimeout)
+	}
+	return err
+}
+
+// Iter backs up one folder over c. If the server renumbers the folder, with
+// a new UIDVALIDITY, before its bodies are fetched, the folder is processed
+// again from the start.
 func (w *Worker) Iter(ctx context.Context, c *client.Client, mi *imap.MailboxInfo) error {
+	err := w.iter(ctx, c, mi, false)
+	if errors.Is(err, errUIDValidityChanged) {
+		w.print("Folder %s: UIDVALIDITY changed during the run, starting over", mi.Name)
+		w.forgetFolder(mi.Name)
+		err = w.iter(ctx, c, mi, true)
+	}
+	return err
+}
+
+// iter is Iter. restarted is set when processing the folder again after
+// errUIDValidityChanged.
+func (w *Worker) iter(ctx context.Context, c *client.Client, mi *imap.MailboxInfo, restarted bool) error {
 	ctx, cancel := context.WithCancel(ctx)
 	defer cancel()
 
+	start := time.Now()
 	w.log("Folder: %s", mi.Name)
 
-	_, err := c.Select(mi.Name, true)
+	readOnly := !w.MarkSeen || w.DryRun
+	status, err := c.Select(mi.Name, readOnly)
 	if err != nil {
 		return fmt.Errorf("select: %w", err)
 	}
 
-	seqset, err := imap.ParseSeqSet("1:*")
-	if err != nil {
-		return err
+	ka := w.startKeepalive(c)
+	defer ka.stop()
+
+	w.onFolder(mi.Name, int(status.Messages))
+	if !restarted {
+		w.addSummary(func(s *RunSummary) {
+			s.Folders++
+		})
+	}
+	w.event(logEvent{Event: "folder_start", Folder: mi.Name, Count: int(status.Messages)})
+
+	var lastUID uint32
+	if fs, ok := w.folderState(mi.Name); ok {
+		switch {
+		case fs.UIDValidity == status.UidValidity && fs.LastUID > 0:
+			lastUID = fs.LastUID
+			w.log("\tincremental from uid %d", lastUID+1)
+		case fs.UIDValidity != 0:
+			w.log("\tuidvalidity changed, full scan")
+		}
 	}
+	maxUID := lastUID
 
 	const keySize = 32
 	key := [keySize]byte{}
@@ -98,152 +908,817 @@ func (w *Worker) Iter(ctx context.Context, c *client.Client, mi *imap.MailboxInf
 		return err
 	}
 
-	msgList := make([]uint32, 0, 100)
-	msgC := make(chan *imap.Message, 10)
-	fetchErr := make(chan error)
-	go func() {
-		fetchErr <- c.Fetch(seqset, []imap.FetchItem{imap.FetchEnvelope, imap.FetchUid}, msgC)
-	}()
-	existCount := 0
-	for msg := range msgC {
-		name, err := fn(xof, key[:], msg.Envelope.MessageId)
-		if err != nil {
-			return fmt.Errorf("fn: %w", err)
-		}
+	dir := w.folderPath(mi.Name)
 
-		_, err = os.Stat(filepath.Join(w.Store, name))
-		if err == nil {
-			existCount++
-			continue
-		}
-		if os.IsNotExist(err) {
-			msgList = append(msgList, msg.SeqNum)
-			continue
-		}
-		return fmt.Errorf("store stat: %w", err)
+	settings := w.folderSettings(mi.Name)
+	criteria := w.searchCriteria(settings)
+	// present collects the key of every message on the server for Mirror.
+	// Only a full listing has them all; otherwise mirrorFolder fetches them.
+	var present map[string]bool
+	if w.Mirror && lastUID == 0 && criteria == nil {
+		present = map[string]bool{}
 	}
-	select {
-	case <-ctx.Done():
-		return ctx.Err()
-	case err := <-fetchErr:
-		if err != nil {
-			e := err.Error()
-			switch {
-			default:
-				return fmt.Errorf("fetch: %w", err)
-			case strings.Contains(e, "No matching messages"):
-				w.log("\tno-messages")
-				return nil
+	complete := true // Every message was handled, none left by MaxMessages.
+	finish := func() error {
+		ka.stop()
+		if w.DryRun {
+			return nil
+		}
+		if w.Mirror {
+			if err := w.mirrorFolder(c, dir, mi.Name, present, xof, key[:]); err != nil {
+				return fmt.Errorf("mirror: %w", err)
 			}
 		}
+		fs := folderState{UIDValidity: status.UidValidity, LastUID: maxUID}
+		if complete {
+			// As of the SELECT; messages added since have a higher UID.
+			fs.UIDNext, fs.Messages = status.UidNext, status.Messages
+		}
+		return w.setFolderState(mi.Name, fs)
 	}
 
-	w.log("\tfetch %05d messages", len(msgList))
-	w.log("\texist %05d messages", existCount)
-	if len(msgList) == 0 {
-		w.log("\tnothing-to-do")
-		return nil
+	// Only the UIDs of the folder are held in memory. Envelopes are fetched
+	// and decided a window at a time, and the bodies of a window are written
+	// before the next window is listed.
+	if criteria == nil {
+		criteria = &imap.SearchCriteria{}
+	}
+	criteria.Uid = &imap.SeqSet{}
+	criteria.Uid.AddRange(lastUID+1, 0)
+	var uids []uint32
+	err = ka.do(func() error {
+		var err error
+		uids, err = uidSearch(c, criteria)
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("search: %w", err)
+	}
+	sort.Slice(uids, func(i, j int) bool { return uids[i] < uids[j] })
+	// "n:*" always matches the last message, even when its UID is below n.
+	for len(uids) > 0 && uids[0] <= lastUID {
+		uids = uids[1:]
+	}
+	if len(uids) == 0 {
+		w.log("\tno-messages")
+		return finish()
+	}
+
+	exists, err := w.existsFunc(dir, mi.Name)
+	if err != nil {
+		return fmt.Errorf("store: %w", err)
 	}
 
 	secName, err := imap.ParseBodySectionName(imap.FetchItem("BODY[]"))
 	if err != nil {
 		return err
 	}
+	// The envelope has no References, so fetch that header on its own.
+	refName, err := imap.ParseBodySectionName(imap.FetchItem("BODY.PEEK[HEADER.FIELDS (REFERENCES)]"))
+	if err != nil {
+		return err
+	}
 
-	ss := &imap.SeqSet{}
-	for _, v := range msgList {
-		ss.AddNum(v)
+	var bodyHasher hash.Hash
+	if !w.SkipBodyHash {
+		bodyHasher, err = newHasher(w.hashAlgo())
+		if err != nil {
+			return err
+		}
 	}
-	msgC = make(chan *imap.Message, 10)
-	go func() {
-		fetchErr <- c.Fetch(ss, []imap.FetchItem{imap.FetchEnvelope, secName.FetchItem()}, msgC)
-	}()
-	headerSep := []byte("---\n")
-	buf := &bytes.Buffer{}
-	bodyBuf := &bytes.Buffer{}
 
-	bodyHasher, err := blake2b.New256(nil)
-	if err != nil {
-		return err
+	envItems := []imap.FetchItem{imap.FetchEnvelope, imap.FetchUid, imap.FetchInternalDate, imap.FetchRFC822Size, imap.FetchFlags}
+	if w.RequireAttachment {
+		envItems = append(envItems, imap.FetchBodyStructure)
+	}
+	items := []imap.FetchItem{imap.FetchEnvelope, imap.FetchUid, imap.FetchInternalDate, imap.FetchFlags, secName.FetchItem(), refName.FetchItem()}
+	if supportsLabels(c) {
+		items = append(items, gmailLabels)
 	}
 
-	for msg := range msgC {
-		buf.Reset()
-		bodyBuf.Reset()
-		bodyHasher.Reset()
+	batch := w.BatchSize
+	if batch <= 0 {
+		batch = defaultBatchSize
+	}
+	window := w.EnvelopeWindow
+	if window <= 0 {
+		window = defaultEnvelopeWindow
+	}
+	// Buffered so a fetch goroutine can always exit, even when ctx is done
+	// and the result is never read.
+	fetchErr := make(chan error, 1)
 
-		name, err := fn(xof, key[:], msg.Envelope.MessageId)
-		if err != nil {
-			return fmt.Errorf("fn: %w", err)
+	// Totals over all windows.
+	var newBytes int64
+	fetchCount, existCount, moved, sizeCount, noAttachCount, rechecked, changed := 0, 0, 0, 0, 0, 0, 0
+	dupCount, deletedCount := 0, 0
+	var claims []string // Message-IDs claimed in Deduper, released unless marked.
+	defer func() {
+		if len(claims) > 0 {
+			w.Deduper.release(claims)
 		}
+	}()
+	limited, limitUID := 0, uint32(math.MaxUint32) // Left for a later run by MaxMessages.
 
+	done := 0
+	var written int64
+	pr := w.newProgress(mi.Name, 0, 0)
+	stored := &imap.SeqSet{}
+	use := w.specialUse(mi.Name)
+	header := func(msg *imap.Message) (Header, error) {
+		name, err := w.messageName(xof, key[:], mi.Name, status.UidValidity, msg)
+		if err != nil {
+			return Header{}, fmt.Errorf("name: %w", err)
+		}
+		h := envelopeHeader(mi.Name, msg)
+		h.Key = name
+		h.SpecialUse = use
+		h.UIDValidity = status.UidValidity
+		h.UID = msg.Uid
+		h.References = parseReferences(msg.GetBody(refName))
+		h.Flags = msg.Flags
+		h.Labels = messageLabels(msg)
+		return h, nil
+	}
+	write := func(msg *imap.Message) error {
+		// Stop between messages so the one being written is finished.
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		h, err := header(msg)
+		if err != nil {
+			return err
+		}
 		body := msg.GetBody(secName)
-		_, err = io.Copy(bodyBuf, io.TeeReader(body, bodyHasher))
+		if body == nil {
+			// A message expunged since the envelope fetch may be returned
+			// without a body; the next run no longer lists it.
+			w.log("\tmissing body for %s, skipped", h.Key)
+			return nil
+		}
+		err = w.writeMessage(dir, &h, msg, body, bodyHasher)
 		if err != nil {
-			return fmt.Errorf("hash body")
+			return fmt.Errorf("write: %w", err)
 		}
-
-		from := ""
-		if len(msg.Envelope.From) > 0 {
-			f := msg.Envelope.From[0]
-			if len(f.PersonalName) > 0 {
-				from = fmt.Sprintf("%s <%s@%s>", f.PersonalName, f.MailboxName, f.HostName)
-			} else {
-				from = fmt.Sprintf("<%s@%s>", f.MailboxName, f.HostName)
+		if err := w.appendIndex(&h); err != nil {
+			return err
+		}
+		if w.Deduper != nil {
+			if err := w.Deduper.Mark(h.MessageID, h.Key); err != nil {
+				return err
 			}
 		}
-
-		h := Header{
-			Key:       name,
-			MessageID: msg.Envelope.MessageId,
-			Date:      msg.Envelope.Date.Format(time.RFC3339Nano),
-			Folder:    mi.Name,
-			Subject:   msg.Envelope.Subject,
-			From:      from,
-			Size:      strconv.FormatInt(int64(bodyBuf.Len()), 10),
-			Hash:      bodyHasher.Sum(nil),
+		stored.AddNum(msg.Uid)
+		done++
+		size, _ := strconv.ParseInt(h.Size, 10, 64)
+		written += size
+		w.addSummary(func(s *RunSummary) {
+			s.Fetched++
+			s.Bytes += size
+		})
+		pr.add(size)
+		w.onMessage(mi.Name, done, len(uids))
+		return nil
+	}
+	aborted := false // The connection was closed by abort.
+	markSeen := func() error {
+		if !w.MarkSeen || stored.Empty() {
+			return nil
+		}
+		var err error
+		if aborted {
+			err = w.markSeenNew(mi.Name, stored)
+		} else {
+			err = ka.do(func() error {
+				return w.markSeen(c, stored)
+			})
 		}
-		e := json.NewEncoder(buf)
-		e.SetEscapeHTML(false)
-		err = e.Encode(h)
+		stored = &imap.SeqSet{}
+		return err
+	}
+	// abort stops the body fetch in progress once write fails. A FETCH
+	// can't be stopped short of its batch except by closing the connection,
+	// so a cancelled run does that instead of waiting for the rest.
+	abort := func() {
+		if ctx.Err() != nil {
+			c.Terminate()
+			aborted = true
+		}
+	}
+	rehash := func(msg *imap.Message) error {
+		h, err := header(msg)
 		if err != nil {
-			return fmt.Errorf("marshal header: %w", err)
+			return err
+		}
+		body := msg.GetBody(secName)
+		if body == nil {
+			return nil
 		}
-		buf.Write(headerSep)
-		_, err = io.Copy(buf, bodyBuf)
+		ok, err := w.rehashMessage(dir, &h, messageDate(msg), body, bodyHasher)
 		if err != nil {
-			return fmt.Errorf("body read: %w", err)
+			return fmt.Errorf("rehash %s: %w", h.Key, err)
 		}
+		if ok {
+			changed++
+		}
+		return nil
+	}
+	var extra []*client.Client
+	extraOpened := false
+	defer func() {
+		w.closeFetchConns(extra)
+	}()
 
-		fn := filepath.Join(w.Store, name)
-		err = os.WriteFile(fn, buf.Bytes(), 0600)
-		if err != nil {
-			return fmt.Errorf("write: %w", err)
+	for at := 0; at < len(uids); at += window {
+		end := at + window
+		if end > len(uids) {
+			end = len(uids)
+		}
+		ss := &imap.SeqSet{}
+		ss.AddNum(uids[at:end]...)
+
+		var winBytes int64
+		var sizeList []*imap.Message // Outside the size limits.
+		var noAttach []*imap.Message // Without an attachment.
+		var recheckList []uint32     // UIDs of stored messages to rehash.
+		// Bodies are fetched by UID, which unlike sequence numbers is not
+		// shifted by messages expunged in the meantime.
+		uidList := make([]uint32, 0, end-at)
+		msgC := make(chan *imap.Message, 10)
+		go func() {
+			fetchErr <- ka.do(func() error {
+				return c.UidFetch(ss, envItems, msgC)
+			})
+		}()
+		for msg := range msgC {
+			if msg.Uid <= lastUID {
+				continue
+			}
+			if msg.Uid > maxUID {
+				maxUID = msg.Uid
+			}
+			name, err := w.messageName(xof, key[:], mi.Name, status.UidValidity, msg)
+			if err != nil {
+				drain(msgC)
+				return fmt.Errorf("name: %w", err)
+			}
+			if present != nil {
+				present[name] = true
+			}
+			if w.seenKey(name, mi.Name) {
+				existCount++
+				continue
+			}
+
+			ok, err := exists(name)
+			if err != nil {
+				drain(msgC)
+				return fmt.Errorf("store stat: %w", err)
+			}
+			if ok {
+				existCount++
+				if w.ReHashExisting {
+					recheckList = append(recheckList, msg.Uid)
+				}
+				if w.Deduper != nil && !w.DryRun {
+					if err := w.Deduper.Mark(normalizeMessageID(msg.Envelope.MessageId), name); err != nil {
+						drain(msgC)
+						return err
+					}
+				}
+				continue
+			}
+			if w.SkipDeleted && hasFlag(msg.Flags, imap.DeletedFlag) {
+				deletedCount++
+				continue
+			}
+			if w.DetectMoves && !w.DryRun {
+				ok, err := w.relocate(dir, mi.Name, name, status.UidValidity, msg)
+				if err != nil {
+					drain(msgC)
+					return fmt.Errorf("relocate: %w", err)
+				}
+				if ok {
+					moved++
+					continue
+				}
+			}
+			if settings.sizeSkipped(msg.Size) {
+				sizeList = append(sizeList, msg)
+				continue
+			}
+			if w.RequireAttachment && !hasAttachment(msg.BodyStructure) {
+				noAttach = append(noAttach, msg)
+				continue
+			}
+			if w.Deduper != nil {
+				id := normalizeMessageID(msg.Envelope.MessageId)
+				if !w.Deduper.claim(id) {
+					dupCount++
+					continue
+				}
+				if len(id) > 0 {
+					claims = append(claims, id)
+				}
+			}
+			if w.MaxMessages > 0 && !w.takeMessage() {
+				limited++
+				if msg.Uid-1 < limitUID {
+					limitUID = msg.Uid - 1
+				}
+				continue
+			}
+			uidList = append(uidList, msg.Uid)
+			winBytes += int64(msg.Size)
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case err := <-fetchErr:
+			switch {
+			case isNoMessages(err):
+				// Every message of the window was expunged.
+				continue
+			case err != nil:
+				return fmt.Errorf("fetch: %w", err)
+			}
+		}
+		// UIDs from the envelopes are only good while UIDVALIDITY stays the
+		// same.
+		if !w.DryRun && len(uidList)+len(recheckList)+len(sizeList)+len(noAttach) > 0 {
+			renumbered, err := w.uidValidityChanged(ctx, ka, c, mi.Name, status.UidValidity)
+			if err != nil {
+				return err
+			}
+			if renumbered {
+				if w.MaxMessages > 0 {
+					w.returnMessages(len(uidList))
+				}
+				return errUIDValidityChanged
+			}
+		}
+
+		fetchCount += len(uidList)
+		newBytes += winBytes
+		sizeCount += len(sizeList)
+		noAttachCount += len(noAttach)
+		rechecked += len(recheckList)
+		w.addSummary(func(s *RunSummary) {
+			s.New += len(uidList)
+			s.NewBytes += winBytes
+			s.SizeSkipped += len(sizeList)
+			s.Unattached += len(noAttach)
+		})
+		if w.DryRun {
+			continue
+		}
+		for _, skip := range []struct {
+			reason string
+			list   []*imap.Message
+		}{
+			{SkipSize, sizeList},
+			{SkipNoAttachment, noAttach},
+		} {
+			if len(skip.list) == 0 {
+				continue
+			}
+			if err := w.mkdirAll(dir); err != nil {
+				return fmt.Errorf("store dir: %w", err)
+			}
+			for _, msg := range skip.list {
+				name, err := w.messageName(xof, key[:], mi.Name, status.UidValidity, msg)
+				if err != nil {
+					return fmt.Errorf("name: %w", err)
+				}
+				if err := w.writeSkipped(dir, mi.Name, name, status.UidValidity, msg, skip.reason); err != nil {
+					return fmt.Errorf("write skipped: %w", err)
+				}
+			}
+		}
+		if len(uidList) > 0 {
+			if err := w.mkdirAll(dir); err != nil {
+				return fmt.Errorf("store dir: %w", err)
+			}
+			w.log("\tfetch %05d messages", len(uidList))
+			pr.grow(len(uidList), winBytes)
+		}
+
+		cp := w.newCheckpoint(mi.Name, status.UidValidity, uidList, batch, limitUID)
+		if w.FetchConnections > 0 && len(uidList) > batch && !extraOpened {
+			extraOpened = true
+			n := (len(uids)-at+batch-1)/batch - 1
+			if n > w.FetchConnections {
+				n = w.FetchConnections
+			}
+			extra = w.fetchConns(ctx, mi.Name, n)
+			if len(extra) > 0 {
+				w.log("\tfetch over %d connections", 1+len(extra))
+			}
+		}
+		if len(extra) > 0 && len(uidList) > batch {
+			fctx, fcancel := context.WithCancel(ctx)
+			msgC := make(chan fetched, 10)
+			go func() {
+				fetchErr <- w.fetchParallel(fctx, ka, c, extra, uidList, batch, items, msgC)
+			}()
+			for f := range msgC {
+				var err error
+				if f.msg != nil {
+					err = write(f.msg)
+					if err == nil {
+						err = cp.handled(f.msg.Uid)
+					}
+				}
+				for _, uid := range f.gone {
+					if err == nil {
+						err = cp.handled(uid)
+					}
+				}
+				if err != nil {
+					fcancel()
+					abort()
+					for range msgC {
+					}
+					if ctx.Err() != nil {
+						markSeen()
+					}
+					return err
+				}
+			}
+			fcancel()
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case err := <-fetchErr:
+				if err != nil {
+					return err
+				}
+			}
+			if err := markSeen(); err != nil {
+				return err
+			}
+		} else {
+			end := 0
+			for _, b := range batches(uidList, batch) {
+				end += len(b)
+				ss := &imap.SeqSet{}
+				ss.AddNum(b...)
+				msgC := make(chan *imap.Message, 10)
+				go func() {
+					fetchErr <- ka.do(func() error {
+						return c.UidFetch(ss, items, msgC)
+					})
+				}()
+				for msg := range msgC {
+					if err := write(msg); err != nil {
+						abort()
+						drain(msgC)
+						if ctx.Err() != nil {
+							markSeen()
+						}
+						return err
+					}
+				}
+				select {
+				case <-ctx.Done():
+					return ctx.Err()
+				case err := <-fetchErr:
+					if err != nil && !isNoMessages(err) {
+						return err
+					}
+				}
+				if err := markSeen(); err != nil {
+					return err
+				}
+				if err := cp.through(end); err != nil {
+					return err
+				}
+			}
+		}
+
+		for _, b := range batches(recheckList, batch) {
+			ss := &imap.SeqSet{}
+			ss.AddNum(b...)
+			msgC := make(chan *imap.Message, 10)
+			go func() {
+				fetchErr <- ka.do(func() error {
+					return c.UidFetch(ss, items, msgC)
+				})
+			}()
+			for msg := range msgC {
+				if err := rehash(msg); err != nil {
+					drain(msgC)
+					return err
+				}
+			}
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case err := <-fetchErr:
+				if err != nil && !isNoMessages(err) {
+					return err
+				}
+			}
+		}
+
+		// Everything below the next window is now handled, so a run that
+		// fails in a later window resumes there.
+		if end < len(uids) {
+			last := uids[end] - 1
+			if last > limitUID {
+				last = limitUID
+			}
+			if err := w.saveFolderState(mi.Name, status.UidValidity, last); err != nil {
+				return err
+			}
 		}
 	}
-	select {
-	case <-ctx.Done():
-		return ctx.Err()
-	case err := <-fetchErr:
-		if err != nil {
-			return err
+
+	if limited > 0 {
+		complete = false
+		w.log("\tmessage limit reached, %d messages left", limited)
+		// Incremental runs must still find those.
+		if limitUID < maxUID {
+			maxUID = limitUID
 		}
+		w.addSummary(func(s *RunSummary) {
+			s.Limited = true
+		})
+	}
+	w.log("\texist %05d messages", existCount)
+	if sizeCount > 0 {
+		w.log("\tsize-skip %05d messages", sizeCount)
+	}
+	if noAttachCount > 0 {
+		w.log("\tno-attachment %05d messages", noAttachCount)
+	}
+	if dupCount > 0 {
+		w.log("\tduplicate %05d messages", dupCount)
+	}
+	if deletedCount > 0 {
+		w.log("\tdeleted %05d messages", deletedCount)
+	}
+	if moved > 0 {
+		w.log("\tmoved %05d messages", moved)
+	}
+	w.addSummary(func(s *RunSummary) {
+		s.Skipped += existCount
+		s.Moved += moved
+	})
+	if w.DryRun {
+		w.print("%s: %d new, %d present, %d outside size limits, %d without attachments, %d bytes", mi.Name, fetchCount, existCount, sizeCount, noAttachCount, newBytes)
+		return nil
+	}
+	if fetchCount == 0 && rechecked == 0 {
+		w.log("\tnothing-to-do")
+		w.event(logEvent{Event: "folder_done", Folder: mi.Name, Duration: time.Since(start).Seconds()})
+		return finish()
+	}
+	if gone := fetchCount - done; gone > 0 {
+		w.log("\t%d messages gone before their body was fetched", gone)
+	}
+	if rechecked > 0 {
+		w.log("\trehashed %05d messages, %d changed", rechecked, changed)
+		w.addSummary(func(s *RunSummary) {
+			s.Changed += changed
+		})
 	}
 	w.log("\tdone")
+	w.event(logEvent{Event: "folder_done", Folder: mi.Name, Count: done, Bytes: written, Duration: time.Since(start).Seconds()})
 
+	return finish()
+}
+
+// uidValidityChanged reports whether the UIDVALIDITY of the selected folder
+// differs from want. Failing to find out is an error, as the UIDs can then
+// not be trusted.
+func (w *Worker) uidValidityChanged(ctx context.Context, ka *keepalive, c *client.Client, name string, want uint32) (bool, error) {
+	var st *imap.MailboxStatus
+	err := ka.do(func() error {
+		var err error
+		st, err = w.folderStatus(ctx, c, name, []imap.StatusItem{imap.StatusUidValidity})
+		return err
+	})
+	if err != nil {
+		return false, fmt.Errorf("status: %w", err)
+	}
+	if st.UidValidity != want {
+		w.log("\tuidvalidity changed from %d to %d", want, st.UidValidity)
+		return true, nil
+	}
+	return false, nil
+}
+
+// markSeen sets \Seen on the messages with the given UIDs.
+func (w *Worker) markSeen(c *client.Client, uids *imap.SeqSet) error {
+	item := imap.FormatFlagsOp(imap.AddFlags, true)
+	err := c.UidStore(uids, item, []interface{}{imap.SeenFlag}, nil)
+	if err != nil {
+		return fmt.Errorf("mark seen: %w", err)
+	}
 	return nil
 }
 
+// markSeenNew marks the messages seen over a new connection, for a folder
+// whose own connection was closed to stop a fetch. The run is cancelled by
+// then, so the connection is not tied to its context.
+func (w *Worker) markSeenNew(mailbox string, uids *imap.SeqSet) error {
+	if w.reconnect == nil {
+		return fmt.Errorf("mark seen: connection closed")
+	}
+	c, err := w.reconnect(context.Background())
+	if err != nil {
+		return fmt.Errorf("mark seen: %w", err)
+	}
+	defer c.Logout()
+	if _, err := c.Select(mailbox, false); err != nil {
+		return fmt.Errorf("mark seen: %w", err)
+	}
+	return w.markSeen(c, uids)
+}
+
+func (w *Worker) onFolder(name string, total int) {
+	if w.OnFolder == nil {
+		return
+	}
+	w.cbMu.Lock()
+	defer w.cbMu.Unlock()
+	w.OnFolder(name, total)
+}
+
+func (w *Worker) onMessage(folder string, done, total int) {
+	if w.OnMessage == nil {
+		return
+	}
+	w.cbMu.Lock()
+	defer w.cbMu.Unlock()
+	w.OnMessage(folder, done, total)
+}
+
+// folderState returns the recorded state for folder when incremental sync is
+// enabled.
+func (w *Worker) folderState(folder string) (folderState, bool) {
+	if !w.Incremental {
+		return folderState{}, false
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.state == nil {
+		return folderState{}, false
+	}
+	return w.state.folder(folder), true
+}
+
+// saveFolderState records that every message up to lastUID is in the store.
+func (w *Worker) saveFolderState(folder string, uidValidity, lastUID uint32) error {
+	return w.setFolderState(folder, folderState{
+		UIDValidity: uidValidity,
+		LastUID:     lastUID,
+	})
+}
+
+func (w *Worker) setFolderState(folder string, fs folderState) error {
+	if !w.Incremental {
+		return nil
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.state == nil {
+		return nil
+	}
+	w.state.setFolder(folder, fs)
+	return w.state.save(w.Store, w.fileMode())
+}
+
+// folderUnchanged reports whether STATUS shows folder as it was when last
+// processed to the end: no message added, as UIDNEXT is the same, and none
+// removed.
+func (w *Worker) folderUnchanged(c *client.Client, folder string) (bool, error) {
+	fs, ok := w.folderState(folder)
+	if !ok || fs.UIDNext == 0 {
+		return false, nil
+	}
+	st, err := c.Status(folder, []imap.StatusItem{imap.StatusUidNext, imap.StatusUidValidity, imap.StatusMessages})
+	if err != nil {
+		return false, fmt.Errorf("status: %w", err)
+	}
+	return st.UidValidity == fs.UIDValidity && st.UidNext == fs.UIDNext && st.Messages == fs.Messages, nil
+}
+
+// dropUnchanged removes the folders folderUnchanged reports unchanged.
+func (w *Worker) dropUnchanged(c *client.Client, miList []*imap.MailboxInfo) ([]*imap.MailboxInfo, error) {
+	list := miList[:0]
+	for _, mi := range miList {
+		same, err := w.folderUnchanged(c, mi.Name)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", mi.Name, err)
+		}
+		if same {
+			w.log("Skip folder: %s, unchanged since the last run", mi.Name)
+			continue
+		}
+		list = append(list, mi)
+	}
+	return list, nil
+}
+
+// drain discards the remaining messages of a fetch so the goroutine running
+// it can finish and the connection is free for the next command.
+func drain(ch chan *imap.Message) {
+	for range ch {
+	}
+}
+
 type Header struct {
-	Key       string
-	MessageID string
-	InReplyTo string // Parent MessageID.
-	Date      string
-	Folder    string
-	Subject   string
-	From      string
-	Size      string // Length of Body in bytes.
-	Hash      []byte // blake2b of Body.
+	Key        string
+	MessageID  string
+	InReplyTo  string   // Parent MessageID.
+	References []string // Thread ancestors, oldest first.
+	Date       string   // RFC 3339 Date header, else the internal date; empty if unknown.
+	Folder     string
+	Folders    []string // Every folder the message was seen in, if more than Folder.
+	Subject    string
+	From       string
+	Size       string // Length of Body in bytes.
+	Hash       []byte // Hash of Body using HashAlgo.
+	HashAlgo   string // HashBlake2b256 if empty.
+	Flags      []string
+	Labels     []string // Gmail labels.
+
+	// SpecialUse is the RFC 6154 role of Folder, such as \Sent or \Trash,
+	// as reported by the server or guessed from its name.
+	SpecialUse string
+
+	// UIDValidity and UID locate the message in Folder on the server when
+	// it was stored.
+	UIDValidity uint32
+	UID         uint32
+
+	// RawHeader is the header block of Body as received, when the Worker
+	// has StoreRawHeaders set. It is not copied to the index.
+	RawHeader string
+
+	Attachments []Attachment // Set when attachments are extracted.
+
+	// Skipped is set when the body was not stored, for the reason in
+	// SkipReason. Size is then the size reported by the server and Hash is
+	// empty.
+	Skipped    bool
+	SkipReason string
+
+	// DuplicateOf is set by Dedupe and DedupeByContent to the store
+	// relative path of the file holding the same body, which this file
+	// does not have.
+	DuplicateOf string
+
+	// Object is set in the cas format to the store relative path of the
+	// object holding the body, which this file does not have.
+	Object string
+}
+
+// normalizeMessageID returns id in the "<local@domain>" form so MessageID and
+// InReplyTo values can be compared directly.
+func normalizeMessageID(id string) string {
+	id = strings.TrimSpace(id)
+	if len(id) == 0 {
+		return ""
+	}
+	id = strings.TrimSuffix(strings.TrimPrefix(id, "<"), ">")
+	return "<" + id + ">"
+}
+
+// parseReferences returns the normalized Message-IDs of a fetched References
+// header, which may be missing.
+func parseReferences(r io.Reader) []string {
+	if r == nil {
+		return nil
+	}
+	m, err := mail.ReadMessage(bufio.NewReader(r))
+	if err != nil {
+		return nil
+	}
+	fields := strings.FieldsFunc(m.Header.Get("References"), func(r rune) bool {
+		return r == ',' || unicode.IsSpace(r)
+	})
+	if len(fields) == 0 {
+		return nil
+	}
+	refs := make([]string, 0, len(fields))
+	for _, f := range fields {
+		refs = append(refs, normalizeMessageID(f))
+	}
+	return refs
+}
+
+// keyID returns the value hashed into a message's stored name. Messages
+// without a Message-ID would all hash to the same name, so they fall back to
+// their folder, UID, date and subject instead. The leading NUL keeps the
+// fallback from colliding with any real Message-ID.
+func keyID(folder string, msg *imap.Message) string {
+	if len(msg.Envelope.MessageId) > 0 {
+		return msg.Envelope.MessageId
+	}
+	return fmt.Sprintf("\x00%s\x00%d\x00%s\x00%s", folder, msg.Uid, msg.Envelope.Date.Format(time.RFC3339Nano), msg.Envelope.Subject)
 }
 
 func fn(xof blake2b.XOF, key []byte, msgID string) (string, error) {
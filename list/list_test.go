@@ -0,0 +1,586 @@
+package list
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/client"
+)
+
+func TestOnlyNewFoldersUTF8(t *testing.T) {
+	addr := testServer(t)
+	testAppend(t, addr, "Größe", 2)
+	p := newUTF8Proxy(t, addr)
+	w := testWorker(t, WithIncremental(true), WithOnlyNewFolders(true))
+	run := func() RunSummary {
+		t.Helper()
+		sum, err := w.List(context.Background(), p.addr, "username", "password")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(sum.Errors) > 0 {
+			t.Fatal(sum.Errors)
+		}
+		return sum
+	}
+	if sum := run(); sum.Folders != 2 {
+		t.Fatalf("first run processed %d folders, want 2", sum.Folders)
+	}
+	if sum := run(); sum.Folders != 0 {
+		t.Fatalf("unchanged run processed %d folders, want 0", sum.Folders)
+	}
+	testAppend(t, addr, "Größe", 1)
+	if sum := run(); sum.Folders != 1 || sum.Fetched != 1 {
+		t.Fatalf("after a new message: %d folders, %d fetched, want 1 and 1", sum.Folders, sum.Fetched)
+	}
+}
+
+func TestUIDValidityChangedUTF8(t *testing.T) {
+	ctx := context.Background()
+	addr := testServer(t)
+	testAppend(t, addr, "日本語", 1)
+	p := newUTF8Proxy(t, addr)
+	w := testWorker(t)
+	c, err := w.connect(ctx, p.addr, "username", "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Logout()
+	w.enableUTF8(c)
+	if !w.utf8Conn(c) {
+		t.Fatalf("%s not enabled", utf8Accept)
+	}
+	status, err := c.Select("日本語", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ka := w.startKeepalive(c)
+	defer ka.stop()
+
+	if _, err := w.uidValidityChanged(ctx, ka, c, "日本語", status.UidValidity); err == nil {
+		t.Fatal("no error without a connection for STATUS")
+	}
+	w.statusDial = func(ctx context.Context) (*client.Client, error) {
+		return w.connect(ctx, p.addr, "username", "password")
+	}
+	defer w.closeStatusConn()
+	for _, tc := range []struct {
+		want    uint32
+		changed bool
+	}{
+		{status.UidValidity, false},
+		{status.UidValidity + 1, true},
+	} {
+		changed, err := w.uidValidityChanged(ctx, ka, c, "日本語", tc.want)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if changed != tc.changed {
+			t.Errorf("want %d: changed %t, expected %t", tc.want, changed, tc.changed)
+		}
+	}
+}
+
+// logoutCounter dials a test server and counts the LOGOUT commands sent on
+// each connection.
+type logoutCounter struct {
+	addr  string
+	mu    sync.Mutex
+	conns []*int32
+}
+
+func (lc *logoutCounter) dial(ctx context.Context, _ string) (*client.Client, error) {
+	conn, err := net.Dial("tcp", lc.addr)
+	if err != nil {
+		return nil, err
+	}
+	n := new(int32)
+	lc.mu.Lock()
+	lc.conns = append(lc.conns, n)
+	lc.mu.Unlock()
+	return client.New(logoutConn{Conn: conn, n: n})
+}
+
+// check fails unless every connection sent LOGOUT exactly once. With
+// aborted, a connection closed to stop a fetch may have sent none.
+func (lc *logoutCounter) check(t *testing.T, aborted bool) {
+	t.Helper()
+	lc.mu.Lock()
+	defer lc.mu.Unlock()
+	if len(lc.conns) == 0 {
+		t.Fatal("no connection made")
+	}
+	for i, n := range lc.conns {
+		if got := atomic.LoadInt32(n); got != 1 && !(aborted && got == 0) {
+			t.Errorf("connection %d sent LOGOUT %d times", i, got)
+		}
+	}
+}
+
+type logoutConn struct {
+	net.Conn
+	n *int32
+}
+
+func (c logoutConn) Write(b []byte) (int, error) {
+	if bytes.HasSuffix(b, []byte(" LOGOUT\r\n")) {
+		atomic.AddInt32(c.n, 1)
+	}
+	return c.Conn.Write(b)
+}
+
+func TestLogoutOnce(t *testing.T) {
+	addr := testServer(t)
+	testAppend(t, addr, "Archive", 3)
+	for _, tc := range []struct {
+		name    string
+		opts    []Option
+		cancel  bool
+		wantErr bool
+	}{
+		{name: "success"},
+		{name: "parallel", opts: []Option{WithConcurrency(2)}},
+		{name: "error", opts: []Option{WithFolders(nil, []string{"["})}, wantErr: true},
+		{name: "cancel", cancel: true, wantErr: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			lc := &logoutCounter{addr: addr}
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			w := testWorker(t, append(tc.opts, WithDial(lc.dial))...)
+			if tc.cancel {
+				w.OnFolder = func(string, int) { cancel() }
+			}
+			_, err := w.List(ctx, addr, "username", "password")
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("err %v, want error %t", err, tc.wantErr)
+			}
+			lc.check(t, tc.cancel)
+		})
+	}
+	t.Run("check", func(t *testing.T) {
+		lc := &logoutCounter{addr: addr}
+		if err := testWorker(t, WithDial(lc.dial)).Check(context.Background(), addr, "username", "password"); err != nil {
+			t.Fatal(err)
+		}
+		lc.check(t, false)
+	})
+}
+
+// failWriter fails every write after the first n.
+type failWriter struct{ n int }
+
+func (fw *failWriter) Write(b []byte) (int, error) {
+	if fw.n <= 0 {
+		return 0, errors.New("sink full")
+	}
+	fw.n--
+	return len(b), nil
+}
+
+func TestFetchGoroutinesExit(t *testing.T) {
+	addr := testServer(t)
+	testAppend(t, addr, "INBOX", 30)
+	for _, tc := range []struct {
+		name   string
+		cancel bool
+		opts   []Option
+	}{
+		{name: "cancel", cancel: true},
+		{name: "write error", opts: []Option{WithSink(&failWriter{n: 3})}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			base := runtime.NumGoroutine()
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			w := testWorker(t, append(tc.opts, WithBatchSize(25))...)
+			if tc.cancel {
+				w.OnMessage = func(folder string, done, total int) {
+					if done == 2 {
+						cancel()
+					}
+				}
+			}
+			type result struct {
+				sum RunSummary
+				err error
+			}
+			done := make(chan result, 1)
+			go func() {
+				sum, err := w.List(ctx, addr, "username", "password")
+				done <- result{sum, err}
+			}()
+			var sum RunSummary
+			select {
+			case r := <-done:
+				sum = r.sum
+				if r.err == nil {
+					t.Fatal("run did not fail")
+				}
+			case <-time.After(10 * time.Second):
+				buf := make([]byte, 1<<20)
+				t.Fatalf("run blocked:\n%s", buf[:runtime.Stack(buf, true)])
+			}
+			if sum.Fetched >= 31 {
+				t.Fatalf("every message fetched, %d", sum.Fetched)
+			}
+			// Server side goroutines end once they see the logout.
+			deadline := time.Now().Add(5 * time.Second)
+			for runtime.NumGoroutine() > base && time.Now().Before(deadline) {
+				time.Sleep(10 * time.Millisecond)
+			}
+			if n := runtime.NumGoroutine(); n > base {
+				buf := make([]byte, 1<<20)
+				t.Fatalf("%d goroutines left running:\n%s", n-base, buf[:runtime.Stack(buf, true)])
+			}
+		})
+	}
+}
+
+// TestCancelAbortsFetch checks that a cancelled run stops the body fetch in
+// progress instead of reading the rest of its batch, and still marks what it
+// stored seen.
+func TestCancelAbortsFetch(t *testing.T) {
+	const n = 20
+	for _, tc := range []struct {
+		name string
+		opts []Option
+	}{
+		{"sequential", []Option{WithBatchSize(n)}},
+		{"parallel", []Option{WithBatchSize(n / 4), WithFetchConnections(2)}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			addr := testServer(t)
+			c := testConnect(t, addr)
+			c.Create("Big")
+			// About 4s of data at the rate below.
+			body := strings.Repeat("0123456789abcdef\r\n", 1<<12)
+			for i := 0; i < n; i++ {
+				msg := fmt.Sprintf("Message-Id: <%d@test>\r\nSubject: message %d\r\n\r\n%s", i, i, body)
+				if err := c.Append("Big", nil, time.Now(), sizedReader{Reader: strings.NewReader(msg), n: len(msg)}); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			opts := append(tc.opts, WithFolders([]string{"Big"}, nil), WithMaxBytesPerSec(400<<10), WithMarkSeen(true))
+			w := testWorker(t, opts...)
+			w.OnMessage = func(folder string, done, total int) {
+				cancel()
+			}
+			start := time.Now()
+			sum, err := w.List(ctx, addr, "username", "password")
+			if !errors.Is(err, context.Canceled) {
+				t.Fatalf("err %v, want cancelled", err)
+			}
+			if d := time.Since(start); d > 2*time.Second {
+				t.Errorf("run took %v after cancel", d)
+			}
+			if sum.Fetched == 0 || sum.Fetched >= n {
+				t.Fatalf("fetched %d of %d", sum.Fetched, n)
+			}
+
+			if _, err := c.Select("Big", true); err != nil {
+				t.Fatal(err)
+			}
+			seq, _ := imap.ParseSeqSet("1:*")
+			msgC := make(chan *imap.Message, n)
+			if err := c.Fetch(seq, []imap.FetchItem{imap.FetchFlags}, msgC); err != nil {
+				t.Fatal(err)
+			}
+			seen := 0
+			for msg := range msgC {
+				for _, f := range msg.Flags {
+					if f == imap.SeenFlag {
+						seen++
+					}
+				}
+			}
+			if seen != sum.Fetched {
+				t.Errorf("%d seen, want %d", seen, sum.Fetched)
+			}
+		})
+	}
+}
+
+func TestBatches(t *testing.T) {
+	const n = 3
+	uids := func(k int) []uint32 {
+		list := make([]uint32, k)
+		for i := range list {
+			list[i] = uint32(i + 1)
+		}
+		return list
+	}
+	for _, tc := range []struct {
+		messages int
+		sizes    []int
+	}{
+		{0, nil},
+		{1, []int{1}},
+		{n, []int{n}},
+		{n + 1, []int{n, 1}},
+		{2 * n, []int{n, n}},
+	} {
+		got := batches(uids(tc.messages), n)
+		var sizes []int
+		var next uint32 = 1
+		for _, b := range got {
+			sizes = append(sizes, len(b))
+			for _, uid := range b {
+				if uid != next {
+					t.Errorf("%d messages: uid %d, want %d", tc.messages, uid, next)
+				}
+				next++
+			}
+		}
+		if fmt.Sprint(sizes) != fmt.Sprint(tc.sizes) {
+			t.Errorf("%d messages: batches of %v, want %v", tc.messages, sizes, tc.sizes)
+		}
+	}
+}
+
+func TestListBatchBoundary(t *testing.T) {
+	const n = 3
+	addr := testServer(t)
+	// INBOX starts with one message, so it holds n+1.
+	testAppend(t, addr, "INBOX", n)
+	sum, err := testWorker(t, WithBatchSize(n)).List(context.Background(), addr, "username", "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sum.Fetched != n+1 {
+		t.Fatalf("fetched %d messages, want %d", sum.Fetched, n+1)
+	}
+}
+
+func TestOnMessageTotal(t *testing.T) {
+	const n = 7
+	addr := testServer(t)
+	testAppend(t, addr, "Archive", n)
+	w := testWorker(t, WithEnvelopeWindow(3), WithBatchSize(2))
+	var totals []int
+	w.OnMessage = func(folder string, done, total int) {
+		if folder == "Archive" {
+			totals = append(totals, total)
+		}
+	}
+	if _, err := w.List(context.Background(), addr, "username", "password"); err != nil {
+		t.Fatal(err)
+	}
+	if len(totals) != n {
+		t.Fatalf("%d calls, want %d", len(totals), n)
+	}
+	for i, total := range totals {
+		if total != n {
+			t.Errorf("call %d: total %d, want %d", i, total, n)
+		}
+	}
+}
+
+func TestDryRunMirrorLeavesStore(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		setup func(t *testing.T, addr string, w *Worker)
+	}{
+		{"empty folder", func(t *testing.T, addr string, w *Worker) {
+			testExpunge(t, addr, "Archive", "1:*")
+		}},
+		{"filtered folder", func(t *testing.T, addr string, w *Worker) {
+			testExpunge(t, addr, "Archive", "1")
+			w.Since = time.Now().AddDate(1, 0, 0)
+		}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			addr := testServer(t)
+			testAppend(t, addr, "Archive", 2)
+			opts := []Option{WithLayout(LayoutFolder), WithMirror(true), WithIncremental(true)}
+			w := testWorker(t, opts...)
+			if _, err := w.List(context.Background(), addr, "username", "password"); err != nil {
+				t.Fatal(err)
+			}
+
+			dw := New(w.Store, append(opts, WithTLSMode(TLSPlain), WithDryRun(true))...)
+			tc.setup(t, addr, dw)
+			before := treeSnapshot(t, w.Store)
+			sum, err := dw.List(context.Background(), addr, "username", "password")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if sum.Trashed != 0 {
+				t.Errorf("dry run trashed %d messages", sum.Trashed)
+			}
+			after := treeSnapshot(t, w.Store)
+			for path, was := range before {
+				if after[path] != was {
+					t.Errorf("%s changed: %q, was %q", path, after[path], was)
+				}
+			}
+			for path := range after {
+				if _, ok := before[path]; !ok {
+					t.Errorf("%s created", path)
+				}
+			}
+		})
+	}
+}
+
+// mirrorStore backs up Archive holding three messages with Mirror, and
+// returns the Worker and the stored key of each UID.
+func mirrorStore(t *testing.T, addr string, opts ...Option) (*Worker, map[uint32]string) {
+	t.Helper()
+	testAppend(t, addr, "Archive", 3)
+	w := testWorker(t, append([]Option{WithLayout(LayoutFolder), WithMirror(true)}, opts...)...)
+	if _, err := w.List(context.Background(), addr, "username", "password"); err != nil {
+		t.Fatal(err)
+	}
+	hs, _, err := w.readIndex()
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys := map[uint32]string{}
+	for _, h := range hs {
+		if h.Folder == "Archive" {
+			keys[h.UID] = h.Key
+		}
+	}
+	if len(keys) != 3 {
+		t.Fatalf("%d messages of Archive stored, want 3", len(keys))
+	}
+	return w, keys
+}
+
+// checkMirror fails unless the Archive directory holds the keys of the
+// UIDs kept, and the trash those of the UIDs trashed.
+func checkMirror(t *testing.T, w *Worker, keys map[uint32]string, kept, trashed []uint32) {
+	t.Helper()
+	dir := w.folderPath("Archive")
+	for _, want := range []struct {
+		dir  string
+		uids []uint32
+	}{
+		{dir, kept},
+		{filepath.Join(w.Store, trashDir, strings.TrimPrefix(dir, w.Store)), trashed},
+	} {
+		got := map[string]bool{}
+		list, err := os.ReadDir(want.dir)
+		if err != nil && !os.IsNotExist(err) {
+			t.Fatal(err)
+		}
+		for _, de := range list {
+			if de.Type().IsRegular() {
+				got[de.Name()] = true
+			}
+		}
+		for _, uid := range want.uids {
+			if !got[keys[uid]] {
+				t.Errorf("%s: uid %d missing", want.dir, uid)
+			}
+			delete(got, keys[uid])
+		}
+		for name := range got {
+			t.Errorf("%s: unexpected %s", want.dir, name)
+		}
+	}
+}
+
+func TestMirror(t *testing.T) {
+	ctx := context.Background()
+	t.Run("orphans", func(t *testing.T) {
+		addr := testServer(t)
+		w, keys := mirrorStore(t, addr)
+		testExpunge(t, addr, "Archive", "2")
+		sum, err := w.List(ctx, addr, "username", "password")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if sum.Trashed != 1 {
+			t.Errorf("trashed %d, want 1", sum.Trashed)
+		}
+		checkMirror(t, w, keys, []uint32{1, 3}, []uint32{2})
+	})
+	t.Run("uidvalidity changed", func(t *testing.T) {
+		addr := testServer(t)
+		w, keys := mirrorStore(t, addr, WithIncremental(true))
+		// The recorded state is of another numbering, with a LastUID that
+		// would hide every message were it trusted.
+		st, err := loadState(w.Store)
+		if err != nil {
+			t.Fatal(err)
+		}
+		st.setFolder("Archive", folderState{UIDValidity: 99, LastUID: 100})
+		if err := st.save(w.Store, w.fileMode()); err != nil {
+			t.Fatal(err)
+		}
+		testExpunge(t, addr, "Archive", "1")
+		if _, err := w.List(ctx, addr, "username", "password"); err != nil {
+			t.Fatal(err)
+		}
+		checkMirror(t, w, keys, []uint32{2, 3}, []uint32{1})
+	})
+	t.Run("filtered", func(t *testing.T) {
+		addr := testServer(t)
+		w, keys := mirrorStore(t, addr)
+		testExpunge(t, addr, "Archive", "3")
+		// No message passes the filter, yet only the expunged one goes.
+		w.Since = time.Now().AddDate(1, 0, 0)
+		if _, err := w.List(ctx, addr, "username", "password"); err != nil {
+			t.Fatal(err)
+		}
+		checkMirror(t, w, keys, []uint32{1, 2}, []uint32{3})
+	})
+	t.Run("failed", func(t *testing.T) {
+		addr := testServer(t)
+		w, keys := mirrorStore(t, addr)
+		testExpunge(t, addr, "Archive", "1")
+		testAppend(t, addr, "Archive", 2)
+		cctx, cancel := context.WithCancel(ctx)
+		defer cancel()
+		w.OnMessage = func(folder string, done, total int) {
+			if folder == "Archive" {
+				cancel()
+			}
+		}
+		if _, err := w.List(cctx, addr, "username", "password"); err == nil {
+			t.Fatal("run did not fail")
+		}
+		checkMirrorKept(t, w, keys)
+	})
+	t.Run("folder gone", func(t *testing.T) {
+		addr := testServer(t)
+		w, keys := mirrorStore(t, addr)
+		if err := testConnect(t, addr).Delete("Archive"); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := w.List(ctx, addr, "username", "password"); err != nil {
+			t.Fatal(err)
+		}
+		checkMirror(t, w, keys, []uint32{1, 2, 3}, nil)
+	})
+}
+
+// checkMirrorKept fails if a stored message of Archive was trashed.
+func checkMirrorKept(t *testing.T, w *Worker, keys map[uint32]string) {
+	t.Helper()
+	for uid, key := range keys {
+		if _, err := os.Stat(filepath.Join(w.folderPath("Archive"), key)); err != nil {
+			t.Errorf("uid %d: %v", uid, err)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(w.Store, trashDir)); !os.IsNotExist(err) {
+		t.Errorf("trash created: %v", err)
+	}
+}
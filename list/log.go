@@ -0,0 +1,104 @@
+package list
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"time"
+)
+
+// Log formats for Worker.LogFormat.
+const (
+	LogText = "text"
+	LogJSON = "json"
+)
+
+// Logger receives text log lines. Folders processed in parallel log from
+// several goroutines, so it must be safe for concurrent use.
+type Logger interface {
+	Logf(format string, v ...interface{})
+}
+
+// StdLogger returns a Logger that writes to l, or to the standard logger if
+// l is nil.
+func StdLogger(l *log.Logger) Logger {
+	if l == nil {
+		l = log.Default()
+	}
+	return stdLogger{l: l}
+}
+
+type stdLogger struct {
+	l *log.Logger
+}
+
+func (s stdLogger) Logf(f string, v ...interface{}) {
+	s.l.Printf(f, v...)
+}
+
+// logEvent is one JSON log record.
+type logEvent struct {
+	Time     time.Time `json:"time"`
+	Event    string    `json:"event"`
+	Folder   string    `json:"folder,omitempty"`
+	Count    int       `json:"count,omitempty"`
+	Bytes    int64     `json:"bytes,omitempty"`
+	Duration float64   `json:"duration,omitempty"` // Seconds.
+	Error    string    `json:"error,omitempty"`
+	Message  string    `json:"message,omitempty"`
+}
+
+func (w *Worker) log(f string, v ...interface{}) {
+	if !w.Verbose {
+		return
+	}
+	w.print(f, v...)
+}
+
+// print logs regardless of Verbose.
+func (w *Worker) print(f string, v ...interface{}) {
+	if w.LogFormat == LogJSON {
+		w.emit(logEvent{Event: "log", Message: strings.TrimSpace(fmt.Sprintf(f, v...))})
+		return
+	}
+	l := w.Logger
+	if l == nil {
+		l = StdLogger(nil)
+	}
+	l.Logf(f, v...)
+}
+
+// event records a structured event. Text logs already describe these in
+// prose, so events are only written in JSON format. Errors are always
+// written, other events only when Verbose.
+func (w *Worker) event(e logEvent) {
+	if w.LogFormat != LogJSON {
+		return
+	}
+	if !w.Verbose && len(e.Error) == 0 {
+		return
+	}
+	w.emit(e)
+}
+
+func (w *Worker) emit(e logEvent) {
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	b, err := json.Marshal(e)
+	if err != nil {
+		return
+	}
+	b = append(b, '\n')
+
+	var out io.Writer = os.Stderr
+	if w.LogOutput != nil {
+		out = w.LogOutput
+	}
+	w.logMu.Lock()
+	defer w.logMu.Unlock()
+	out.Write(b)
+}
@@ -0,0 +1,121 @@
+package list
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/emersion/go-imap"
+)
+
+var maildirFlags = map[string]byte{
+	imap.DraftFlag:    'D',
+	imap.FlaggedFlag:  'F',
+	imap.AnsweredFlag: 'R',
+	imap.SeenFlag:     'S',
+	imap.DeletedFlag:  'T',
+}
+
+var maildirSeq uint64
+
+// maildirKeys returns the message keys already delivered to a maildir. The
+// key is stored as the unique part of each file name.
+func maildirKeys(dir string) (map[string]bool, error) {
+	keys := map[string]bool{}
+	for _, sub := range []string{"cur", "new"} {
+		list, err := os.ReadDir(filepath.Join(dir, sub))
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		for _, de := range list {
+			if k, ok := maildirKey(de.Name()); ok {
+				keys[k] = true
+			}
+		}
+	}
+	return keys, nil
+}
+
+func maildirKey(filename string) (string, bool) {
+	if i := strings.IndexByte(filename, ':'); i >= 0 {
+		filename = filename[:i]
+	}
+	parts := strings.Split(filename, ".")
+	if len(parts) < 3 {
+		return "", false
+	}
+	return parts[1], true
+}
+
+// maildirName returns "<time>.<key>.<host>:2,<flags>".
+func maildirName(key string, date time.Time, flags []string) string {
+	host, err := os.Hostname()
+	if err != nil || len(host) == 0 {
+		host = "localhost"
+	}
+	host = strings.NewReplacer("/", `\057`, ":", `\072`, ".", "_").Replace(host)
+
+	info := make([]byte, 0, len(flags))
+	for _, f := range flags {
+		if b, ok := maildirFlags[imap.CanonicalFlag(f)]; ok {
+			info = append(info, b)
+		}
+	}
+	sort.Slice(info, func(i, j int) bool { return info[i] < info[j] })
+
+	return strconv.FormatInt(date.Unix(), 10) + "." + key + "." + host + ":2," + string(info)
+}
+
+// writeMaildir delivers body into dir/tmp and then moves it into dir/cur.
+func (w *Worker) writeMaildir(dir string, h *Header, msg *imap.Message, body io.Reader) error {
+	for _, sub := range []string{"cur", "new", "tmp"} {
+		if err := w.mkdirAll(filepath.Join(dir, sub)); err != nil {
+			return err
+		}
+	}
+	date := messageDate(msg)
+	if date.IsZero() {
+		date = time.Now()
+	}
+	name := maildirName(h.Key, date, msg.Flags)
+
+	tmpName := filepath.Join(dir, "tmp", fmt.Sprintf("%s.%d", h.Key, atomic.AddUint64(&maildirSeq, 1)))
+	f, err := w.openFile(tmpName, os.O_CREATE|os.O_EXCL|os.O_WRONLY)
+	if err != nil {
+		return err
+	}
+	n, err := io.Copy(f, body)
+	if err != nil {
+		f.Close()
+		os.Remove(tmpName)
+		return fmt.Errorf("body copy: %w", err)
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		os.Remove(tmpName)
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(tmpName)
+		return err
+	}
+	h.Size = strconv.FormatInt(n, 10)
+	if err := w.setModTime(tmpName, h.Key, messageDate(msg)); err != nil {
+		os.Remove(tmpName)
+		return err
+	}
+	if err := os.Rename(tmpName, filepath.Join(dir, "cur", name)); err != nil {
+		os.Remove(tmpName)
+		return err
+	}
+	return nil
+}
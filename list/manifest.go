@@ -0,0 +1,68 @@
+package list
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// manifestFile lists every stored message as CSV for review in a
+// spreadsheet.
+const manifestFile = "manifest.csv"
+
+// Manifest writes Store/manifest.csv with a row for every stored message,
+// from the index when present. Rows are sorted by folder, then date.
+func (w *Worker) Manifest(ctx context.Context) error {
+	if err := w.checkModes(); err != nil {
+		return err
+	}
+	hs, err := w.Search(ctx, SearchQuery{})
+	if err != nil {
+		return fmt.Errorf("manifest: %w", err)
+	}
+	sort.SliceStable(hs, func(i, j int) bool {
+		a, b := hs[i], hs[j]
+		if a.Folder != b.Folder {
+			return a.Folder < b.Folder
+		}
+		if a.Date != b.Date {
+			return a.Date < b.Date
+		}
+		return a.Key < b.Key
+	})
+
+	f, err := os.CreateTemp(w.Store, "."+manifestFile+".*.tmp")
+	if err != nil {
+		return err
+	}
+	tmpName := f.Name()
+	defer os.Remove(tmpName)
+	if err := f.Chmod(w.fileMode()); err != nil {
+		f.Close()
+		return err
+	}
+
+	cw := csv.NewWriter(f)
+	cw.UseCRLF = true
+	cw.Write([]string{"Key", "Folder", "Date", "From", "Subject", "Size", "Hash", "HashAlgo"})
+	for _, h := range hs {
+		cw.Write([]string{h.Key, h.Folder, h.Date, h.From, h.Subject, h.Size, hex.EncodeToString(h.Hash), h.HashAlgo})
+	}
+	cw.Flush()
+	if err := cw.Error(); err != nil {
+		f.Close()
+		return fmt.Errorf("manifest: %w", err)
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmpName, filepath.Join(w.Store, manifestFile)); err != nil {
+		return err
+	}
+	w.log("manifest lists %d messages", len(hs))
+	return nil
+}
@@ -0,0 +1,158 @@
+package list
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/emersion/go-imap"
+)
+
+// mboxKeyHeader is added to each message appended to an mbox so later runs
+// can tell which messages the file already holds.
+const mboxKeyHeader = "X-Imapdown-Key: "
+
+func mboxPath(dir, folder string) string {
+	return filepath.Join(dir, folderDir(folder)+".mbox")
+}
+
+// mboxKeys scans an mbox file for the keys of the messages it contains.
+func mboxKeys(fn string) (map[string]bool, error) {
+	keys := map[string]bool{}
+	f, err := os.Open(fn)
+	if os.IsNotExist(err) {
+		return keys, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	prefix := []byte(mboxKeyHeader)
+	r := bufio.NewReader(f)
+	for {
+		line, err := r.ReadSlice('\n')
+		if bytes.HasPrefix(line, prefix) {
+			keys[string(bytes.TrimSpace(line[len(prefix):]))] = true
+		}
+		switch err {
+		case nil, bufio.ErrBufferFull:
+			continue
+		case io.EOF:
+			return keys, nil
+		default:
+			return nil, err
+		}
+	}
+}
+
+// mboxStatus returns the Status and X-Status header values for flags.
+func mboxStatus(flags []string) (status, xstatus string) {
+	status = "O"
+	for _, f := range flags {
+		switch imap.CanonicalFlag(f) {
+		case imap.SeenFlag:
+			status = "RO"
+		case imap.AnsweredFlag:
+			xstatus += "A"
+		case imap.FlaggedFlag:
+			xstatus += "F"
+		case imap.DraftFlag:
+			xstatus += "T"
+		case imap.DeletedFlag:
+			xstatus += "D"
+		}
+	}
+	return status, xstatus
+}
+
+// writeMbox appends the message to the folder's mbox file using mboxrd
+// "From " quoting. Line endings are converted to LF. A failed append is
+// truncated away so the file never ends in a partial message.
+func (w *Worker) writeMbox(dir string, h *Header, msg *imap.Message, body io.Reader) error {
+	f, err := w.openFile(mboxPath(dir, h.Folder), os.O_CREATE|os.O_WRONLY)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	start, err := f.Seek(0, io.SeekEnd)
+	if err != nil {
+		return err
+	}
+
+	err = writeMboxMessage(f, h, msg, body)
+	if err == nil {
+		err = f.Sync()
+	}
+	if err != nil {
+		f.Truncate(start)
+		return err
+	}
+	return f.Close()
+}
+
+func writeMboxMessage(f io.Writer, h *Header, msg *imap.Message, body io.Reader) error {
+	sender := "MAILER-DAEMON"
+	if len(msg.Envelope.From) > 0 {
+		a := msg.Envelope.From[0]
+		sender = a.MailboxName + "@" + a.HostName
+	}
+	date := messageDate(msg)
+	if date.IsZero() {
+		date = time.Now()
+	}
+	status, xstatus := mboxStatus(msg.Flags)
+
+	bw := bufio.NewWriter(f)
+	fmt.Fprintf(bw, "From %s %s\n", sender, date.UTC().Format(time.ANSIC))
+	bw.WriteString(mboxKeyHeader + h.Key + "\n")
+	bw.WriteString("Status: " + status + "\n")
+	if len(xstatus) > 0 {
+		bw.WriteString("X-Status: " + xstatus + "\n")
+	}
+
+	var n int64
+	r := bufio.NewReader(body)
+	last := byte('\n')
+	for {
+		line, err := r.ReadSlice('\n')
+		n += int64(len(line))
+		if len(line) > 0 {
+			// Only quote at the start of a line, not after a long line was
+			// split by the buffer.
+			if last == '\n' && isFromLine(line) {
+				bw.WriteByte('>')
+			}
+			last = line[len(line)-1]
+			if bytes.HasSuffix(line, []byte("\r\n")) {
+				line = append(line[:len(line)-2], '\n')
+			}
+			bw.Write(line)
+		}
+		if err == bufio.ErrBufferFull {
+			continue
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("body copy: %w", err)
+		}
+	}
+	if last != '\n' {
+		bw.WriteByte('\n')
+	}
+	bw.WriteByte('\n')
+	h.Size = strconv.FormatInt(n, 10)
+	return bw.Flush()
+}
+
+// isFromLine reports whether line matches ^>*From and must be quoted.
+func isFromLine(line []byte) bool {
+	return bytes.HasPrefix(bytes.TrimLeft(line, ">"), []byte("From "))
+}
@@ -0,0 +1,245 @@
+package list
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+// A native message file starts with formatMagic, then the length in bytes
+// of the JSON header on its own line, the header, and the raw message.
+// Files written before the magic was added hold the header on one line
+// followed by legacySep; both are read.
+var (
+	formatMagic = []byte("IMAPDOWN/1\n")
+	legacySep   = []byte("---\n")
+)
+
+// maxHeaderLen bounds the header length read from a file.
+const maxHeaderLen = 64 << 20
+
+// writeHeader writes the magic line and length prefixed header of a native
+// message file.
+func writeHeader(out io.Writer, h *Header) error {
+	buf := &bytes.Buffer{}
+	e := json.NewEncoder(buf)
+	e.SetEscapeHTML(false)
+	if err := e.Encode(h); err != nil {
+		return fmt.Errorf("marshal header: %w", err)
+	}
+	if _, err := out.Write(formatMagic); err != nil {
+		return err
+	}
+	if _, err := fmt.Fprintf(out, "%d\n", buf.Len()); err != nil {
+		return err
+	}
+	_, err := out.Write(buf.Bytes())
+	return err
+}
+
+// readHeader reads the header of a native message file, leaving r at the
+// start of the body.
+func readHeader(r *bufio.Reader) (Header, error) {
+	h := Header{}
+	magic, err := r.Peek(len(formatMagic))
+	if err != nil && err != io.EOF {
+		return h, fmt.Errorf("read header: %w", err)
+	}
+	if !bytes.Equal(magic, formatMagic) {
+		return readLegacyHeader(r)
+	}
+	r.Discard(len(formatMagic))
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return h, fmt.Errorf("read header length: %w", err)
+	}
+	n, err := strconv.Atoi(line[:len(line)-1])
+	if err != nil || n < 0 || n > maxHeaderLen {
+		return h, fmt.Errorf("invalid header length %q", line[:len(line)-1])
+	}
+	b := make([]byte, n)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return h, fmt.Errorf("read header: %w", err)
+	}
+	if err := json.Unmarshal(b, &h); err != nil {
+		return h, fmt.Errorf("parse header: %w", err)
+	}
+	return h, nil
+}
+
+func readLegacyHeader(r *bufio.Reader) (Header, error) {
+	h := Header{}
+	line, err := r.ReadBytes('\n')
+	if err != nil {
+		return h, fmt.Errorf("read header: %w", err)
+	}
+	if err := json.Unmarshal(line, &h); err != nil {
+		return h, fmt.Errorf("parse header: %w", err)
+	}
+	sep := make([]byte, len(legacySep))
+	if _, err := io.ReadFull(r, sep); err != nil {
+		return h, fmt.Errorf("read separator: %w", err)
+	}
+	if !bytes.Equal(sep, legacySep) {
+		return h, fmt.Errorf("missing header separator")
+	}
+	return h, nil
+}
+
+// ReadMessage parses a native message file, which may be gzip compressed,
+// returning its header and a reader of the raw message.
+func ReadMessage(r io.Reader) (Header, io.Reader, error) {
+	br := bufio.NewReader(r)
+	if b, _ := br.Peek(2); len(b) == 2 && b[0] == 0x1f && b[1] == 0x8b {
+		gz, err := gzip.NewReader(br)
+		if err != nil {
+			return Header{}, nil, fmt.Errorf("gzip: %w", err)
+		}
+		br = bufio.NewReader(gz)
+	}
+	h, err := readHeader(br)
+	if err != nil {
+		return h, nil, err
+	}
+	return h, br, nil
+}
+
+// StoredMessage is a native message file opened by Open.
+type StoredMessage struct {
+	Path   string
+	Header Header
+	// Body reads the raw message, from the object Header.Object or the file
+	// Header.DuplicateOf names if set. It is empty when Header.Skipped is
+	// set.
+	Body io.ReadCloser
+}
+
+type storedBody struct {
+	io.Reader
+	io.Closer
+}
+
+// Open opens the native message file at path, which may be gzip
+// compressed. The caller must close Body. Encrypted files are opened with
+// Worker.Open.
+//
+// The body of a duplicate is read from the file its DuplicateOf names,
+// which is relative to the store: the directory of path or, in the folder
+// layout, its parent.
+func Open(path string) (*StoredMessage, error) {
+	w := &Worker{}
+	return w.Open(path)
+}
+
+// Open is the package Open, decrypting files with Identity. A duplicate's
+// DuplicateOf is looked up in Store if set.
+func (w *Worker) Open(path string) (*StoredMessage, error) {
+	f, err := w.openStored(path)
+	if err != nil {
+		return nil, err
+	}
+	br := bufio.NewReader(f)
+	h, err := readHeader(br)
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	m := &StoredMessage{Path: path, Header: h, Body: storedBody{Reader: br, Closer: f}}
+	if len(h.Object) > 0 {
+		f.Close()
+		body, err := w.openObject(path, h.Object)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		m.Body = body
+		return m, nil
+	}
+	if len(h.DuplicateOf) == 0 {
+		return m, nil
+	}
+	f.Close()
+	orig, err := duplicatePath(w.Store, path, h.DuplicateOf)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	of, err := w.openStored(orig)
+	if err != nil {
+		return nil, err
+	}
+	obr := bufio.NewReader(of)
+	if _, err := readHeader(obr); err != nil {
+		of.Close()
+		return nil, fmt.Errorf("%s: %w", orig, err)
+	}
+	m.Body = storedBody{Reader: obr, Closer: of}
+	return m, nil
+}
+
+// duplicatePath returns the path of the file holding the body of a
+// duplicate, named by rel within store or, once Mirror trashed it, within
+// the trash. Without a store the directory of path and its parent are
+// tried.
+func duplicatePath(store, path, rel string) (string, error) {
+	p, err := storePath(store, path, rel)
+	if err != nil {
+		return "", fmt.Errorf("duplicate of %s: %w", rel, err)
+	}
+	return p, nil
+}
+
+// storePath is duplicatePath for any store relative path.
+func storePath(store, path, rel string) (string, error) {
+	roots := []string{store}
+	if len(store) == 0 {
+		dir := filepath.Dir(path)
+		roots = []string{dir, filepath.Dir(dir)}
+	}
+	for _, root := range roots {
+		for _, p := range []string{
+			filepath.Join(root, filepath.FromSlash(rel)),
+			filepath.Join(root, trashDir, filepath.FromSlash(rel)),
+		} {
+			if _, err := os.Stat(p); err == nil {
+				return p, nil
+			}
+		}
+	}
+	return "", os.ErrNotExist
+}
+
+// readStoredHeader reads only the header of the native message file at
+// path.
+func (w *Worker) readStoredHeader(path string) (Header, error) {
+	f, err := w.openStored(path)
+	if err != nil {
+		return Header{}, err
+	}
+	defer f.Close()
+	h, err := readHeader(bufio.NewReader(f))
+	if err != nil {
+		return h, fmt.Errorf("%s: %w", path, err)
+	}
+	return h, nil
+}
+
+// Walk calls fn with every message file in the native store directory,
+// skipping the files the store keeps for itself. Body is closed when fn
+// returns. Walk stops at the first error.
+func Walk(store string, fn func(m *StoredMessage) error) error {
+	w := &Worker{Store: store}
+	return w.walkStore(context.Background(), func(path string) error {
+		m, err := w.Open(path)
+		if err != nil {
+			return err
+		}
+		defer m.Body.Close()
+		return fn(m)
+	})
+}
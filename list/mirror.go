@@ -0,0 +1,152 @@
+package list
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/client"
+	"golang.org/x/crypto/blake2b"
+)
+
+// trashDir holds files pruned by Mirror, under the store root. Files keep
+// their path relative to the store.
+const trashDir = ".trash"
+
+// checkMirror reports whether the store can tell which files belong to a
+// folder, which pruning needs.
+func (w *Worker) checkMirror() error {
+	if !w.Mirror {
+		return nil
+	}
+	switch {
+	case w.Format == FormatMbox:
+		return fmt.Errorf("mirror is not supported with the %s format", FormatMbox)
+	case w.Format != FormatMaildir && w.Layout != LayoutFolder:
+		return fmt.Errorf("mirror requires the %s layout", LayoutFolder)
+	}
+	return nil
+}
+
+// storedFiles returns the message files in a folder directory by key.
+func (w *Worker) storedFiles(dir string) (map[string][]string, error) {
+	files := map[string][]string{}
+	subs := []string{""}
+	if w.Format == FormatMaildir {
+		subs = []string{"cur", "new"}
+	}
+	for _, sub := range subs {
+		list, err := os.ReadDir(filepath.Join(dir, sub))
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		for _, de := range list {
+			name := de.Name()
+			if !de.Type().IsRegular() || strings.HasPrefix(name, ".") || strings.HasSuffix(name, ".tmp") {
+				continue
+			}
+			// The text of ExtractText goes with its message.
+			key, ok := storedKey(strings.TrimSuffix(name, textSuffix)), true
+			switch w.Format {
+			case FormatMaildir:
+				key, ok = maildirKey(name)
+			case FormatEML:
+				key, ok = emlKey(name)
+			}
+			if !ok {
+				continue
+			}
+			files[key] = append(files[key], filepath.Join(dir, sub, name))
+		}
+	}
+	return files, nil
+}
+
+// serverKeys returns the key of every message in the selected folder.
+func (w *Worker) serverKeys(c *client.Client, folder string, xof blake2b.XOF, key []byte) (map[string]bool, error) {
+	seqset, err := imap.ParseSeqSet("1:*")
+	if err != nil {
+		return nil, err
+	}
+	keys := map[string]bool{}
+	msgC := make(chan *imap.Message, 10)
+	fetchErr := make(chan error, 1)
+	go func() {
+		fetchErr <- c.Fetch(seqset, []imap.FetchItem{imap.FetchEnvelope, imap.FetchUid, imap.FetchInternalDate}, msgC)
+	}()
+	for msg := range msgC {
+		name, err := w.messageName(xof, key, folder, c.Mailbox().UidValidity, msg)
+		if err != nil {
+			drain(msgC)
+			return nil, err
+		}
+		keys[name] = true
+	}
+	if err := <-fetchErr; err != nil {
+		if isNoMessages(err) {
+			return keys, nil
+		}
+		return nil, fmt.Errorf("fetch: %w", err)
+	}
+	return keys, nil
+}
+
+// mirrorFolder moves files in dir whose key is not in present to the trash.
+// A nil present set means the folder listing was partial, so the keys are
+// fetched again in full.
+func (w *Worker) mirrorFolder(c *client.Client, dir, folder string, present map[string]bool, xof blake2b.XOF, key []byte) error {
+	if present == nil {
+		var err error
+		present, err = w.serverKeys(c, folder, xof, key)
+		if err != nil {
+			return err
+		}
+	}
+	files, err := w.storedFiles(dir)
+	if err != nil {
+		return err
+	}
+	trashed := 0
+	for k, paths := range files {
+		if present[k] {
+			continue
+		}
+		for _, p := range paths {
+			if err := w.trash(p); err != nil {
+				return err
+			}
+			trashed++
+		}
+	}
+	if trashed == 0 {
+		return nil
+	}
+	w.log("\ttrash %05d messages", trashed)
+	w.event(logEvent{Event: "folder_trash", Folder: folder, Count: trashed})
+	w.addSummary(func(s *RunSummary) {
+		s.Trashed += trashed
+	})
+	w.idxMu.Lock()
+	if w.idx != nil {
+		w.idxStale = true
+	}
+	w.idxMu.Unlock()
+	return nil
+}
+
+func (w *Worker) trash(path string) error {
+	rel, err := filepath.Rel(w.Store, path)
+	if err != nil {
+		return err
+	}
+	dst := filepath.Join(w.Store, trashDir, rel)
+	if err := w.mkdirAll(filepath.Dir(dst)); err != nil {
+		return err
+	}
+	return os.Rename(path, dst)
+}
@@ -0,0 +1,113 @@
+package list
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// Modes of the files and directories in the store when FileMode and DirMode
+// are unset.
+const (
+	defaultFileMode os.FileMode = 0600
+	defaultDirMode  os.FileMode = 0700
+)
+
+func (w *Worker) fileMode() os.FileMode {
+	if w.FileMode == 0 {
+		return defaultFileMode
+	}
+	return w.FileMode
+}
+
+func (w *Worker) dirMode() os.FileMode {
+	if w.DirMode == 0 {
+		return defaultDirMode
+	}
+	return w.DirMode
+}
+
+// checkModes rejects modes with bits other than permissions, that would lock
+// the owner out of the store, or that let anyone write to it without
+// AllowWorldWritable.
+func (w *Worker) checkModes() error {
+	for _, m := range []struct {
+		name  string
+		mode  os.FileMode
+		owner os.FileMode
+	}{
+		{"file", w.fileMode(), 0600},
+		{"directory", w.dirMode(), 0700},
+	} {
+		switch {
+		case m.mode&^os.ModePerm != 0:
+			return fmt.Errorf("%s mode %v: only permission bits may be set", m.name, m.mode)
+		case m.mode&m.owner != m.owner:
+			return fmt.Errorf("%s mode %#o: the owner needs %#o", m.name, m.mode, m.owner)
+		case m.mode&0002 != 0 && !w.AllowWorldWritable:
+			return fmt.Errorf("%s mode %#o is world-writable; set AllowWorldWritable to use it", m.name, m.mode)
+		}
+	}
+	return nil
+}
+
+// mkdirAll creates dir and any missing parents with DirMode. Directories
+// that already exist are left alone.
+func (w *Worker) mkdirAll(dir string) error {
+	return mkdirAllMode(dir, w.dirMode())
+}
+
+// mkdirAllMode is mkdirAll with the given mode.
+func mkdirAllMode(dir string, mode os.FileMode) error {
+	var missing []string
+	for p := dir; ; p = filepath.Dir(p) {
+		if _, err := os.Stat(p); !errors.Is(err, os.ErrNotExist) {
+			break
+		}
+		missing = append(missing, p)
+		if filepath.Dir(p) == p {
+			break
+		}
+	}
+	if len(missing) == 0 {
+		return nil
+	}
+	if err := os.MkdirAll(dir, mode); err != nil {
+		return err
+	}
+	// MkdirAll applies the umask; set the mode as given.
+	for _, p := range missing {
+		if err := os.Chmod(p, mode); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// openFile opens name with flag, creating it with FileMode if flag has
+// os.O_CREATE.
+func (w *Worker) openFile(name string, flag int) (*os.File, error) {
+	_, err := os.Stat(name)
+	created := errors.Is(err, os.ErrNotExist)
+	f, err := os.OpenFile(name, flag, w.fileMode())
+	if err != nil {
+		return nil, err
+	}
+	if created && flag&os.O_CREATE != 0 {
+		if err := f.Chmod(w.fileMode()); err != nil {
+			f.Close()
+			return nil, err
+		}
+	}
+	return f, nil
+}
+
+// writeFile is os.WriteFile, setting mode as given rather than masked by
+// the umask.
+func writeFile(name string, b []byte, mode os.FileMode) error {
+	if err := os.WriteFile(name, b, mode); err != nil {
+		return err
+	}
+	return os.Chmod(name, mode)
+}
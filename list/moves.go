@@ -0,0 +1,97 @@
+package list
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"github.com/emersion/go-imap"
+)
+
+// checkMoves reports whether the store can find messages by Message-ID
+// across folders, which DetectMoves needs.
+func (w *Worker) checkMoves() error {
+	if !w.DetectMoves {
+		return nil
+	}
+	if len(w.Format) > 0 && w.Format != FormatNative || w.Backend != nil {
+		return fmt.Errorf("detecting moves needs the %s format without a Backend", FormatNative)
+	}
+	return nil
+}
+
+// movedFrom returns the header and file of the same message stored for
+// another folder, matched by Message-ID and size. A file Mirror moved to
+// the trash during the run, as happens when the message left that folder,
+// is used from there.
+func (w *Worker) movedFrom(folder string, msg *imap.Message) (Header, string, error) {
+	id := normalizeMessageID(msg.Envelope.MessageId)
+	if len(id) == 0 {
+		return Header{}, "", nil
+	}
+	size := strconv.FormatUint(uint64(msg.Size), 10)
+	var list []Header
+	w.idxMu.Lock()
+	for _, h := range w.idxByID[id] {
+		if h.Folder != folder && h.Size == size {
+			list = append(list, h)
+		}
+	}
+	w.idxMu.Unlock()
+	for i := range list {
+		h := &list[i]
+		path, err := w.storedPath(h)
+		if err == nil {
+			return *h, path, nil
+		}
+		if !errors.Is(err, os.ErrNotExist) {
+			return Header{}, "", err
+		}
+		rel, err := filepath.Rel(w.Store, w.folderPath(h.Folder))
+		if err != nil {
+			return Header{}, "", err
+		}
+		for _, name := range storedNames(h.Key) {
+			p := filepath.Join(w.Store, trashDir, rel, name)
+			if _, err := os.Stat(p); err == nil {
+				return *h, p, nil
+			}
+		}
+	}
+	return Header{}, "", nil
+}
+
+// relocate stores a message new to folder from the copy already stored for
+// another folder, so its body is not downloaded again. It reports false if
+// there is no such copy.
+//
+// In the flat layout every folder shares one file, so nothing is copied;
+// updateFolders records the new folder instead.
+func (w *Worker) relocate(dir, folder, key string, uidValidity uint32, msg *imap.Message) (bool, error) {
+	src, path, err := w.movedFrom(folder, msg)
+	if err != nil || len(path) == 0 {
+		return false, err
+	}
+	if err := w.mkdirAll(dir); err != nil {
+		return false, fmt.Errorf("store dir: %w", err)
+	}
+	dst := filepath.Join(dir, key+storedSuffix(path))
+	var h Header
+	_, err = w.rewriteFile(path, dst, false, func(sh *Header) bool {
+		sh.Key = key
+		sh.Folder = folder
+		sh.Folders = nil
+		sh.SpecialUse = w.specialUse(folder)
+		sh.UIDValidity = uidValidity
+		sh.UID = msg.Uid
+		h = *sh
+		return true
+	})
+	if err != nil {
+		return false, fmt.Errorf("copy %s: %w", path, err)
+	}
+	w.log("\t%s: moved from %s", key, src.Folder)
+	return true, w.appendIndex(&h)
+}
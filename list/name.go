@@ -0,0 +1,115 @@
+package list
+
+import (
+	"encoding/base32"
+	"fmt"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/emersion/go-imap"
+	"golang.org/x/crypto/blake2b"
+)
+
+// envelopeHeader returns the header fields known from a message envelope.
+func envelopeHeader(folder string, msg *imap.Message) Header {
+	from := ""
+	if len(msg.Envelope.From) > 0 {
+		f := msg.Envelope.From[0]
+		if name := decodeWords(f.PersonalName); len(name) > 0 {
+			from = fmt.Sprintf("%s <%s@%s>", name, f.MailboxName, f.HostName)
+		} else {
+			from = fmt.Sprintf("<%s@%s>", f.MailboxName, f.HostName)
+		}
+	}
+	return Header{
+		MessageID: normalizeMessageID(msg.Envelope.MessageId),
+		InReplyTo: normalizeMessageID(msg.Envelope.InReplyTo),
+		Date:      formatDate(messageDate(msg)),
+		Folder:    folder,
+		Subject:   decodeWords(msg.Envelope.Subject),
+		From:      from,
+	}
+}
+
+// messageDate returns the Date header of msg, or the date the server received
+// it when the header is missing or unparseable. It is zero if neither is known.
+func messageDate(msg *imap.Message) time.Time {
+	if msg.Envelope != nil && !msg.Envelope.Date.IsZero() {
+		return msg.Envelope.Date
+	}
+	return msg.InternalDate
+}
+
+// formatDate formats a Header date, which is empty when unknown.
+func formatDate(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.Format(time.RFC3339Nano)
+}
+
+// messageName returns the stored name of msg, from NameFunc if set.
+// uidValidity is that of folder.
+func (w *Worker) messageName(xof blake2b.XOF, key []byte, folder string, uidValidity uint32, msg *imap.Message) (string, error) {
+	if w.NameFunc == nil {
+		return fn(xof, key, keyID(folder, msg))
+	}
+	h := envelopeHeader(folder, msg)
+	h.UIDValidity = uidValidity
+	h.UID = msg.Uid
+	name, err := w.NameFunc(h)
+	if err != nil {
+		return "", err
+	}
+	// Names are file names, and maildir splits them on '.' and ':'.
+	if len(name) == 0 || strings.ContainsAny(name, `/\.:`) || strings.HasSuffix(name, ".tmp") {
+		return "", fmt.Errorf("invalid message name %q", name)
+	}
+	return name, nil
+}
+
+// NameByDateSubject names a message "<date>_<subject-slug>_<hash>", such as
+// "2023-05-01_quarterly-report_k3j9d2qa". The hash is of the Message-ID, or
+// of the folder, UIDVALIDITY, UID, date, sender and subject when there is
+// none, so messages without one that share a date and subject differ.
+func NameByDateSubject(h Header) (string, error) {
+	const maxSlug = 40
+
+	date := "0000-00-00"
+	if d, err := time.Parse(time.RFC3339Nano, h.Date); err == nil && !d.IsZero() {
+		date = d.UTC().Format("2006-01-02")
+	}
+
+	b := &strings.Builder{}
+	dash := false
+	n := 0
+	for _, r := range strings.ToLower(h.Subject) {
+		if n >= maxSlug {
+			break
+		}
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			b.WriteRune(r)
+			dash = false
+			n++
+			continue
+		}
+		if !dash {
+			b.WriteByte('-')
+			dash = true
+			n++
+		}
+	}
+	slug := strings.Trim(b.String(), "-")
+	if len(slug) == 0 {
+		slug = "no-subject"
+	}
+
+	id := h.MessageID
+	if len(id) == 0 {
+		id = fmt.Sprintf("\x00%s\x00%d\x00%d\x00%s\x00%s\x00%s", h.Folder, h.UIDValidity, h.UID, h.Date, h.From, h.Subject)
+	}
+	sum := blake2b.Sum256([]byte(id))
+	short := strings.ToLower(base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(sum[:5]))
+	return date + "_" + slug + "_" + short, nil
+}
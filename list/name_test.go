@@ -0,0 +1,66 @@
+package list
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"golang.org/x/crypto/blake2b"
+)
+
+func TestNameByDateSubject(t *testing.T) {
+	base := Header{
+		Folder:      "INBOX",
+		Date:        "2023-05-01T10:00:00Z",
+		From:        "a@example.com",
+		Subject:     "Quarterly report",
+		UIDValidity: 7,
+		UID:         1,
+	}
+	name := func(h Header) string {
+		t.Helper()
+		s, err := NameByDateSubject(h)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return s
+	}
+	if n := name(base); !strings.HasPrefix(n, "2023-05-01_quarterly-report_") {
+		t.Fatalf("name %s", n)
+	}
+
+	otherUID, otherValidity := base, base
+	otherUID.UID = 2
+	otherValidity.UIDValidity = 8
+	if name(base) == name(otherUID) {
+		t.Error("messages without a Message-ID differing by UID share a name")
+	}
+	if name(base) == name(otherValidity) {
+		t.Error("messages without a Message-ID differing by UIDVALIDITY share a name")
+	}
+
+	base.MessageID, otherUID.MessageID = "<a@test>", "<a@test>"
+	if name(base) != name(otherUID) {
+		t.Error("a message with a Message-ID is named by its UID")
+	}
+}
+
+func TestMessageNameUID(t *testing.T) {
+	var got Header
+	w := &Worker{NameFunc: func(h Header) (string, error) {
+		got = h
+		return "name", nil
+	}}
+	msg := &imap.Message{Uid: 42, Envelope: &imap.Envelope{Subject: "s", Date: time.Now()}}
+	xof, err := blake2b.NewXOF(blake2b.OutputLengthUnknown, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.messageName(xof, make([]byte, 20), "INBOX", 7, msg); err != nil {
+		t.Fatal(err)
+	}
+	if got.UID != 42 || got.UIDValidity != 7 {
+		t.Fatalf("NameFunc given UID %d UIDValidity %d, want 42 and 7", got.UID, got.UIDValidity)
+	}
+}
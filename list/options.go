@@ -0,0 +1,464 @@
+package list
+
+import (
+	"context"
+	"crypto/tls"
+	"io"
+	"os"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/client"
+)
+
+// Option configures a Worker created with New.
+type Option func(w *Worker)
+
+// New returns a Worker that stores messages in store.
+func New(store string, opts ...Option) *Worker {
+	w := &Worker{
+		Store: store,
+	}
+	for _, o := range opts {
+		o(w)
+	}
+	return w
+}
+
+// WithVerbose logs progress events.
+func WithVerbose(v bool) Option {
+	return func(w *Worker) {
+		w.Verbose = v
+	}
+}
+
+// WithLogger sends log output to l instead of the standard logger. Use
+// StdLogger to log to a *log.Logger.
+func WithLogger(l Logger) Option {
+	return func(w *Worker) {
+		w.Logger = l
+	}
+}
+
+// WithLogFormat sets LogText or LogJSON, with JSON records written to out.
+func WithLogFormat(format string, out io.Writer) Option {
+	return func(w *Worker) {
+		w.LogFormat = format
+		w.LogOutput = out
+	}
+}
+
+// WithTLSConfig sets the TLS configuration used for implicit TLS and STARTTLS.
+func WithTLSConfig(c *tls.Config) Option {
+	return func(w *Worker) {
+		w.TLSConfig = c
+	}
+}
+
+// WithBackend stores message files in s instead of the store directory.
+func WithBackend(s Store) Option {
+	return func(w *Worker) {
+		w.Backend = s
+	}
+}
+
+// WithDial sets the function that creates connections instead of dialing
+// the server.
+func WithDial(dial func(ctx context.Context, addr string) (*client.Client, error)) Option {
+	return func(w *Worker) {
+		w.Dial = dial
+	}
+}
+
+// WithProxy connects through a socks5:// or http:// proxy URL.
+func WithProxy(u string) Option {
+	return func(w *Worker) {
+		w.Proxy = u
+	}
+}
+
+// WithTLSMode sets one of TLSImplicit, TLSStartTLS, or TLSPlain.
+func WithTLSMode(mode string) Option {
+	return func(w *Worker) {
+		w.TLSMode = mode
+	}
+}
+
+// WithAuthMethod sets one of AuthLogin or AuthXOAuth2.
+func WithAuthMethod(method string) Option {
+	return func(w *Worker) {
+		w.AuthMethod = method
+	}
+}
+
+// WithLayout sets one of LayoutFlat or LayoutFolder.
+func WithLayout(layout string) Option {
+	return func(w *Worker) {
+		w.Layout = layout
+	}
+}
+
+// WithFormat sets one of FormatNative, FormatMaildir, FormatMbox, FormatEML,
+// or FormatCAS.
+func WithFormat(format string) Option {
+	return func(w *Worker) {
+		w.Format = format
+	}
+}
+
+// WithCompress gzips stored message files.
+func WithCompress(v bool) Option {
+	return func(w *Worker) {
+		w.Compress = v
+	}
+}
+
+// WithCompression compresses traffic with servers that support it.
+func WithCompression(v bool) Option {
+	return func(w *Worker) {
+		w.Compression = v
+	}
+}
+
+// WithExtractText also writes the text of each message to <key>.txt.
+func WithExtractText(v bool) Option {
+	return func(w *Worker) {
+		w.ExtractText = v
+	}
+}
+
+// WithExtractAttachments stores attachments in their own files.
+func WithExtractAttachments(v bool) Option {
+	return func(w *Worker) {
+		w.ExtractAttachments = v
+	}
+}
+
+// WithIncremental enables incremental sync.
+func WithIncremental(v bool) Option {
+	return func(w *Worker) {
+		w.Incremental = v
+	}
+}
+
+// WithSkipDeleted sets whether messages flagged \Deleted are left out.
+func WithSkipDeleted(v bool) Option {
+	return func(w *Worker) {
+		w.SkipDeleted = v
+	}
+}
+
+// WithOnlyNewFolders skips folders STATUS shows unchanged since the last
+// run.
+func WithOnlyNewFolders(v bool) Option {
+	return func(w *Worker) {
+		w.OnlyNewFolders = v
+	}
+}
+
+// WithDateRange only fetches messages received on or after since and before
+// before. Either may be zero.
+func WithDateRange(since, before time.Time) Option {
+	return func(w *Worker) {
+		w.Since = since
+		w.Before = before
+	}
+}
+
+// WithSinceLastRun only fetches messages received since the last successful
+// run.
+func WithSinceLastRun(v bool) Option {
+	return func(w *Worker) {
+		w.SinceLastRun = v
+	}
+}
+
+// WithPreferAllMail only downloads Gmail's All Mail and records labels.
+func WithPreferAllMail(v bool) Option {
+	return func(w *Worker) {
+		w.PreferAllMail = v
+	}
+}
+
+// WithConcurrency processes folders over n connections in parallel.
+func WithConcurrency(n int) Option {
+	return func(w *Worker) {
+		w.Concurrency = n
+	}
+}
+
+// WithFetchConnections fetches the bodies of a folder over n extra
+// connections.
+func WithFetchConnections(n int) Option {
+	return func(w *Worker) {
+		w.FetchConnections = n
+	}
+}
+
+// WithMaxBytesPerSec limits the download rate across all connections.
+func WithMaxBytesPerSec(n int64) Option {
+	return func(w *Worker) {
+		w.MaxBytesPerSec = n
+	}
+}
+
+// WithMaxConnections caps the connections open to the server at once.
+func WithMaxConnections(n int) Option {
+	return func(w *Worker) {
+		w.MaxConnections = n
+	}
+}
+
+// WithTimeouts sets the per folder and per command timeouts.
+func WithTimeouts(folder, op time.Duration) Option {
+	return func(w *Worker) {
+		w.FolderTimeout = folder
+		w.OpTimeout = op
+	}
+}
+
+// WithMaxRetries retries transient failures up to n times.
+func WithMaxRetries(n int) Option {
+	return func(w *Worker) {
+		w.MaxRetries = n
+	}
+}
+
+// WithNameFunc sets the function that names stored messages.
+func WithNameFunc(f func(h Header) (string, error)) Option {
+	return func(w *Worker) {
+		w.NameFunc = f
+	}
+}
+
+// WithKeepalive sends NOOP after the connection is idle for d.
+func WithKeepalive(d time.Duration) Option {
+	return func(w *Worker) {
+		w.Keepalive = d
+	}
+}
+
+// WithBatchSize sets the number of message bodies fetched per command.
+func WithBatchSize(n int) Option {
+	return func(w *Worker) {
+		w.BatchSize = n
+	}
+}
+
+// WithEnvelopeWindow sets the number of envelopes fetched and decided at a
+// time.
+func WithEnvelopeWindow(n int) Option {
+	return func(w *Worker) {
+		w.EnvelopeWindow = n
+	}
+}
+
+// WithMirror trashes stored messages that were deleted on the server.
+func WithMirror(v bool) Option {
+	return func(w *Worker) {
+		w.Mirror = v
+	}
+}
+
+// WithWriteSummary writes each run's summary into the store.
+func WithWriteSummary(v bool) Option {
+	return func(w *Worker) {
+		w.WriteSummary = v
+	}
+}
+
+// WithWatchFolders sets the folders kept in sync by Watch and how often
+// they are checked without IDLE.
+func WithWatchFolders(folders []string, interval time.Duration) Option {
+	return func(w *Worker) {
+		w.WatchFolders = folders
+		w.WatchInterval = interval
+	}
+}
+
+// WithMarkSeen sets \Seen on the server for downloaded messages.
+func WithMarkSeen(v bool) Option {
+	return func(w *Worker) {
+		w.MarkSeen = v
+	}
+}
+
+// WithWriteManifest writes manifest.csv after each run.
+func WithWriteManifest(v bool) Option {
+	return func(w *Worker) {
+		w.WriteManifest = v
+	}
+}
+
+// WithMessageSize skips messages larger than max or smaller than min bytes.
+// Zero disables either limit.
+func WithMessageSize(min, max int64) Option {
+	return func(w *Worker) {
+		w.MinMessageSize = min
+		w.MaxMessageSize = max
+	}
+}
+
+// WithDetectMoves copies messages moved between folders from the store
+// instead of downloading them again.
+func WithDetectMoves(v bool) Option {
+	return func(w *Worker) {
+		w.DetectMoves = v
+	}
+}
+
+// WithRequireAttachment skips messages without an attachment.
+func WithRequireAttachment(v bool) Option {
+	return func(w *Worker) {
+		w.RequireAttachment = v
+	}
+}
+
+// WithSearchFlags only fetches messages matching the flag terms, such as
+// "unseen" or "flagged".
+func WithSearchFlags(flags []string) Option {
+	return func(w *Worker) {
+		w.SearchFlags = flags
+	}
+}
+
+// WithHashAlgo sets the algorithm of the recorded body hash.
+func WithHashAlgo(algo string) Option {
+	return func(w *Worker) {
+		w.HashAlgo = algo
+	}
+}
+
+// WithSkipBodyHash stores messages without hashing their bodies.
+func WithSkipBodyHash(v bool) Option {
+	return func(w *Worker) {
+		w.SkipBodyHash = v
+	}
+}
+
+// WithStoreRawHeaders records each message's full header block in its
+// Header.
+func WithStoreRawHeaders(v bool) Option {
+	return func(w *Worker) {
+		w.StoreRawHeaders = v
+	}
+}
+
+// WithReHashExisting re-downloads stored messages and rewrites those whose
+// body changed on the server.
+func WithReHashExisting(v bool) Option {
+	return func(w *Worker) {
+		w.ReHashExisting = v
+	}
+}
+
+// WithLimits stops the run after maxFolders folders or maxMessages
+// downloaded messages. Zero means no limit.
+func WithLimits(maxFolders, maxMessages int) Option {
+	return func(w *Worker) {
+		w.MaxFolders = maxFolders
+		w.MaxMessages = maxMessages
+	}
+}
+
+// WithEncrypt encrypts native message files to the age recipient, keeping
+// headers in the cleartext index if plainIndex is set.
+func WithEncrypt(recipient string, plainIndex bool) Option {
+	return func(w *Worker) {
+		w.Encrypt = recipient
+		w.PlainIndex = plainIndex
+	}
+}
+
+// WithIdentity sets the age identities that read encrypted message files.
+func WithIdentity(identity string) Option {
+	return func(w *Worker) {
+		w.Identity = identity
+	}
+}
+
+// WithModes sets the permissions of files and directories written to the
+// store. Zero keeps the default.
+func WithModes(file, dir os.FileMode, allowWorldWritable bool) Option {
+	return func(w *Worker) {
+		w.FileMode = file
+		w.DirMode = dir
+		w.AllowWorldWritable = allowWorldWritable
+	}
+}
+
+// WithDedupeByContent stores a body already in the store as a reference to
+// the file holding it.
+func WithDedupeByContent(v bool) Option {
+	return func(w *Worker) {
+		w.DedupeByContent = v
+	}
+}
+
+// WithDeduper skips messages whose Message-ID d has seen and marks those
+// stored in it.
+func WithDeduper(d *Deduper) Option {
+	return func(w *Worker) {
+		w.Deduper = d
+	}
+}
+
+// WithSink writes each message to sink as a line of JSON instead of a file
+// in the store.
+func WithSink(sink io.Writer) Option {
+	return func(w *Worker) {
+		w.Sink = sink
+	}
+}
+
+// WithDryRun reports what would be downloaded without fetching bodies.
+func WithDryRun(v bool) Option {
+	return func(w *Worker) {
+		w.DryRun = v
+	}
+}
+
+// WithFolders sets the include and exclude folder patterns.
+func WithFolders(include, exclude []string) Option {
+	return func(w *Worker) {
+		w.IncludeFolders = include
+		w.ExcludeFolders = exclude
+	}
+}
+
+// WithFolderSettings only processes the folders listed, each with its own
+// settings.
+func WithFolderSettings(folders []FolderSettings) Option {
+	return func(w *Worker) {
+		w.Folders = folders
+	}
+}
+
+// WithRootFolder only processes root and the folders below it.
+func WithRootFolder(root string) Option {
+	return func(w *Worker) {
+		w.RootFolder = root
+	}
+}
+
+// WithExcludeSpecialUse skips folders with the special-use roles, such as
+// "trash" or "junk".
+func WithExcludeSpecialUse(roles []string) Option {
+	return func(w *Worker) {
+		w.ExcludeSpecialUse = roles
+	}
+}
+
+// WithSkipEmptyFolders skips folders that STATUS reports as empty.
+func WithSkipEmptyFolders(v bool) Option {
+	return func(w *Worker) {
+		w.SkipEmptyFolders = v
+	}
+}
+
+// WithFolderFilter only processes folders for which f returns true.
+func WithFolderFilter(f func(mi *imap.MailboxInfo) bool) Option {
+	return func(w *Worker) {
+		w.FolderFilter = f
+	}
+}
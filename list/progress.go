@@ -0,0 +1,87 @@
+package list
+
+import "time"
+
+// Download progress is logged at most every progressInterval, or every
+// progressEvery messages, whichever comes first.
+const (
+	progressInterval = 5 * time.Second
+	progressEvery    = 500
+)
+
+// progress estimates the time left to download a folder from a moving
+// average of the recent download rate.
+type progress struct {
+	w      *Worker
+	folder string
+	total  int   // Messages to fetch.
+	size   int64 // Server reported size of those messages.
+
+	done  int
+	bytes int64
+
+	last      time.Time // Of the last log line.
+	lastDone  int
+	lastBytes int64
+	rate      float64 // Bytes per second, moving average.
+	msgTime   float64 // Seconds per message, moving average.
+}
+
+// newProgress returns nil unless Verbose, so callers need not check.
+func (w *Worker) newProgress(folder string, total int, size int64) *progress {
+	if !w.Verbose {
+		return nil
+	}
+	return &progress{w: w, folder: folder, total: total, size: size, last: time.Now()}
+}
+
+// grow adds n messages of size bytes to those to fetch.
+func (p *progress) grow(n int, size int64) {
+	if p == nil {
+		return
+	}
+	p.total += n
+	p.size += size
+}
+
+// add records one written message of n bytes and logs the estimate when due.
+func (p *progress) add(n int64) {
+	if p == nil {
+		return
+	}
+	p.done++
+	p.bytes += n
+	now := time.Now()
+	elapsed := now.Sub(p.last).Seconds()
+	if p.done == p.total || (elapsed < progressInterval.Seconds() && p.done-p.lastDone < progressEvery) {
+		return
+	}
+	const weight = 0.3 // Of the latest interval.
+	rate := float64(p.bytes-p.lastBytes) / elapsed
+	msgTime := elapsed / float64(p.done-p.lastDone)
+	if p.rate == 0 {
+		p.rate, p.msgTime = rate, msgTime
+	} else {
+		p.rate = weight*rate + (1-weight)*p.rate
+		p.msgTime = weight*msgTime + (1-weight)*p.msgTime
+	}
+	p.last, p.lastDone, p.lastBytes = now, p.done, p.bytes
+
+	// Sizes of large messages dominate the time; fall back to the message
+	// count when either is unknown.
+	var left time.Duration
+	if p.rate > 0 && p.size > p.bytes {
+		left = time.Duration(float64(p.size-p.bytes) / p.rate * float64(time.Second))
+	} else {
+		left = time.Duration(float64(p.total-p.done) * p.msgTime * float64(time.Second))
+	}
+	p.w.log("\tprogress %s: %d of %d messages, %d of %d bytes, %.0f bytes/s, %.2fs per message, %v left",
+		p.folder, p.done, p.total, p.bytes, p.size, p.rate, p.msgTime, left.Round(time.Second))
+
+	s := p.w.snapshotSummary()
+	if run := now.Sub(s.Start).Seconds(); run > 0 && s.Bytes > 0 && s.NewBytes > s.Bytes {
+		runRate := float64(s.Bytes) / run
+		runLeft := time.Duration(float64(s.NewBytes-s.Bytes) / runRate * float64(time.Second))
+		p.w.log("\tprogress run: %d of %d messages in folders scanned so far, %v left", s.Fetched, s.New, runLeft.Round(time.Second))
+	}
+}
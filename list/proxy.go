@@ -0,0 +1,113 @@
+package list
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"golang.org/x/net/proxy"
+)
+
+// dialer returns the dialer for server connections, through Proxy if set.
+func (w *Worker) dialer() (proxy.ContextDialer, error) {
+	d := &net.Dialer{}
+	if len(w.Proxy) == 0 {
+		return d, nil
+	}
+	u, err := url.Parse(w.Proxy)
+	if err != nil {
+		return nil, fmt.Errorf("invalid proxy: %w", err)
+	}
+	switch u.Scheme {
+	default:
+		return nil, fmt.Errorf("unsupported proxy scheme %q, use socks5 or http", u.Scheme)
+	case "socks5", "socks5h":
+		pd, err := proxy.FromURL(u, d)
+		if err != nil {
+			return nil, fmt.Errorf("proxy: %w", err)
+		}
+		cd, ok := pd.(proxy.ContextDialer)
+		if !ok {
+			return nil, fmt.Errorf("proxy %s does not support contexts", u.Scheme)
+		}
+		return cd, nil
+	case "http", "https":
+		return &connectDialer{proxy: u, forward: d}, nil
+	}
+}
+
+// connectDialer tunnels through an HTTP proxy with CONNECT.
+type connectDialer struct {
+	proxy   *url.URL
+	forward *net.Dialer
+}
+
+func (d *connectDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	host := d.proxy.Host
+	if len(d.proxy.Port()) == 0 {
+		port := "80"
+		if d.proxy.Scheme == "https" {
+			port = "443"
+		}
+		host = net.JoinHostPort(d.proxy.Hostname(), port)
+	}
+	conn, err := d.forward.DialContext(ctx, network, host)
+	if err != nil {
+		return nil, fmt.Errorf("proxy %s: %w", host, err)
+	}
+	if d.proxy.Scheme == "https" {
+		tc := tls.Client(conn, &tls.Config{ServerName: d.proxy.Hostname()})
+		if err := tc.HandshakeContext(ctx); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("proxy %s: %w", host, err)
+		}
+		conn = tc
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: http.Header{},
+	}
+	if u := d.proxy.User; u != nil {
+		pass, _ := u.Password()
+		req.Header.Set("Proxy-Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(u.Username()+":"+pass)))
+	}
+	if err := req.Write(conn); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("proxy %s: %w", host, err)
+	}
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("proxy %s: %w", host, err)
+	}
+	// The body of a successful CONNECT is the tunnel, so it is not read.
+	if resp.StatusCode != http.StatusOK {
+		conn.Close()
+		return nil, fmt.Errorf("proxy %s: CONNECT %s: %s", host, addr, resp.Status)
+	}
+	conn.SetDeadline(time.Time{})
+	// The server greeting may already be buffered.
+	return &bufferedConn{Conn: conn, r: br}, nil
+}
+
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
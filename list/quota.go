@@ -0,0 +1,58 @@
+package list
+
+import (
+	"fmt"
+	"sort"
+
+	quota "github.com/emersion/go-imap-quota"
+	"github.com/emersion/go-imap/client"
+)
+
+// Quota is the usage and limit of one quota root. A zero limit means the
+// server sets none for that resource.
+type Quota struct {
+	Root          string
+	StorageUsed   int64 // Bytes.
+	StorageLimit  int64 // Bytes.
+	MessagesUsed  int64
+	MessagesLimit int64
+}
+
+func (q Quota) String() string {
+	return fmt.Sprintf("%q storage=%d/%d messages=%d/%d", q.Root, q.StorageUsed, q.StorageLimit, q.MessagesUsed, q.MessagesLimit)
+}
+
+// reportQuota logs the quota roots of INBOX and records them in the summary.
+// Nothing is reported if the server lacks the QUOTA extension or the query
+// fails.
+func (w *Worker) reportQuota(c *client.Client) {
+	qc := quota.NewClient(c)
+	ok, err := qc.SupportQuota()
+	if err != nil || !ok {
+		return
+	}
+	list, err := qc.GetQuotaRoot("INBOX")
+	if err != nil {
+		w.log("Quota: %v", err)
+		return
+	}
+	quotas := make([]Quota, 0, len(list))
+	for _, st := range list {
+		q := Quota{Root: st.Name}
+		if r, ok := st.Resources[quota.ResourceStorage]; ok {
+			// STORAGE is counted in units of 1024 bytes.
+			q.StorageUsed = int64(r[0]) * 1024
+			q.StorageLimit = int64(r[1]) * 1024
+		}
+		if r, ok := st.Resources[quota.ResourceMessage]; ok {
+			q.MessagesUsed = int64(r[0])
+			q.MessagesLimit = int64(r[1])
+		}
+		w.print("Quota %v", q)
+		quotas = append(quotas, q)
+	}
+	sort.Slice(quotas, func(i, j int) bool { return quotas[i].Root < quotas[j].Root })
+	w.addSummary(func(s *RunSummary) {
+		s.Quotas = quotas
+	})
+}
@@ -0,0 +1,31 @@
+package list
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+)
+
+// maxRawHeader bounds the header block kept by StoreRawHeaders.
+const maxRawHeader = 1 << 20
+
+// readRawHeader returns the header block at the start of a raw message, up
+// to the blank line that ends it.
+func readRawHeader(r io.Reader) (string, error) {
+	br := bufio.NewReader(io.LimitReader(r, maxRawHeader))
+	buf := &bytes.Buffer{}
+	for {
+		line, err := br.ReadBytes('\n')
+		if len(bytes.TrimRight(line, "\r\n")) == 0 && len(line) > 0 {
+			break
+		}
+		buf.Write(line)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return "", err
+		}
+	}
+	return buf.String(), nil
+}
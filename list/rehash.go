@@ -0,0 +1,130 @@
+package list
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// historyFile in historyDir logs the stored messages rewritten by
+// ReHashExisting.
+const (
+	historyDir  = ".history"
+	historyFile = "changes.jsonl"
+)
+
+// historyEntry is one line of the history log.
+type historyEntry struct {
+	Time     time.Time
+	Folder   string
+	Key      string
+	HashAlgo string
+	OldHash  []byte
+	OldSize  string
+	NewHash  []byte
+	NewSize  string
+}
+
+// rehashMessage compares body with the stored file of h.Key in dir and, if
+// the hash differs, logs the change and writes the file again. The folders
+// already recorded in the stored header are kept.
+func (w *Worker) rehashMessage(dir string, h *Header, date time.Time, body io.Reader, hasher hash.Hash) (bool, error) {
+	path := ""
+	for _, name := range storedNames(h.Key) {
+		p := filepath.Join(dir, name)
+		if _, err := os.Stat(p); err == nil {
+			path = p
+			break
+		}
+	}
+	if len(path) == 0 {
+		return false, nil
+	}
+	sf, err := w.openStored(path)
+	if err != nil {
+		return false, err
+	}
+	old, err := readHeader(bufio.NewReader(sf))
+	sf.Close()
+	if err != nil {
+		return false, err
+	}
+	if old.Skipped || len(old.DuplicateOf) > 0 {
+		return false, nil
+	}
+
+	// The body was read into memory by the client already.
+	b, err := io.ReadAll(body)
+	if err != nil {
+		return false, err
+	}
+	oh, err := newHasher(old.HashAlgo)
+	if err != nil {
+		return false, err
+	}
+	oh.Write(b)
+	if bytes.Equal(oh.Sum(nil), old.Hash) {
+		return false, nil
+	}
+
+	h.Folder = old.Folder
+	h.Folders = old.Folders
+	if err := w.writeNative(dir, h, date, bytes.NewReader(b), hasher); err != nil {
+		return false, err
+	}
+	final := filepath.Join(dir, h.Key+w.nativeSuffix())
+	if path != final {
+		if err := os.Remove(path); err != nil {
+			return false, err
+		}
+	}
+	err = w.appendHistory(historyEntry{
+		Time:     time.Now(),
+		Folder:   h.Folder,
+		Key:      h.Key,
+		HashAlgo: old.HashAlgo,
+		OldHash:  old.Hash,
+		OldSize:  old.Size,
+		NewHash:  h.Hash,
+		NewSize:  h.Size,
+	})
+	if err != nil {
+		return false, err
+	}
+	w.log("\tbody of %s changed, rewritten", h.Key)
+	// The index still has the old header.
+	w.idxMu.Lock()
+	w.idxStale = true
+	w.idxMu.Unlock()
+	return true, nil
+}
+
+func (w *Worker) appendHistory(e historyEntry) error {
+	line, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	dir := filepath.Join(w.Store, historyDir)
+	if err := w.mkdirAll(dir); err != nil {
+		return err
+	}
+	f, err := w.openFile(filepath.Join(dir, historyFile), os.O_CREATE|os.O_WRONLY|os.O_APPEND)
+	if err != nil {
+		return fmt.Errorf("history: %w", err)
+	}
+	if _, err := f.Write(line); err != nil {
+		f.Close()
+		return fmt.Errorf("history: %w", err)
+	}
+	return f.Close()
+}
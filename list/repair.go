@@ -0,0 +1,144 @@
+package list
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"sort"
+)
+
+// folderFiles is what Repair finds stored for one folder.
+type folderFiles struct {
+	files      int
+	messageIDs map[string]bool
+	lastUID    map[uint32]uint32 // UIDVALIDITY to the highest UID stored.
+	count      map[uint32]int    // UIDVALIDITY to the files holding it.
+}
+
+// Repair reconciles the incremental state and the index with the message
+// files in the store, after files were removed by hand or a run was cut
+// short. Each folder's state is set to the highest UID stored for it, and
+// the index is rebuilt. Folders stored without state and state without
+// stored messages are reported; the latter is dropped.
+func (w *Worker) Repair(ctx context.Context) error {
+	if !w.headerFiles() {
+		return fmt.Errorf("repair only supports the %s and %s formats", FormatNative, FormatCAS)
+	}
+	if w.Backend != nil {
+		return fmt.Errorf("repair is not supported with a Backend")
+	}
+	if err := w.checkModes(); err != nil {
+		return err
+	}
+	st, err := loadState(w.Store)
+	if err != nil {
+		return err
+	}
+
+	found := map[string]*folderFiles{}
+	unreadable := 0
+	err = w.walkStore(ctx, func(path string) error {
+		sf, err := w.openStored(path)
+		if err != nil {
+			return err
+		}
+		h, err := readHeader(bufio.NewReader(sf))
+		sf.Close()
+		if err != nil {
+			w.print("repair: skip %s: %v", path, err)
+			unreadable++
+			return nil
+		}
+		ff := found[h.Folder]
+		if ff == nil {
+			ff = &folderFiles{messageIDs: map[string]bool{}, lastUID: map[uint32]uint32{}, count: map[uint32]int{}}
+			found[h.Folder] = ff
+		}
+		ff.files++
+		if len(h.MessageID) > 0 {
+			ff.messageIDs[h.MessageID] = true
+		}
+		if h.UIDValidity == 0 || h.UID == 0 {
+			return nil
+		}
+		ff.count[h.UIDValidity]++
+		if h.UID > ff.lastUID[h.UIDValidity] {
+			ff.lastUID[h.UIDValidity] = h.UID
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	names := make([]string, 0, len(found)+len(st.Folders))
+	for name := range found {
+		names = append(names, name)
+	}
+	for name := range st.Folders {
+		if found[name] == nil {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	changed := 0
+	for _, name := range names {
+		ff := found[name]
+		fs, ok := st.Folders[name]
+		if ff == nil {
+			w.print("%s: state at uid %d has no stored messages, dropped", name, fs.LastUID)
+			delete(st.Folders, name)
+			changed++
+			continue
+		}
+		w.log("%s: %d files, %d message ids", name, ff.files, len(ff.messageIDs))
+		if len(ff.count) == 0 {
+			if ok {
+				w.print("%s: stored messages have no UIDs, state at uid %d dropped", name, fs.LastUID)
+				delete(st.Folders, name)
+				changed++
+			}
+			continue
+		}
+		if len(ff.count) > 1 {
+			w.print("%s: stored messages have %d UIDVALIDITY values", name, len(ff.count))
+		}
+		// Keep the recorded UIDVALIDITY if any file has it, otherwise take
+		// the one most files have.
+		var validity uint32
+		if ok && ff.count[fs.UIDValidity] > 0 {
+			validity = fs.UIDValidity
+		} else {
+			for v, n := range ff.count {
+				if n > ff.count[validity] || (n == ff.count[validity] && v > validity) {
+					validity = v
+				}
+			}
+		}
+		want := folderState{UIDValidity: validity, LastUID: ff.lastUID[validity]}
+		switch {
+		case !ok:
+			w.print("%s: %d stored messages have no state, set to uid %d", name, ff.files, want.LastUID)
+		case fs.UIDValidity == want.UIDValidity && fs.LastUID == want.LastUID:
+			continue
+		case fs.UIDValidity != want.UIDValidity:
+			w.print("%s: state has UIDVALIDITY %d, stored messages %d; set to uid %d", name, fs.UIDValidity, want.UIDValidity, want.LastUID)
+		default:
+			w.print("%s: state at uid %d, highest stored uid %d", name, fs.LastUID, want.LastUID)
+		}
+		st.setFolder(name, want)
+		changed++
+	}
+	if changed > 0 {
+		if err := st.save(w.Store, w.fileMode()); err != nil {
+			return err
+		}
+	}
+	w.print("repair: %d folders, %d state entries changed, %d unreadable files", len(found), changed, unreadable)
+
+	if len(w.Encrypt) > 0 && !w.PlainIndex {
+		return nil
+	}
+	return w.RebuildIndex(ctx)
+}
@@ -0,0 +1,182 @@
+package list
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/client"
+)
+
+type storedRef struct {
+	path   string
+	header Header
+}
+
+// sizedReader is an imap.Literal of a known length.
+type sizedReader struct {
+	io.Reader
+	n int
+}
+
+func (r sizedReader) Len() int { return r.n }
+
+// Restore uploads the store to server. Messages are appended to each folder
+// recorded in their header with their recorded flags and date, creating
+// folders as needed. Messages whose Message-ID is already in the target
+// folder are skipped; messages without a Message-ID are always appended.
+func (w *Worker) Restore(ctx context.Context, server, username, password string) error {
+	if !w.headerFiles() {
+		return fmt.Errorf("restore only supports the %s and %s formats", FormatNative, FormatCAS)
+	}
+	if w.Backend != nil {
+		return fmt.Errorf("restore is not supported with a Backend")
+	}
+	byFolder := map[string][]storedRef{}
+	err := w.walkStore(ctx, func(path string) error {
+		h, err := w.readStoredHeader(path)
+		if err != nil {
+			return err
+		}
+		if h.Skipped {
+			w.log("%s: no body stored, not restored", h.Key)
+			return nil
+		}
+		if len(h.DuplicateOf) > 0 {
+			// The body is in the file Dedupe kept.
+			path, err = duplicatePath(w.Store, path, h.DuplicateOf)
+			if err != nil {
+				w.print("%s: %v, not restored", h.Key, err)
+				return nil
+			}
+		}
+		if len(h.Object) > 0 {
+			if _, err := storePath(w.Store, path, h.Object); err != nil {
+				w.print("%s: object %s: %v, not restored", h.Key, h.Object, err)
+				return nil
+			}
+		}
+		folders := h.Folders
+		if len(folders) == 0 {
+			folders = []string{h.Folder}
+		}
+		for _, folder := range folders {
+			byFolder[folder] = append(byFolder[folder], storedRef{path: path, header: h})
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	c, err := w.connect(ctx, server, username, password)
+	if err != nil {
+		return err
+	}
+	defer c.Logout()
+
+	existing, err := existingFolders(c)
+	if err != nil {
+		return err
+	}
+
+	folders := make([]string, 0, len(byFolder))
+	for name := range byFolder {
+		folders = append(folders, name)
+	}
+	sort.Strings(folders)
+	for _, folder := range folders {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if !existing[folder] {
+			w.log("Create folder: %s", folder)
+			if err := c.Create(folder); err != nil {
+				return fmt.Errorf("create %s: %w", folder, err)
+			}
+		}
+		if err := w.restoreFolder(ctx, c, folder, byFolder[folder]); err != nil {
+			return fmt.Errorf("restore %s: %w", folder, err)
+		}
+	}
+	return nil
+}
+
+// existingFolders returns the names of the folders on the server.
+func existingFolders(c *client.Client) (map[string]bool, error) {
+	names := map[string]bool{}
+	ch := make(chan *imap.MailboxInfo, 10)
+	errC := make(chan error, 1)
+	go func() {
+		errC <- c.List("", "*", ch)
+	}()
+	for mi := range ch {
+		names[mi.Name] = true
+	}
+	if err := <-errC; err != nil {
+		return nil, fmt.Errorf("list: %w", err)
+	}
+	return names, nil
+}
+
+func (w *Worker) restoreFolder(ctx context.Context, c *client.Client, folder string, refs []storedRef) error {
+	w.log("Folder: %s", folder)
+	if _, err := c.Select(folder, true); err != nil {
+		return fmt.Errorf("select: %w", err)
+	}
+	appended, skipped := 0, 0
+	for _, ref := range refs {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		h := ref.header
+		if len(h.MessageID) > 0 {
+			crit := imap.NewSearchCriteria()
+			crit.Header.Add("Message-Id", h.MessageID)
+			ids, err := c.UidSearch(crit)
+			if err != nil {
+				return fmt.Errorf("search: %w", err)
+			}
+			if len(ids) > 0 {
+				skipped++
+				continue
+			}
+		}
+		if err := w.appendStored(c, folder, ref); err != nil {
+			return fmt.Errorf("append %s: %w", h.Key, err)
+		}
+		appended++
+	}
+	w.log("\tappended %05d messages", appended)
+	w.log("\texist    %05d messages", skipped)
+	return nil
+}
+
+func (w *Worker) appendStored(c *client.Client, folder string, ref storedRef) error {
+	h := ref.header
+	size, err := strconv.Atoi(h.Size)
+	if err != nil {
+		return fmt.Errorf("invalid size %q", h.Size)
+	}
+	date, _ := time.Parse(time.RFC3339Nano, h.Date)
+
+	// The server sets \Recent itself and rejects it in APPEND.
+	flags := make([]string, 0, len(h.Flags))
+	for _, f := range h.Flags {
+		if f == imap.RecentFlag {
+			continue
+		}
+		flags = append(flags, f)
+	}
+
+	m, err := w.Open(ref.path)
+	if err != nil {
+		return err
+	}
+	defer m.Body.Close()
+	return c.Append(folder, flags, date, sizedReader{Reader: io.LimitReader(m.Body, int64(size)), n: size})
+}
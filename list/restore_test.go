@@ -0,0 +1,58 @@
+package list
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRestoreEveryFolder(t *testing.T) {
+	addr := testServer(t)
+	c := testConnect(t, addr)
+	msg := "Message-Id: <both@test>\r\nSubject: in two folders\r\n\r\nbody\r\n"
+	for _, folder := range []string{"Archive", "Work"} {
+		if err := c.Create(folder); err != nil {
+			t.Fatal(err)
+		}
+		if err := c.Append(folder, nil, time.Now(), sizedReader{Reader: strings.NewReader(msg), n: len(msg)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	w := testWorker(t)
+	if _, err := w.List(context.Background(), addr, "username", "password"); err != nil {
+		t.Fatal(err)
+	}
+	hs, _, err := w.readIndex()
+	if err != nil {
+		t.Fatal(err)
+	}
+	found := false
+	for _, h := range hs {
+		if h.MessageID == "<both@test>" {
+			found = true
+			if len(h.Folders) != 2 {
+				t.Fatalf("stored with folders %q, want Archive and Work", h.Folders)
+			}
+		}
+	}
+	if !found {
+		t.Fatal("message not stored")
+	}
+
+	to := testServer(t)
+	if err := w.Restore(context.Background(), to, "username", "password"); err != nil {
+		t.Fatal(err)
+	}
+	rc := testConnect(t, to)
+	// The message INBOX starts with is already there and skipped.
+	for folder, want := range map[string]uint32{"Archive": 1, "Work": 1, "INBOX": 1} {
+		st, err := rc.Select(folder, true)
+		if err != nil {
+			t.Fatalf("select %s: %v", folder, err)
+		}
+		if st.Messages != want {
+			t.Errorf("%s: %d messages after restore, want %d", folder, st.Messages, want)
+		}
+	}
+}
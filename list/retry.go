@@ -0,0 +1,74 @@
+package list
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"time"
+)
+
+const (
+	retryBase = time.Second
+	retryMax  = time.Minute
+)
+
+// transientError marks an error after which the connection was lost, so the
+// operation may succeed on a new connection.
+type transientError struct {
+	err error
+}
+
+func (e transientError) Error() string { return e.err.Error() }
+func (e transientError) Unwrap() error { return e.err }
+
+// retryable reports whether err is a transport failure worth retrying.
+// Authentication failures and cancellation are permanent.
+func retryable(err error) bool {
+	switch {
+	case err == nil:
+		return false
+	case errors.Is(err, ErrAuth),
+		errors.Is(err, context.Canceled),
+		errors.Is(err, errFolderTimeout):
+		return false
+	}
+	var te transientError
+	if errors.As(err, &te) {
+		return true
+	}
+	var ne net.Error
+	if errors.As(err, &ne) {
+		return true
+	}
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return true
+	}
+	e := err.Error()
+	return strings.Contains(e, "connection closed") || strings.Contains(e, "connection reset")
+}
+
+// withRetry calls op until it succeeds, fails permanently, or MaxRetries
+// retries have been made, waiting with exponential backoff between tries.
+func (w *Worker) withRetry(ctx context.Context, what string, op func() error) error {
+	delay := retryBase
+	for attempt := 1; ; attempt++ {
+		err := op()
+		if err == nil || attempt > w.MaxRetries || !retryable(err) || ctx.Err() != nil {
+			return err
+		}
+		w.log("%s: %v; retry %d of %d in %v", what, err, attempt, w.MaxRetries, delay)
+		t := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			return ctx.Err()
+		case <-t.C:
+		}
+		delay *= 2
+		if delay > retryMax {
+			delay = retryMax
+		}
+	}
+}
@@ -0,0 +1,85 @@
+package list
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// SearchQuery selects stored messages. Zero fields match everything.
+type SearchQuery struct {
+	From    string // Case-insensitive substring of the From header.
+	Subject string // Regular expression matched against the subject.
+	Folder  string // Exact folder name.
+	Since   time.Time
+	Before  time.Time
+}
+
+// Search returns the headers of every stored message matching q. It only
+// reads the local store and never connects to a server. The index is used
+// when present, otherwise every file is read.
+func (w *Worker) Search(ctx context.Context, q SearchQuery) ([]Header, error) {
+	if !w.headerFiles() {
+		return nil, fmt.Errorf("search only supports the %s and %s formats", FormatNative, FormatCAS)
+	}
+	var subject *regexp.Regexp
+	if len(q.Subject) > 0 {
+		var err error
+		subject, err = regexp.Compile(q.Subject)
+		if err != nil {
+			return nil, fmt.Errorf("subject: %w", err)
+		}
+	}
+	from := strings.ToLower(q.From)
+	match := func(h Header) bool {
+		if len(from) > 0 && !strings.Contains(strings.ToLower(h.From), from) {
+			return false
+		}
+		if subject != nil && !subject.MatchString(h.Subject) {
+			return false
+		}
+		if len(q.Folder) > 0 && h.Folder != q.Folder {
+			return false
+		}
+		if !q.Since.IsZero() || !q.Before.IsZero() {
+			d, err := time.Parse(time.RFC3339Nano, h.Date)
+			if err != nil {
+				return false
+			}
+			if !q.Since.IsZero() && d.Before(q.Since) {
+				return false
+			}
+			if !q.Before.IsZero() && !d.Before(q.Before) {
+				return false
+			}
+		}
+		return true
+	}
+
+	var found []Header
+	hs, indexed, err := w.readIndex()
+	if err != nil {
+		return nil, err
+	}
+	if indexed {
+		for _, h := range hs {
+			if match(h) {
+				found = append(found, h)
+			}
+		}
+		return found, nil
+	}
+	err = w.walkStore(ctx, func(path string) error {
+		h, err := w.readStoredHeader(path)
+		if err != nil {
+			return err
+		}
+		if match(h) {
+			found = append(found, h)
+		}
+		return nil
+	})
+	return found, err
+}
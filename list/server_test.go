@@ -0,0 +1,207 @@
+package list
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"io/fs"
+	"net"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/backend/memory"
+	"github.com/emersion/go-imap/client"
+	"github.com/emersion/go-imap/server"
+	"github.com/emersion/go-imap/utf7"
+)
+
+// testServer starts an in-memory IMAP server for the test with the user
+// "username", password "password", and returns its address. INBOX holds the
+// one message the memory backend starts with.
+func testServer(t *testing.T) string {
+	t.Helper()
+	s := server.New(memory.New())
+	s.AllowInsecureAuth = true
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.Serve(l)
+	t.Cleanup(func() { s.Close() })
+	return l.Addr().String()
+}
+
+// testWorker returns a Worker for a test server storing to a new directory.
+func testWorker(t *testing.T, opts ...Option) *Worker {
+	t.Helper()
+	return New(t.TempDir(), append([]Option{WithTLSMode(TLSPlain)}, opts...)...)
+}
+
+// testConnect logs in to a test server.
+func testConnect(t *testing.T, addr string) *client.Client {
+	t.Helper()
+	c, err := testWorker(t).connect(context.Background(), addr, "username", "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Logout() })
+	return c
+}
+
+// testAppend creates folder if needed and appends n messages to it.
+func testAppend(t *testing.T, addr, folder string, n int) {
+	t.Helper()
+	c := testConnect(t, addr)
+	if folder != "INBOX" {
+		c.Create(folder)
+	}
+	for i := 0; i < n; i++ {
+		msg := fmt.Sprintf("Message-Id: <%d.%d@test>\r\nSubject: message %d\r\nFrom: a@example.com\r\n\r\nbody %d\r\n", time.Now().UnixNano(), i, i, i)
+		if err := c.Append(folder, nil, time.Now(), sizedReader{Reader: strings.NewReader(msg), n: len(msg)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// utf8Proxy sits in front of a test server and acts as an RFC 6855 server:
+// it offers UTF8=ACCEPT, and once a connection enables it, rejects SEARCH
+// with a CHARSET and sends folder names in LIST and STATUS as UTF-8.
+type utf8Proxy struct {
+	addr       string
+	backend    string
+	enabled    int32 // Connections that enabled UTF8=ACCEPT.
+	badCharset int32 // Commands rejected for a CHARSET.
+}
+
+func newUTF8Proxy(t *testing.T, backend string) *utf8Proxy {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	p := &utf8Proxy{addr: l.Addr().String(), backend: backend}
+	go func() {
+		for {
+			cc, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go p.serve(cc)
+		}
+	}()
+	return p
+}
+
+var mutf7Word = regexp.MustCompile(`&[A-Za-z0-9+,]+-`)
+
+func (p *utf8Proxy) serve(cc net.Conn) {
+	defer cc.Close()
+	sc, err := net.Dial("tcp", p.backend)
+	if err != nil {
+		return
+	}
+	defer sc.Close()
+	var wmu sync.Mutex
+	write := func(s string) {
+		wmu.Lock()
+		defer wmu.Unlock()
+		io.WriteString(cc, s)
+	}
+	var enabled atomic.Bool
+	go func() {
+		defer cc.Close()
+		r := bufio.NewReader(sc)
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				return
+			}
+			line = strings.Replace(line, "[CAPABILITY ", "[CAPABILITY "+utf8Accept+" ", 1)
+			if strings.HasPrefix(line, "* CAPABILITY ") {
+				line = "* CAPABILITY " + utf8Accept + " " + line[len("* CAPABILITY "):]
+			}
+			if enabled.Load() && (strings.HasPrefix(line, "* LIST ") || strings.HasPrefix(line, "* STATUS ")) {
+				line = mutf7Word.ReplaceAllStringFunc(line, func(s string) string {
+					d, err := utf7.Encoding.NewDecoder().String(s)
+					if err != nil {
+						return s
+					}
+					return d
+				})
+			}
+			write(line)
+		}
+	}()
+	r := bufio.NewReader(cc)
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		tag, rest, _ := strings.Cut(line, " ")
+		cmd := strings.ToUpper(strings.TrimSpace(rest))
+		switch {
+		case cmd == "ENABLE "+utf8Accept:
+			enabled.Store(true)
+			atomic.AddInt32(&p.enabled, 1)
+			write("* ENABLED " + utf8Accept + "\r\n" + tag + " OK ENABLE completed\r\n")
+			continue
+		case enabled.Load() && strings.Contains(cmd, " CHARSET "):
+			atomic.AddInt32(&p.badCharset, 1)
+			write(tag + " BAD CHARSET not allowed after ENABLE " + utf8Accept + "\r\n")
+			continue
+		}
+		if _, err := io.WriteString(sc, line); err != nil {
+			return
+		}
+	}
+}
+
+// testExpunge removes the messages of folder in the sequence set seqs.
+func testExpunge(t *testing.T, addr, folder, seqs string) {
+	t.Helper()
+	c := testConnect(t, addr)
+	if _, err := c.Select(folder, false); err != nil {
+		t.Fatal(err)
+	}
+	set, err := imap.ParseSeqSet(seqs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Store(set, imap.FormatFlagsOp(imap.AddFlags, true), []interface{}{imap.DeletedFlag}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Expunge(nil); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// treeSnapshot describes every file below dir by its path, size, mode and
+// time, so two snapshots differ if anything was written, moved or removed.
+func treeSnapshot(t *testing.T, dir string) map[string]string {
+	t.Helper()
+	files := map[string]string{}
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		fi, err := d.Info()
+		if err != nil {
+			return err
+		}
+		files[path] = fmt.Sprint(fi.Size(), fi.Mode(), fi.ModTime().UnixNano())
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return files
+}
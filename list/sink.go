@@ -0,0 +1,94 @@
+package list
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+)
+
+// sinkRecord is one line written to Worker.Sink. The body is base64 in
+// JSON.
+type sinkRecord struct {
+	Header
+	Body []byte
+}
+
+// checkSink reports options that need message files and so can't be used
+// with a Sink.
+func (w *Worker) checkSink() error {
+	if w.Sink == nil {
+		return nil
+	}
+	var opt string
+	switch {
+	case len(w.Format) > 0 && w.Format != FormatNative:
+		opt = "the " + w.Format + " format"
+	case w.Layout == LayoutFolder:
+		opt = "the " + LayoutFolder + " layout"
+	case w.Backend != nil:
+		opt = "a Backend"
+	case w.Compress:
+		opt = "Compress"
+	case w.ExtractAttachments:
+		opt = "ExtractAttachments"
+	case w.Mirror:
+		opt = "Mirror"
+	case w.ReHashExisting:
+		opt = "ReHashExisting"
+	case w.DetectMoves:
+		opt = "DetectMoves"
+	case w.DedupeByContent:
+		opt = "DedupeByContent"
+	case w.WriteManifest:
+		opt = "WriteManifest"
+	default:
+		return nil
+	}
+	return fmt.Errorf("%s can't be used with a Sink", opt)
+}
+
+// sinkSeen reports whether key was already written to the Sink.
+func (w *Worker) sinkSeen(key string) bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.sinkKeys[key]
+}
+
+// writeSink writes h and body to the Sink as one line, filling in the body
+// Size and Hash.
+func (w *Worker) writeSink(h *Header, body io.Reader, hasher hash.Hash) error {
+	buf := &bytes.Buffer{}
+	if err := w.copyBody(buf, body, h, hasher); err != nil {
+		return fmt.Errorf("read body: %w", err)
+	}
+	if w.StoreRawHeaders {
+		var err error
+		h.RawHeader, err = readRawHeader(bytes.NewReader(buf.Bytes()))
+		if err != nil {
+			return fmt.Errorf("raw header: %w", err)
+		}
+	}
+	return w.emitSink(&sinkRecord{Header: *h, Body: buf.Bytes()})
+}
+
+// emitSink writes r to the Sink as one line and records its key as written.
+func (w *Worker) emitSink(r *sinkRecord) error {
+	line := &bytes.Buffer{}
+	enc := json.NewEncoder(line)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(r); err != nil {
+		return fmt.Errorf("marshal: %w", err)
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if _, err := w.Sink.Write(line.Bytes()); err != nil {
+		return fmt.Errorf("sink: %w", err)
+	}
+	if w.sinkKeys == nil {
+		w.sinkKeys = map[string]bool{}
+	}
+	w.sinkKeys[r.Key] = true
+	return nil
+}
@@ -0,0 +1,100 @@
+package list
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/emersion/go-imap"
+)
+
+// sizeSkipped reports whether a message of the server reported size is
+// outside MinMessageSize and MaxMessageSize.
+func (s FolderSettings) sizeSkipped(size uint32) bool {
+	if s.MaxMessageSize > 0 && int64(size) > s.MaxMessageSize {
+		return true
+	}
+	return s.MinMessageSize > 0 && int64(size) < s.MinMessageSize
+}
+
+// Header.SkipReason values.
+const (
+	SkipSize         = "size"          // Outside MinMessageSize and MaxMessageSize.
+	SkipNoAttachment = "no-attachment" // No attachment with RequireAttachment.
+)
+
+// writeSkipped records a message whose body is not wanted as a native file
+// in dir holding only its header, so later runs find it stored.
+func (w *Worker) writeSkipped(dir, folder, key string, uidValidity uint32, msg *imap.Message, reason string) error {
+	h := envelopeHeader(folder, msg)
+	h.Key = key
+	h.SpecialUse = w.specialUse(folder)
+	h.UIDValidity = uidValidity
+	h.UID = msg.Uid
+	h.Flags = msg.Flags
+	h.Size = strconv.FormatUint(uint64(msg.Size), 10)
+	h.Skipped = true
+	h.SkipReason = reason
+	if w.Sink != nil {
+		return w.emitSink(&sinkRecord{Header: h})
+	}
+	name := key
+	if len(w.Encrypt) > 0 {
+		name += ageSuffix
+	}
+	tmp, err := writeTemp(dir, key, w.fileMode(), func(f *os.File) error {
+		out, err := w.storedWriter(f, name)
+		if err != nil {
+			return err
+		}
+		if err := writeHeader(out, &h); err != nil {
+			return err
+		}
+		return out.Close()
+	})
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp)
+	if err := w.setModTime(tmp, key, messageDate(msg)); err != nil {
+		return err
+	}
+	if w.Backend != nil {
+		err = w.writeBackend(dir, name, tmp)
+	} else {
+		err = os.Rename(tmp, filepath.Join(dir, name))
+	}
+	if err != nil {
+		return err
+	}
+	return w.appendIndex(&h)
+}
+
+// hasAttachment reports whether a message structure has a part that is an
+// attachment: one with an attachment disposition, or a named part that is
+// not shown inline.
+func hasAttachment(bs *imap.BodyStructure) bool {
+	if bs == nil {
+		return false
+	}
+	found := false
+	bs.Walk(func(path []int, part *imap.BodyStructure) bool {
+		if found {
+			return false
+		}
+		if strings.EqualFold(part.MIMEType, "multipart") {
+			return true
+		}
+		switch strings.ToLower(part.Disposition) {
+		case "attachment":
+			found = true
+		case "inline":
+		default:
+			name, _ := part.Filename()
+			found = len(name) > 0
+		}
+		return false
+	})
+	return found
+}
@@ -0,0 +1,122 @@
+package list
+
+import (
+	"strings"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/client"
+	"github.com/emersion/go-imap/responses"
+	"github.com/emersion/go-imap/utf7"
+)
+
+// specialUseAttrs are the RFC 6154 folder roles recorded in
+// Header.SpecialUse.
+var specialUseAttrs = []string{
+	imap.AllAttr,
+	imap.ArchiveAttr,
+	imap.DraftsAttr,
+	imap.FlaggedAttr,
+	imap.JunkAttr,
+	imap.SentAttr,
+	imap.TrashAttr,
+}
+
+// specialUseNames guesses the role of a folder from its last name element
+// on servers that don't report one.
+var specialUseNames = map[string]string{
+	"all mail":         imap.AllAttr,
+	"archive":          imap.ArchiveAttr,
+	"archives":         imap.ArchiveAttr,
+	"drafts":           imap.DraftsAttr,
+	"draft":            imap.DraftsAttr,
+	"starred":          imap.FlaggedAttr,
+	"junk":             imap.JunkAttr,
+	"junk e-mail":      imap.JunkAttr,
+	"junk email":       imap.JunkAttr,
+	"spam":             imap.JunkAttr,
+	"bulk mail":        imap.JunkAttr,
+	"sent":             imap.SentAttr,
+	"sent items":       imap.SentAttr,
+	"sent mail":        imap.SentAttr,
+	"sent messages":    imap.SentAttr,
+	"trash":            imap.TrashAttr,
+	"bin":              imap.TrashAttr,
+	"deleted":          imap.TrashAttr,
+	"deleted items":    imap.TrashAttr,
+	"deleted messages": imap.TrashAttr,
+}
+
+// specialUseOf returns the role of a listed folder, from its attributes or
+// else its name, or "" if it has none.
+func specialUseOf(mi *imap.MailboxInfo) string {
+	for _, a := range mi.Attributes {
+		for _, su := range specialUseAttrs {
+			if strings.EqualFold(a, su) {
+				return su
+			}
+		}
+	}
+	name := mi.Name
+	if len(mi.Delimiter) > 0 {
+		if i := strings.LastIndex(name, mi.Delimiter); i >= 0 {
+			name = name[i+len(mi.Delimiter):]
+		}
+	}
+	return specialUseNames[strings.ToLower(name)]
+}
+
+// specialUse returns the role of a folder seen by the last folder listing.
+func (w *Worker) specialUse(folder string) string {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if su, ok := w.folderUse[folder]; ok {
+		return su
+	}
+	return specialUseOf(&imap.MailboxInfo{Name: folder, Delimiter: "/"})
+}
+
+// excludedUse reports whether a folder's role is in ExcludeSpecialUse,
+// which may name roles with or without the leading backslash.
+func (w *Worker) excludedUse(su string) bool {
+	if len(su) == 0 {
+		return false
+	}
+	for _, x := range w.ExcludeSpecialUse {
+		if strings.EqualFold(strings.TrimPrefix(x, `\`), su[1:]) {
+			return true
+		}
+	}
+	return false
+}
+
+// listSpecialUse is LIST with RETURN (SPECIAL-USE) from RFC 5258 and 6154,
+// for servers that only report roles when asked.
+type listSpecialUse struct {
+	ref, name string
+}
+
+func (cmd listSpecialUse) Command() *imap.Command {
+	enc := utf7.Encoding.NewEncoder()
+	ref, _ := enc.String(cmd.ref)
+	name, _ := enc.String(cmd.name)
+	return &imap.Command{
+		Name:      "LIST",
+		Arguments: []interface{}{ref, name, imap.RawString("RETURN"), []interface{}{imap.RawString("SPECIAL-USE")}},
+	}
+}
+
+// listMailboxes is c.List, asking for folder roles where the server
+// supports it.
+func listMailboxes(c *client.Client, ref, name string, ch chan *imap.MailboxInfo) error {
+	ext, _ := c.Support("LIST-EXTENDED")
+	su, _ := c.Support("SPECIAL-USE")
+	if !ext || !su {
+		return c.List(ref, name, ch)
+	}
+	defer close(ch)
+	status, err := c.Execute(listSpecialUse{ref: ref, name: name}, &responses.List{Mailboxes: ch})
+	if err != nil {
+		return err
+	}
+	return status.Err()
+}
@@ -0,0 +1,74 @@
+package list
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// stateFile records per-folder sync progress in the root of the store.
+const stateFile = ".imapdown-state.json"
+
+type folderState struct {
+	UIDValidity uint32
+	LastUID     uint32 // Highest UID already present in the store.
+
+	// UIDNext and Messages are from when the folder was last processed to
+	// the end, and zero after a partial run. See Worker.OnlyNewFolders.
+	UIDNext  uint32 `json:",omitempty"`
+	Messages uint32 `json:",omitempty"`
+}
+
+type syncState struct {
+	Folders map[string]*folderState
+}
+
+func loadState(store string) (*syncState, error) {
+	s := &syncState{
+		Folders: map[string]*folderState{},
+	}
+	b, err := os.ReadFile(filepath.Join(store, stateFile))
+	if errors.Is(err, os.ErrNotExist) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("read state: %w", err)
+	}
+	if err := json.Unmarshal(b, s); err != nil {
+		return nil, fmt.Errorf("parse state: %w", err)
+	}
+	if s.Folders == nil {
+		s.Folders = map[string]*folderState{}
+	}
+	return s, nil
+}
+
+func (s *syncState) save(store string, mode os.FileMode) error {
+	b, err := json.MarshalIndent(s, "", "\t")
+	if err != nil {
+		return err
+	}
+	fn := filepath.Join(store, stateFile)
+	tmp := fn + ".tmp"
+	if err := writeFile(tmp, b, mode); err != nil {
+		return fmt.Errorf("write state: %w", err)
+	}
+	if err := os.Rename(tmp, fn); err != nil {
+		return fmt.Errorf("write state: %w", err)
+	}
+	return nil
+}
+
+// folder returns the recorded state for a folder, or a zero state.
+func (s *syncState) folder(name string) folderState {
+	if fs, ok := s.Folders[name]; ok {
+		return *fs
+	}
+	return folderState{}
+}
+
+func (s *syncState) setFolder(name string, fs folderState) {
+	s.Folders[name] = &fs
+}
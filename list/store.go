@@ -0,0 +1,284 @@
+package list
+
+import (
+	"bufio"
+	"encoding/base32"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/emersion/go-imap"
+
+	"golang.org/x/crypto/blake2b"
+)
+
+// Store layouts for Worker.Layout.
+const (
+	LayoutFlat   = "flat"   // All messages directly in Store.
+	LayoutFolder = "folder" // Messages in Store/<folder-dir>/.
+)
+
+// Store formats for Worker.Format.
+const (
+	FormatNative  = "native"  // Versioned JSON header, then the raw message.
+	FormatMaildir = "maildir" // Maildir per folder, readable by mail clients.
+	FormatMbox    = "mbox"    // One appended mbox file per folder.
+	FormatEML     = "eml"     // Raw <key>.eml with the header in <key>.json.
+	FormatCAS     = "cas"     // Native header files, bodies in objects/ by hash.
+)
+
+// folderPath returns the directory messages from folder are written to.
+func (w *Worker) folderPath(folder string) string {
+	if w.Format == FormatMbox {
+		return w.Store
+	}
+	if w.Layout == LayoutFolder || w.Format == FormatMaildir {
+		return filepath.Join(w.Store, folderDir(folder))
+	}
+	return w.Store
+}
+
+// folderDir returns a directory name for a mailbox. The readable slug may
+// collide ("a/b" and "a.b") so a short hash of the full name is appended.
+func folderDir(name string) string {
+	const maxSlug = 60
+
+	b := &strings.Builder{}
+	dash := false
+	n := 0
+	for _, r := range name {
+		if n >= maxSlug {
+			break
+		}
+		switch {
+		case unicode.IsLetter(r) || unicode.IsDigit(r) || r == '_' || r == '.':
+			b.WriteRune(r)
+			dash = false
+		default:
+			if dash {
+				continue
+			}
+			b.WriteByte('-')
+			dash = true
+		}
+		n++
+	}
+	slug := strings.Trim(b.String(), "-.")
+	if len(slug) == 0 {
+		slug = "folder"
+	}
+	sum := blake2b.Sum256([]byte(name))
+	short := strings.ToLower(base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(sum[:5]))
+	return slug + "_" + short
+}
+
+// existsFunc returns a func that reports whether a message key from folder
+// is already stored in dir.
+func (w *Worker) existsFunc(dir, folder string) (func(key string) (bool, error), error) {
+	if w.Sink != nil {
+		return func(key string) (bool, error) {
+			return w.sinkSeen(key), nil
+		}, nil
+	}
+	switch w.Format {
+	case FormatEML:
+		return func(key string) (bool, error) {
+			return emlExists(dir, key)
+		}, nil
+	default:
+		return func(key string) (bool, error) {
+			// Check every form so toggling Compress or Encrypt does not
+			// re-download.
+			for _, name := range storedNames(key) {
+				if w.Backend != nil {
+					bk, err := w.backendKey(dir, name)
+					if err != nil {
+						return false, err
+					}
+					ok, err := w.Backend.Exists(bk)
+					if ok || err != nil {
+						return ok, err
+					}
+					continue
+				}
+				_, err := os.Stat(filepath.Join(dir, name))
+				if err == nil {
+					return true, nil
+				}
+				if !os.IsNotExist(err) {
+					return false, err
+				}
+			}
+			return false, nil
+		}, nil
+	case FormatMaildir, FormatMbox:
+		var keys map[string]bool
+		var err error
+		if w.Format == FormatMaildir {
+			keys, err = maildirKeys(dir)
+		} else {
+			keys, err = mboxKeys(mboxPath(dir, folder))
+		}
+		if err != nil {
+			return nil, err
+		}
+		return func(key string) (bool, error) {
+			return keys[key], nil
+		}, nil
+	}
+}
+
+// writeMessage stores a fetched message in dir in the configured format.
+func (w *Worker) writeMessage(dir string, h *Header, msg *imap.Message, body io.Reader, hasher hash.Hash) error {
+	if w.Sink != nil {
+		return w.writeSink(h, body, hasher)
+	}
+	switch w.Format {
+	default:
+		return w.writeNative(dir, h, messageDate(msg), body, hasher)
+	case FormatEML:
+		return w.writeEML(dir, h, messageDate(msg), body, hasher)
+	case FormatMaildir:
+		return w.writeMaildir(dir, h, msg, body)
+	case FormatMbox:
+		return w.writeMbox(dir, h, msg, body)
+	}
+}
+
+// gzSuffix marks a native message file that is gzip compressed as a whole.
+const gzSuffix = ".gz"
+
+// setModTime sets the modification time of a message file to its date so
+// the store sorts by time. A zero date leaves the file time alone.
+func (w *Worker) setModTime(path, key string, date time.Time) error {
+	if date.IsZero() {
+		w.print("Warning: message %s has no date, file time not set", key)
+		return nil
+	}
+	return os.Chtimes(path, date, date)
+}
+
+// writeNative writes h and body to dir/h.Key, filling in the body Size and
+// Hash, and sets the file time to date. The body is spooled first, as the
+// header holding its hash comes before it.
+//
+// The file is renamed into place once complete and synced, so an
+// interrupted write never looks downloaded; sweepTemp removes what it
+// leaves behind.
+func (w *Worker) writeNative(dir string, h *Header, date time.Time, body io.Reader, hasher hash.Hash) error {
+	spool, err := os.CreateTemp(dir, ".body-*.tmp")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		spool.Close()
+		os.Remove(spool.Name())
+	}()
+
+	if err := w.copyBody(spool, body, h, hasher); err != nil {
+		return fmt.Errorf("spool body: %w", err)
+	}
+	if w.StoreRawHeaders {
+		if _, err := spool.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+		h.RawHeader, err = readRawHeader(spool)
+		if err != nil {
+			return fmt.Errorf("raw header: %w", err)
+		}
+	}
+	if w.ExtractAttachments {
+		if _, err := spool.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+		h.Attachments, err = w.extractAttachments(h.Key, spool)
+		if err != nil {
+			return err
+		}
+	}
+	if w.ExtractText {
+		if _, err := spool.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+		if err := w.writeText(dir, h.Key, spool); err != nil {
+			return fmt.Errorf("text: %w", err)
+		}
+	}
+	if w.DedupeByContent {
+		orig, ok, err := w.contentOriginal(h)
+		if err != nil {
+			return fmt.Errorf("dedupe: %w", err)
+		}
+		if ok {
+			w.log("\tduplicate %s of %s", h.Key, orig)
+			h.DuplicateOf = orig
+		}
+	}
+	if w.Format == FormatCAS {
+		if err := w.writeObject(spool, h); err != nil {
+			return err
+		}
+	}
+	if _, err := spool.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	f, err := os.CreateTemp(dir, h.Key+".*.tmp")
+	if err != nil {
+		return err
+	}
+	tmpName := f.Name()
+	ok := false
+	defer func() {
+		if !ok {
+			f.Close()
+			os.Remove(tmpName)
+		}
+	}()
+	if err := f.Chmod(w.fileMode()); err != nil {
+		return err
+	}
+
+	bw := bufio.NewWriter(f)
+	out, err := w.storedWriter(bw, h.Key+w.nativeSuffix())
+	if err != nil {
+		return err
+	}
+	if err := writeHeader(out, h); err != nil {
+		return err
+	}
+	if len(h.DuplicateOf) == 0 && len(h.Object) == 0 {
+		if _, err := io.Copy(out, spool); err != nil {
+			return fmt.Errorf("body copy: %w", err)
+		}
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+	if err := bw.Flush(); err != nil {
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := w.setModTime(tmpName, h.Key, date); err != nil {
+		return err
+	}
+	final := h.Key + w.nativeSuffix()
+	if w.Backend != nil {
+		return w.writeBackend(dir, final, tmpName)
+	}
+	if err := os.Rename(tmpName, filepath.Join(dir, final)); err != nil {
+		return err
+	}
+	ok = true
+	return nil
+}
@@ -0,0 +1,83 @@
+package list
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/emersion/go-imap/backend/memory"
+)
+
+// dotDelimiter makes test servers started after it use "." as the
+// hierarchy delimiter, as Courier and Cyrus do.
+func dotDelimiter(t *testing.T) {
+	old := memory.Delimiter
+	memory.Delimiter = "."
+	t.Cleanup(func() { memory.Delimiter = old })
+}
+
+func TestFolderPathDotDelimiter(t *testing.T) {
+	w := New("store", WithLayout(LayoutFolder))
+	dir := w.folderPath("INBOX.Sub.Child")
+	if filepath.Dir(dir) != "store" || !strings.HasPrefix(filepath.Base(dir), "INBOX.Sub.Child_") {
+		t.Fatalf("INBOX.Sub.Child stored in %s", dir)
+	}
+	for _, other := range []string{"INBOX/Sub/Child", "INBOX.Sub", "INBOX.Sub.Child."} {
+		if w.folderPath(other) == dir {
+			t.Errorf("%s stored in the same directory as INBOX.Sub.Child", other)
+		}
+	}
+	if got := New("store").folderPath("INBOX.Sub.Child"); got != "store" {
+		t.Errorf("flat layout stores INBOX.Sub.Child in %s", got)
+	}
+}
+
+func TestDotDelimiterRoundTrip(t *testing.T) {
+	dotDelimiter(t)
+	addr := testServer(t)
+	testAppend(t, addr, "INBOX.Sub", 1)
+	testAppend(t, addr, "INBOX.Sub.Child", 2)
+	testAppend(t, addr, "INBOX2", 1)
+
+	w := testWorker(t, WithLayout(LayoutFolder), WithRootFolder("INBOX.Sub"))
+	sum, err := w.List(context.Background(), addr, "username", "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sum.Folders != 2 || sum.Fetched != 3 {
+		t.Fatalf("processed %d folders, fetched %d, want 2 and 3", sum.Folders, sum.Fetched)
+	}
+	hs, _, err := w.readIndex()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var folders []string
+	for _, h := range hs {
+		folders = append(folders, h.Folder)
+		if _, err := os.Stat(filepath.Join(w.folderPath(h.Folder), h.Key)); err != nil {
+			t.Errorf("%s: %v", h.Folder, err)
+		}
+	}
+	sort.Strings(folders)
+	if got := strings.Join(folders, " "); got != "INBOX.Sub INBOX.Sub.Child INBOX.Sub.Child" {
+		t.Fatalf("stored folders %s", got)
+	}
+
+	to := testServer(t)
+	if err := w.Restore(context.Background(), to, "username", "password"); err != nil {
+		t.Fatal(err)
+	}
+	c := testConnect(t, to)
+	for name, want := range map[string]uint32{"INBOX.Sub": 1, "INBOX.Sub.Child": 2} {
+		st, err := c.Select(name, true)
+		if err != nil {
+			t.Fatalf("select %s: %v", name, err)
+		}
+		if st.Messages != want {
+			t.Errorf("%s: %d messages restored, want %d", name, st.Messages, want)
+		}
+	}
+}
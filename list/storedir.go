@@ -0,0 +1,46 @@
+package list
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// prepareStore makes Store an absolute path to a writable directory,
+// creating it if needed. A dry run only checks it, and does not create it.
+func (w *Worker) prepareStore() error {
+	if len(w.Store) == 0 {
+		return fmt.Errorf("store: no directory set")
+	}
+	abs, err := filepath.Abs(w.Store)
+	if err != nil {
+		return fmt.Errorf("store %s: %w", w.Store, err)
+	}
+	w.Store = abs
+
+	fi, err := os.Stat(abs)
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+		if w.DryRun {
+			return nil
+		}
+		if err := w.mkdirAll(abs); err != nil {
+			return fmt.Errorf("store %s: create directory: %w", abs, err)
+		}
+	case err != nil:
+		return fmt.Errorf("store %s: %w", abs, err)
+	case !fi.IsDir():
+		return fmt.Errorf("store %s exists but is not a directory; choose a directory path", abs)
+	}
+	if w.DryRun {
+		return nil
+	}
+	probe, err := os.CreateTemp(abs, ".probe-*.tmp")
+	if err != nil {
+		return fmt.Errorf("store %s is not writable; check its permissions: %w", abs, err)
+	}
+	probe.Close()
+	os.Remove(probe.Name())
+	return nil
+}
@@ -0,0 +1,116 @@
+package list
+
+import (
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"time"
+)
+
+// summaryFile is written to the store root when Worker.WriteSummary is set.
+const summaryFile = ".imapdown-summary.json"
+
+// RunSummary counts the work done by one List run. A run that fails part
+// way still reports what it completed.
+type RunSummary struct {
+	Start       time.Time
+	End         time.Time
+	Folders     int   // Folders scanned.
+	New         int   // Messages not yet in the store.
+	NewBytes    int64 // Server reported size of the new messages.
+	Fetched     int   // Messages downloaded and written.
+	Skipped     int   // Messages already in the store.
+	SizeSkipped int   // Messages recorded without a body for their size.
+	Unattached  int   // Messages recorded without a body for lacking an attachment.
+	Bytes       int64 // Body bytes written.
+	Trashed     int   // Files moved to the trash by Mirror.
+	Moved       int   // Messages copied from another folder by DetectMoves.
+	Changed     int   // Stored messages rewritten by ReHashExisting.
+	Errors      []string
+	Quotas      []Quota // Quota roots reported at the start of the run.
+	Limited     bool    // Stopped early by MaxFolders or MaxMessages.
+}
+
+func (s RunSummary) String() string {
+	str := fmt.Sprintf("folders=%d new=%d fetched=%d skipped=%d size-skipped=%d no-attachment=%d bytes=%d trashed=%d moved=%d changed=%d errors=%d duration=%v",
+		s.Folders, s.New, s.Fetched, s.Skipped, s.SizeSkipped, s.Unattached, s.Bytes, s.Trashed, s.Moved, s.Changed, len(s.Errors), s.End.Sub(s.Start).Round(time.Millisecond))
+	for _, q := range s.Quotas {
+		str += fmt.Sprintf(" quota=%v", q)
+	}
+	if s.Limited {
+		str += " limited"
+	}
+	return str
+}
+
+func (w *Worker) snapshotSummary() RunSummary {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	s := w.summary
+	s.Errors = append([]string(nil), s.Errors...)
+	s.Quotas = append([]Quota(nil), s.Quotas...)
+	return s
+}
+
+func (w *Worker) addSummary(f func(s *RunSummary)) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	f(&w.summary)
+}
+
+// takeMessage counts a message against MaxMessages, reporting false once
+// none are left.
+func (w *Worker) takeMessage() bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.msgBudget <= 0 {
+		return false
+	}
+	w.msgBudget--
+	return true
+}
+
+// returnMessages gives back n messages taken with takeMessage that were not
+// downloaded.
+func (w *Worker) returnMessages(n int) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.msgBudget += n
+}
+
+func (w *Worker) messagesLeft() int {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.msgBudget
+}
+
+func (w *Worker) startSummary() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.summary = RunSummary{Start: time.Now()}
+}
+
+// finishSummary completes the summary and writes it if configured. The
+// run error is recorded if no folder error already was.
+func (w *Worker) finishSummary(runErr error) error {
+	w.mu.Lock()
+	w.summary.End = time.Now()
+	if runErr != nil && len(w.summary.Errors) == 0 {
+		w.summary.Errors = append(w.summary.Errors, runErr.Error())
+	}
+	s := w.summary
+	w.mu.Unlock()
+
+	if !w.WriteSummary {
+		return nil
+	}
+	b, err := json.MarshalIndent(s, "", "\t")
+	if err != nil {
+		return err
+	}
+	err = writeFile(filepath.Join(w.Store, summaryFile), b, w.fileMode())
+	if err != nil {
+		return fmt.Errorf("write summary: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,74 @@
+package list
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"time"
+)
+
+// tempName and maildirTemp match the names of the temporary files a Worker writes:
+// os.CreateTemp names such as "<key>.123.tmp" and ".body-123.tmp", and
+// maildir deliveries "<key>.1" in tmp.
+var (
+	tempName    = regexp.MustCompile(`^(\.(attach|body|probe)-|.+\.)[0-9]+\.tmp$`)
+	maildirTemp = regexp.MustCompile(`^[^.]+\.[0-9]+$`)
+)
+
+// sweepAge is how long a temporary file must be left untouched before
+// sweepTemp takes it for the leftover of a killed run rather than one
+// still being written, such as by another run on the same store.
+const sweepAge = time.Hour
+
+// sweepTemp removes temporary files left by a run that was killed, such as
+// unfinished message, index, and state files, and maildir deliveries still
+// in tmp. Files are only renamed into place once complete, so none of them
+// hold a stored message. Only names a Worker writes are removed, and only
+// once they are older than sweepAge.
+func (w *Worker) sweepTemp() error {
+	n := 0
+	old := time.Now().Add(-sweepAge)
+	err := filepath.WalkDir(w.Store, func(path string, d fs.DirEntry, err error) error {
+		if errors.Is(err, os.ErrNotExist) && path == w.Store {
+			return filepath.SkipDir
+		}
+		if err != nil {
+			return err
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		name := d.Name()
+		switch {
+		case w.Format == FormatMaildir && filepath.Base(filepath.Dir(path)) == "tmp":
+			if !maildirTemp.MatchString(name) {
+				return nil
+			}
+		case filepath.Dir(path) == filepath.Clean(w.Store) && (name == stateFile+".tmp" || name == lastRunFile+".tmp"):
+		case !tempName.MatchString(name):
+			return nil
+		}
+		fi, err := d.Info()
+		if err != nil {
+			return err
+		}
+		if fi.ModTime().After(old) {
+			return nil
+		}
+		if err := os.Remove(path); err != nil {
+			return err
+		}
+		n++
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("sweep: %w", err)
+	}
+	if n > 0 {
+		w.log("Removed %d unfinished temporary files", n)
+	}
+	return nil
+}
@@ -0,0 +1,59 @@
+package list
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestSweepTemp(t *testing.T) {
+	w := testWorker(t, WithDryRun(true))
+	stale := time.Now().Add(-2 * sweepAge)
+	write := func(name string, mod time.Time) string {
+		p := filepath.Join(w.Store, name)
+		if err := os.MkdirAll(filepath.Dir(p), 0o700); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, []byte("x"), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(p, mod, mod); err != nil {
+			t.Fatal(err)
+		}
+		return p
+	}
+	gone := []string{
+		write(filepath.Join("INBOX", "abc.123.tmp"), stale),
+		write(filepath.Join("INBOX", ".body-456.tmp"), stale),
+		write(stateFile+".tmp", stale),
+	}
+	kept := []string{
+		write(filepath.Join("INBOX", "notes.tmp"), stale),
+		write(filepath.Join("INBOX", "abc.789.tmp"), time.Now()),
+	}
+
+	if _, err := w.List(context.Background(), testServer(t), "username", "password"); err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range append(gone, kept...) {
+		if _, err := os.Stat(p); err != nil {
+			t.Errorf("dry run: %v", err)
+		}
+	}
+
+	if err := w.sweepTemp(); err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range gone {
+		if _, err := os.Stat(p); !os.IsNotExist(err) {
+			t.Errorf("%s not removed: %v", p, err)
+		}
+	}
+	for _, p := range kept {
+		if _, err := os.Stat(p); err != nil {
+			t.Errorf("removed: %v", err)
+		}
+	}
+}
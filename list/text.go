@@ -0,0 +1,176 @@
+package list
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"unicode"
+
+	"github.com/emersion/go-message"
+	"github.com/emersion/go-message/mail"
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+// textSuffix marks the plain text of a message written by ExtractText, next
+// to its message file.
+const textSuffix = ".txt"
+
+func (w *Worker) checkText() error {
+	if !w.ExtractText {
+		return nil
+	}
+	switch {
+	case !w.headerFiles():
+		return fmt.Errorf("text can only be extracted with the %s and %s formats", FormatNative, FormatCAS)
+	case w.Backend != nil || w.Sink != nil:
+		return fmt.Errorf("text can only be extracted to the Store directory")
+	case len(w.Encrypt) > 0:
+		return fmt.Errorf("encryption can't be used with ExtractText, which stores the text in the clear")
+	}
+	return nil
+}
+
+// writeText writes the text of the message read from r to dir/key.txt. A
+// message that can't be parsed is logged, and one without text writes
+// nothing.
+func (w *Worker) writeText(dir, key string, r io.Reader) error {
+	text, err := extractText(r)
+	if err != nil {
+		w.log("\t%s: text: %v", key, err)
+		return nil
+	}
+	if len(text) == 0 {
+		return nil
+	}
+	tmp, err := writeTemp(dir, key, w.fileMode(), func(f *os.File) error {
+		_, err := io.WriteString(f, text)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, filepath.Join(dir, key+textSuffix)); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return nil
+}
+
+// extractText returns the text of the message read from r: its text/plain
+// parts, or if it has none the text of its text/html parts, decoded from
+// their transfer encoding and charset. Attachments are left out. Of a
+// multipart/alternative this is the text/plain part.
+func extractText(r io.Reader) (string, error) {
+	mr, err := mail.CreateReader(r)
+	if err != nil && !message.IsUnknownCharset(err) {
+		return "", err
+	}
+	var plain, rich []string
+	for {
+		p, err := mr.NextPart()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil && !message.IsUnknownCharset(err) && !message.IsUnknownEncoding(err) {
+			return "", err
+		}
+		var h message.Header
+		switch ph := p.Header.(type) {
+		case *mail.InlineHeader:
+			h = ph.Header
+		case *mail.AttachmentHeader:
+			h = ph.Header
+		}
+		if disp, _, _ := h.ContentDisposition(); disp == "attachment" {
+			continue
+		}
+		t, _, _ := h.ContentType()
+		if len(t) == 0 && len(h.Get("Content-Type")) == 0 {
+			// RFC 2045 5.2.
+			t = "text/plain"
+		}
+		if t != "text/plain" && t != "text/html" {
+			continue
+		}
+		b, err := io.ReadAll(p.Body)
+		if err != nil {
+			return "", err
+		}
+		if t == "text/plain" {
+			plain = append(plain, string(b))
+		} else {
+			rich = append(rich, htmlText(b))
+		}
+	}
+	if len(plain) == 0 {
+		plain = rich
+	}
+	return tidyText(strings.Join(plain, "\n")), nil
+}
+
+// htmlText returns the text of an HTML document, with a line break for each
+// block and other runs of white space as one space. Scripts and styles are
+// dropped.
+func htmlText(b []byte) string {
+	z := html.NewTokenizer(bytes.NewReader(b))
+	sb := &strings.Builder{}
+	skip := 0
+	for {
+		tt := z.Next()
+		switch tt {
+		case html.ErrorToken:
+			lines := strings.Split(sb.String(), "\n")
+			for i := range lines {
+				lines[i] = strings.TrimSpace(lines[i])
+			}
+			return strings.Join(lines, "\n")
+		case html.TextToken:
+			if skip == 0 {
+				sb.WriteString(spaces.ReplaceAllString(string(z.Text()), " "))
+			}
+		case html.StartTagToken, html.EndTagToken, html.SelfClosingTagToken:
+			name, _ := z.TagName()
+			switch atom.Lookup(name) {
+			case atom.Script, atom.Style, atom.Head:
+				switch {
+				case tt == html.StartTagToken:
+					skip++
+				case tt == html.EndTagToken && skip > 0:
+					skip--
+				}
+			case atom.Br, atom.P, atom.Div, atom.Tr, atom.Li, atom.Table, atom.Blockquote,
+				atom.H1, atom.H2, atom.H3, atom.H4, atom.H5, atom.H6, atom.Hr, atom.Pre:
+				sb.WriteString("\n")
+			}
+		}
+	}
+}
+
+var spaces = regexp.MustCompile(`\s+`)
+
+// tidyText drops the trailing white space of each line of s, and leading
+// and repeated empty lines. The result ends with a newline unless empty.
+func tidyText(s string) string {
+	sb := &strings.Builder{}
+	blank := false
+	for _, line := range strings.Split(strings.ReplaceAll(s, "\r\n", "\n"), "\n") {
+		line = strings.TrimRightFunc(line, unicode.IsSpace)
+		if len(line) == 0 {
+			blank = sb.Len() > 0
+			continue
+		}
+		if blank {
+			sb.WriteString("\n")
+			blank = false
+		}
+		sb.WriteString(line)
+		sb.WriteString("\n")
+	}
+	return sb.String()
+}
@@ -0,0 +1,43 @@
+package list
+
+import (
+	"context"
+	"net"
+
+	"golang.org/x/time/rate"
+)
+
+// throttleBurst is the most read from a throttled connection at once.
+const throttleBurst = 32 * 1024
+
+// limiter returns the rate limiter shared by every connection of the
+// worker, or nil when MaxBytesPerSec is unset.
+func (w *Worker) limiter() *rate.Limiter {
+	if w.MaxBytesPerSec <= 0 {
+		return nil
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.rate == nil || w.rate.Limit() != rate.Limit(w.MaxBytesPerSec) {
+		w.rate = rate.NewLimiter(rate.Limit(w.MaxBytesPerSec), throttleBurst)
+	}
+	return w.rate
+}
+
+// throttledConn limits the rate data is read from the server. Bytes are
+// counted on the wire, so after TLS and compression.
+type throttledConn struct {
+	net.Conn
+	l *rate.Limiter
+}
+
+func (c *throttledConn) Read(p []byte) (int, error) {
+	if len(p) > throttleBurst {
+		p = p[:throttleBurst]
+	}
+	n, err := c.Conn.Read(p)
+	if n > 0 {
+		c.l.WaitN(context.Background(), n)
+	}
+	return n, err
+}
@@ -0,0 +1,138 @@
+package list
+
+import (
+	"context"
+	"fmt"
+	"mime"
+	"strings"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/client"
+	"github.com/emersion/go-imap/commands"
+	"github.com/emersion/go-imap/responses"
+	"github.com/emersion/go-message/charset"
+)
+
+// utf8Accept is the RFC 6855 capability letting the server send envelopes
+// in UTF-8 rather than in the charset of the message.
+const utf8Accept = "UTF8=ACCEPT"
+
+type enableCmd struct {
+	caps []string
+}
+
+func (cmd enableCmd) Command() *imap.Command {
+	args := make([]interface{}, len(cmd.caps))
+	for i, c := range cmd.caps {
+		args[i] = imap.RawString(c)
+	}
+	return &imap.Command{
+		Name:      "ENABLE",
+		Arguments: args,
+	}
+}
+
+// enableUTF8 issues ENABLE UTF8=ACCEPT on c where the server supports it.
+// It must come before any folder is selected. The server then also sends
+// folder names in UTF-8, which go-imap can't parse, so c must not LIST
+// afterwards, and STATUS goes through folderStatus. A failure is logged and
+// the connection used as is.
+func (w *Worker) enableUTF8(c *client.Client) {
+	if c.State() != imap.AuthenticatedState {
+		return
+	}
+	if ok, _ := c.Support(utf8Accept); !ok {
+		return
+	}
+	status, err := c.Execute(enableCmd{caps: []string{utf8Accept}}, nil)
+	if err == nil {
+		err = status.Err()
+	}
+	if err != nil {
+		w.log("Enable %s: %v", utf8Accept, err)
+		return
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.utf8Conns == nil {
+		w.utf8Conns = map[*client.Client]bool{}
+	}
+	w.utf8Conns[c] = true
+}
+
+// utf8Conn reports whether enableUTF8 enabled UTF8=ACCEPT on c.
+func (w *Worker) utf8Conn(c *client.Client) bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.utf8Conns[c]
+}
+
+// forgetUTF8 drops c, which is done with, from those enableUTF8 enabled.
+func (w *Worker) forgetUTF8(c *client.Client) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	delete(w.utf8Conns, c)
+}
+
+// folderStatus is c.Status, or if c has UTF8=ACCEPT enabled, STATUS over a
+// second connection from statusDial that has not. It is opened on first use
+// and shared until closeStatusConn.
+func (w *Worker) folderStatus(ctx context.Context, c *client.Client, name string, items []imap.StatusItem) (*imap.MailboxStatus, error) {
+	if !w.utf8Conn(c) {
+		return c.Status(name, items)
+	}
+	w.statusMu.Lock()
+	defer w.statusMu.Unlock()
+	if w.statusC == nil || w.statusC.State() == imap.LogoutState {
+		if w.statusDial == nil {
+			return nil, fmt.Errorf("no connection to send STATUS over")
+		}
+		sc, err := w.statusDial(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("status connection: %w", err)
+		}
+		w.statusC = sc
+	}
+	return w.statusC.Status(name, items)
+}
+
+// closeStatusConn logs out of the connection of folderStatus, if open.
+func (w *Worker) closeStatusConn() {
+	w.statusMu.Lock()
+	defer w.statusMu.Unlock()
+	if w.statusC != nil && w.statusC.State() != imap.LogoutState {
+		w.statusC.Logout()
+	}
+	w.statusC = nil
+}
+
+// uidSearch is c.UidSearch without the CHARSET go-imap always sends, which
+// RFC 6855 forbids once UTF8=ACCEPT is enabled. The criteria iter sends
+// hold no strings, so the default US-ASCII is right either way.
+func uidSearch(c *client.Client, criteria *imap.SearchCriteria) ([]uint32, error) {
+	res := &responses.Search{}
+	status, err := c.Execute(&commands.Uid{Cmd: &commands.Search{Criteria: criteria}}, res)
+	if err != nil {
+		return nil, err
+	}
+	if err := status.Err(); err != nil {
+		return nil, err
+	}
+	return res.Ids, nil
+}
+
+var wordDecoder = &mime.WordDecoder{CharsetReader: charset.Reader}
+
+// decodeWords decodes the RFC 2047 encoded-words in an envelope field.
+// go-imap already decodes UTF-8 and Latin-1 words; this handles the other
+// charsets, such as ISO-2022-JP. A field that can't be decoded is kept.
+func decodeWords(s string) string {
+	if !strings.Contains(s, "=?") {
+		return s
+	}
+	dec, err := wordDecoder.DecodeHeader(s)
+	if err != nil {
+		return s
+	}
+	return dec
+}
@@ -0,0 +1,58 @@
+package list
+
+import (
+	"context"
+	"testing"
+)
+
+var utf8Folders = []string{"日本語", "Entwürfe", "Größe/Übersicht"}
+
+func TestUTF8FolderRoundTrip(t *testing.T) {
+	addr := testServer(t)
+	for _, name := range utf8Folders {
+		testAppend(t, addr, name, 2)
+	}
+	p := newUTF8Proxy(t, addr)
+	w := testWorker(t, WithLayout(LayoutFolder))
+	sum, err := w.List(context.Background(), p.addr, "username", "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.enabled == 0 {
+		t.Fatalf("%s not enabled", utf8Accept)
+	}
+	if p.badCharset > 0 {
+		t.Fatalf("%d commands sent a CHARSET after %s", p.badCharset, utf8Accept)
+	}
+	if sum.Fetched != 1+2*len(utf8Folders) || len(sum.Errors) > 0 {
+		t.Fatalf("summary: %v %v", sum, sum.Errors)
+	}
+	hs, _, err := w.readIndex()
+	if err != nil {
+		t.Fatal(err)
+	}
+	count := map[string]int{}
+	for _, h := range hs {
+		count[h.Folder]++
+	}
+	for _, name := range utf8Folders {
+		if count[name] != 2 {
+			t.Errorf("%s: %d messages stored, want 2", name, count[name])
+		}
+	}
+
+	to := testServer(t)
+	if err := w.Restore(context.Background(), to, "username", "password"); err != nil {
+		t.Fatal(err)
+	}
+	c := testConnect(t, to)
+	for _, name := range utf8Folders {
+		st, err := c.Select(name, true)
+		if err != nil {
+			t.Fatalf("select %s: %v", name, err)
+		}
+		if st.Messages != 2 {
+			t.Errorf("%s: %d messages restored, want 2", name, st.Messages)
+		}
+	}
+}
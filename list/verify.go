@@ -0,0 +1,194 @@
+package list
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// walkStore calls fn with the path of every message file in the store.
+// Dot files such as the state file, temporary files, the index, the
+// manifest, and extracted attachments are skipped.
+func (w *Worker) walkStore(ctx context.Context, fn func(path string) error) error {
+	return filepath.WalkDir(w.Store, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		name := d.Name()
+		if d.IsDir() && (path == filepath.Join(w.Store, attachDir) || path == filepath.Join(w.Store, objectsDir)) {
+			return filepath.SkipDir
+		}
+		if path != w.Store && strings.HasPrefix(name, ".") {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if d.IsDir() || !d.Type().IsRegular() || strings.HasSuffix(name, ".tmp") || strings.HasSuffix(name, textSuffix) {
+			return nil
+		}
+		if path == filepath.Join(w.Store, indexFile) || path == filepath.Join(w.Store, manifestFile) {
+			return nil
+		}
+		return fn(path)
+	})
+}
+
+// Verify re-hashes the body of every stored message and compares it to the
+// Hash recorded in its header. Each mismatch is printed with the message
+// Key and Folder. The returned error is non-nil if any file failed.
+//
+// When the store has an index the files it lists are checked, including
+// whether any are missing; otherwise the store is walked.
+func (w *Worker) Verify(ctx context.Context) error {
+	if !w.headerFiles() {
+		return fmt.Errorf("verify only supports the %s and %s formats", FormatNative, FormatCAS)
+	}
+	var total, failed, unhashed int
+	check := func(path string) error {
+		total++
+		h, sum, err := w.verifyFile(path)
+		if err != nil {
+			failed++
+			w.print("FAIL %s: %v", path, err)
+			return nil
+		}
+		if h.Skipped {
+			w.log("skipped %s, no body stored", h.Key)
+			return nil
+		}
+		if len(h.DuplicateOf) > 0 {
+			orig, err := duplicatePath(w.Store, path, h.DuplicateOf)
+			if err == nil {
+				_, sum, err = w.verifyFile(orig)
+			}
+			if err != nil {
+				failed++
+				w.print("FAIL %s (folder %q): duplicate of %s: %v", h.Key, h.Folder, h.DuplicateOf, err)
+				return nil
+			}
+			if len(h.Hash) > 0 && !bytes.Equal(sum, h.Hash) {
+				failed++
+				w.print("FAIL %s (folder %q): duplicate of %s: hash mismatch", h.Key, h.Folder, h.DuplicateOf)
+				return nil
+			}
+			w.log("ok %s, duplicate of %s", h.Key, h.DuplicateOf)
+			return nil
+		}
+		if len(h.Hash) == 0 {
+			unhashed++
+			w.log("%s: no recorded hash", h.Key)
+			return nil
+		}
+		if !bytes.Equal(sum, h.Hash) {
+			failed++
+			w.print("FAIL %s (folder %q): hash mismatch", h.Key, h.Folder)
+			return nil
+		}
+		w.log("ok %s", h.Key)
+		return nil
+	}
+	hs, indexed, err := w.readIndex()
+	if err != nil {
+		return err
+	}
+	if indexed {
+		for i := range hs {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			path, err := w.storedPath(&hs[i])
+			if err != nil {
+				total++
+				failed++
+				w.print("FAIL %v", err)
+				continue
+			}
+			check(path)
+		}
+	} else if w.Backend != nil {
+		return fmt.Errorf("verify needs the index with a Backend")
+	} else {
+		err = w.walkStore(ctx, check)
+	}
+	if err != nil {
+		return err
+	}
+	w.log("verified %d files", total)
+	if unhashed > 0 {
+		w.print("%d files have no recorded hash and were not checked", unhashed)
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d files failed verification", failed, total)
+	}
+	return nil
+}
+
+// openStored opens a native message file, decrypting and decompressing it
+// if needed.
+func (w *Worker) openStored(path string) (io.ReadCloser, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	return w.decodeStored(f, path)
+}
+
+type gzipFile struct {
+	*gzip.Reader
+	f io.Closer
+}
+
+func (g *gzipFile) Close() error {
+	g.Reader.Close()
+	return g.f.Close()
+}
+
+// verifyFile returns the header of a native message file and the hash of
+// its body, using the header's HashAlgo. With a Backend path is its key.
+func (w *Worker) verifyFile(path string) (Header, []byte, error) {
+	var f io.ReadCloser
+	var err error
+	if w.Backend != nil {
+		f, err = w.openBackend(path)
+	} else {
+		f, err = w.openStored(path)
+	}
+	if err != nil {
+		return Header{}, nil, err
+	}
+	defer f.Close()
+
+	br := bufio.NewReader(f)
+	h, err := readHeader(br)
+	if err != nil || len(h.Hash) == 0 {
+		return h, nil, err
+	}
+	var r io.Reader = br
+	if len(h.Object) > 0 {
+		obj, err := w.openObject(path, h.Object)
+		if err != nil {
+			return h, nil, err
+		}
+		defer obj.Close()
+		r = obj
+	}
+	hasher, err := newHasher(h.HashAlgo)
+	if err != nil {
+		return h, nil, err
+	}
+	if _, err := io.Copy(hasher, r); err != nil {
+		return h, nil, fmt.Errorf("read body: %w", err)
+	}
+	return h, hasher.Sum(nil), nil
+}
@@ -0,0 +1,224 @@
+package list
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/emersion/go-imap"
+	idle "github.com/emersion/go-imap-idle"
+	"github.com/emersion/go-imap/client"
+)
+
+// idleRestart re-issues IDLE before the 29 minute limit after which servers
+// may drop an idle client (RFC 2177).
+const idleRestart = 25 * time.Minute
+
+// defaultWatchInterval is used when WatchInterval is unset.
+const defaultWatchInterval = time.Minute
+
+// Watch runs List, then stays connected and stores new messages as they
+// arrive until ctx is done. Each of WatchFolders, or INBOX if unset, is
+// watched over its own connection with IDLE, or checked every
+// WatchInterval if the server lacks it. A lost connection is re-established,
+// waiting longer after each failure; a rejected login ends the watch.
+//
+// Watch enables Incremental, so each wake-up only fetches envelopes of
+// messages newer than the last one stored.
+func (w *Worker) Watch(ctx context.Context, server, username, password string) error {
+	w.Incremental = true
+	sum, err := w.List(ctx, server, username, password)
+	if err != nil {
+		return err
+	}
+	w.print("%v", sum)
+
+	if err := w.openIndex(ctx); err != nil {
+		return err
+	}
+	defer w.closeIndex()
+	w.statusDial = func(ctx context.Context) (*client.Client, error) {
+		return w.connect(ctx, server, username, password)
+	}
+	defer func() {
+		w.closeStatusConn()
+		w.statusDial = nil
+	}()
+
+	folders := w.WatchFolders
+	if len(folders) == 0 {
+		folders = []string{"INBOX"}
+	}
+	errC := make(chan error, len(folders))
+	wg := &sync.WaitGroup{}
+	for _, name := range folders {
+		wg.Add(1)
+		go func(name string) {
+			defer wg.Done()
+			errC <- w.watchFolder(ctx, server, username, password, name)
+		}(name)
+	}
+	wg.Wait()
+	close(errC)
+	var errList []error
+	for err := range errC {
+		if err != nil && !errors.Is(err, context.Canceled) {
+			errList = append(errList, err)
+		}
+	}
+	return errors.Join(errList...)
+}
+
+// watchFolder keeps one folder in sync, reconnecting until ctx is done or
+// the login is rejected.
+func (w *Worker) watchFolder(ctx context.Context, server, username, password, name string) error {
+	delay := retryBase
+	for {
+		start := time.Now()
+		err := w.watchConn(ctx, server, username, password, name)
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if errors.Is(err, ErrAuth) {
+			return err
+		}
+		if time.Since(start) > retryMax {
+			// The connection worked for a while, start over.
+			delay = retryBase
+		}
+		w.print("Watch %s: %v; reconnect in %v", name, err, delay)
+		t := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			return ctx.Err()
+		case <-t.C:
+		}
+		delay *= 2
+		if delay > retryMax {
+			delay = retryMax
+		}
+	}
+}
+
+// watchConn syncs the folder on a new connection each time the server
+// reports a change, until the connection fails or ctx is done.
+func (w *Worker) watchConn(ctx context.Context, server, username, password, name string) error {
+	c, err := w.connect(ctx, server, username, password)
+	if err != nil {
+		return err
+	}
+	w.enableUTF8(c)
+	defer w.forgetUTF8(c)
+
+	// Updates must always be read or the client blocks; they are collapsed
+	// into a single pending change. The channel is unbuffered so an update
+	// is received before the command it came with returns, and a reset
+	// after a command clears what that command reported.
+	updates := make(chan client.Update)
+	changed := make(chan struct{}, 1)
+	reset := make(chan chan struct{})
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		for {
+			select {
+			case <-done:
+				return
+			case u := <-updates:
+				switch u.(type) {
+				case *client.MailboxUpdate, *client.ExpungeUpdate:
+					select {
+					case changed <- struct{}{}:
+					default:
+					}
+				}
+			case ack := <-reset:
+				select {
+				case <-changed:
+				default:
+				}
+				close(ack)
+			}
+		}
+	}()
+	c.Updates = updates
+	defer c.Logout()
+	clearChanged := func() {
+		ack := make(chan struct{})
+		reset <- ack
+		<-ack
+	}
+
+	ic := idle.NewClient(c)
+	ic.LogoutTimeout = idleRestart
+	canIdle, err := ic.SupportIdle()
+	if err != nil {
+		return err
+	}
+	poll := w.WatchInterval
+	if poll <= 0 {
+		poll = defaultWatchInterval
+	}
+	mi := &imap.MailboxInfo{Name: name}
+	for {
+		if err := w.iterFolder(ctx, c, mi); err != nil {
+			return err
+		}
+		// Every SELECT reports the message count, which is not a change.
+		// Select again to drop those, and sync again if mail arrived
+		// while the last sync ran.
+		next := c.Mailbox().UidNext
+		status, err := c.Select(name, true)
+		if err != nil {
+			return fmt.Errorf("select: %w", err)
+		}
+		clearChanged()
+		if status.UidNext != next {
+			continue
+		}
+
+		if !canIdle {
+			// Without IDLE many servers never report new mail on an
+			// existing connection, so check again from time to time.
+			t := time.NewTimer(poll)
+			select {
+			case <-ctx.Done():
+				t.Stop()
+				return ctx.Err()
+			case <-c.LoggedOut():
+				t.Stop()
+				return errors.New("disconnected")
+			case <-changed:
+				t.Stop()
+			case <-t.C:
+			}
+			continue
+		}
+		w.log("Watch %s: idle", name)
+		stop := make(chan struct{})
+		idleErr := make(chan error, 1)
+		go func() {
+			idleErr <- ic.Idle(stop)
+		}()
+		select {
+		case <-ctx.Done():
+			close(stop)
+			<-idleErr
+			return ctx.Err()
+		case err := <-idleErr:
+			close(stop)
+			if err == nil {
+				err = errors.New("idle ended")
+			}
+			return err
+		case <-changed:
+			close(stop)
+			if err := <-idleErr; err != nil {
+				return err
+			}
+		}
+	}
+}
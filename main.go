@@ -1,44 +1,578 @@
 package main
 
 import (
+	"bufio"
 	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"flag"
 	"fmt"
+	"io"
 	"log"
 	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"text/tabwriter"
 	"time"
 
 	"github.com/kardianos/imapdown/list"
-	"github.com/kardianos/task"
+	"golang.org/x/term"
 )
 
 func main() {
-	err := task.Start(context.Background(), time.Second*2, run)
+	ctx, stop := interruptContext()
+	defer stop()
+	err := run(ctx)
 	if err != nil {
 		log.Fatal(err)
 	}
 }
 
+// interruptContext returns a context that is cancelled on the first
+// interrupt, letting the run finish the message it is writing and log its
+// summary. A second interrupt exits at once.
+func interruptContext() (context.Context, func()) {
+	ctx, cancel := context.WithCancel(context.Background())
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		select {
+		case <-ctx.Done():
+			return
+		case <-sig:
+		}
+		log.Print("Interrupted, stopping after the current message; interrupt again to exit now")
+		cancel()
+		<-sig
+		log.Print("Interrupted again, exiting")
+		os.Exit(1)
+	}()
+	return ctx, func() {
+		signal.Stop(sig)
+		cancel()
+	}
+}
+
+// stringList is a flag that may be given more than once.
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(v string) error {
+	*l = append(*l, v)
+	return nil
+}
+
+const dateLayout = "2006-01-02"
+
+// parseMode parses octal permissions such as 0640.
+func parseMode(s string) (os.FileMode, error) {
+	m, err := strconv.ParseUint(s, 8, 32)
+	if err != nil {
+		return 0, err
+	}
+	return os.FileMode(m), nil
+}
+
 func run(ctx context.Context) error {
+	configFile := flag.String("config", "", "JSON file listing accounts to back up, each into a directory under -store")
 	h := flag.String("host", "", "imap host:port")
+	providerName := flag.String("provider", "", "fill in the host of a known service and print login advice: "+providerNames())
 	u := flag.String("user", "", "username")
-	p := flag.String("pass", "", "password")
+	p := flag.String("pass", "", "password, visible to other users; prefer the other -pass flags")
+	passFile := flag.String("pass-file", "", "file containing the password")
+	passEnv := flag.String("pass-env", "", "environment variable containing the password")
+	passStdin := flag.Bool("pass-stdin", false, "read the password from stdin, prompting if it is a terminal")
+	netrcFile := flag.String("netrc", "", "netrc file to look up the user and password for the host in, ~/.netrc if unset; flags override it")
+	layout := flag.String("layout", list.LayoutFlat, "store layout: flat, or folder for a sub-directory per mailbox")
+	format := flag.String("format", list.FormatNative, "store format: native, maildir, mbox, eml, or cas")
+	compression := flag.Bool("compress", false, "compress traffic if the server supports COMPRESS=DEFLATE, not with -tls starttls")
+	attachments := flag.Bool("attachments", false, "also store each attachment once in the attachments directory, native format only")
+	extractText := flag.Bool("extract-text", false, "also store the plain text of each message as <key>.txt, for searching bodies")
+	hashAlgo := flag.String("hash", list.HashBlake2b256, "body hash recorded in each header: blake2b256, sha256, or sha512_256")
+	skipHash := flag.Bool("skip-hash", false, "don't hash message bodies, faster but verify can't check them")
+	rawHeaders := flag.Bool("raw-headers", false, "also record the complete header block of each message in its JSON header, native and eml formats only")
+	rehash := flag.Bool("rehash", false, "download stored messages again and rewrite those whose body changed on the server, slow")
+	gz := flag.Bool("gz", false, "gzip compress stored message files")
+	incremental := flag.Bool("incremental", false, "only fetch messages newer than the last run, tracked per folder")
+	onlyNewFolders := flag.Bool("only-new-folders", false, "with -incremental, skip folders whose STATUS shows no message added or removed since the last run")
+	since := flag.String("since", "", "only fetch messages received on or after this date (2006-01-02)")
+	before := flag.String("before", "", "only fetch messages received before this date (2006-01-02)")
+	sinceLastRun := flag.Bool("since-last-run", false, "only fetch messages received since the last successful run, recorded in .last-run")
+	var only stringList
+	flag.Var(&only, "only", "only fetch messages with this flag state: unseen, seen, flagged, unflagged, answered, unanswered, may be repeated")
+	skipDeleted := flag.Bool("skip-deleted", false, "skip messages flagged \\Deleted but not yet expunged")
+	rootFolder := flag.String("root", "", "only back up this folder and the folders below it, such as INBOX")
+	var include, exclude stringList
+	flag.Var(&include, "include", "only back up folders matching this glob, may be repeated")
+	flag.Var(&exclude, "exclude", "skip folders matching this glob, may be repeated")
+	foldersFile := flag.String("folders-file", "", "only back up the folders in this file, one per line with optional since=, before=, max-size=, min-size= overrides")
+	var excludeUse stringList
+	flag.Var(&excludeUse, "exclude-special", "skip folders with this special-use role, such as trash or junk, may be repeated")
+	pruneEmpty := flag.Bool("prune-empty-folders", false, "check folders with STATUS and skip empty ones without selecting them")
+	allMail := flag.Bool("gmail-all-mail", false, "on Gmail only download All Mail and record labels")
+	concurrency := flag.Int("concurrency", 1, "number of connections used to process folders in parallel")
+	fetchConns := flag.Int("fetch-connections", 0, "extra connections per folder used to fetch message bodies in parallel")
+	maxRate := flag.Int64("max-rate", 0, "most bytes per second read from the server over all connections, 0 for no limit")
+	maxConns := flag.Int("max-connections", 10, "most connections open to the server at once")
+	folderTimeout := flag.Duration("folder-timeout", 0, "skip a folder that takes longer than this, 0 for no limit")
+	opTimeout := flag.Duration("op-timeout", 0, "fail an IMAP command that takes longer than this, 0 for no limit")
+	retries := flag.Int("retries", 3, "retry a folder or connection this many times after a network failure")
+	naming := flag.String("naming", "hash", "message file names: hash of the Message-ID, or date-subject")
+	keepalive := flag.Duration("keepalive", 0, "send NOOP after the connection is idle this long, 0 to disable")
+	batchSize := flag.Int("batch", 200, "number of message bodies to fetch per command")
+	envelopeWindow := flag.Int("envelope-window", 5000, "number of envelopes fetched and decided at a time")
+	mirror := flag.Bool("mirror", false, "move stored messages deleted on the server to .trash in the store, needs -layout folder or -format maildir")
+	writeManifest := flag.Bool("write-manifest", false, "write manifest.csv listing every stored message after the run")
+	writeSummary := flag.Bool("write-summary", false, "write a JSON run summary into the store")
+	markSeen := flag.Bool("mark-seen", false, "modify the server: mark downloaded messages as read, unread state is lost")
+	maxSize := flag.Int64("max-size", 0, "skip messages larger than this many bytes, recording only their header, 0 for no limit")
+	minSize := flag.Int64("min-size", 0, "skip messages smaller than this many bytes, recording only their header")
+	detectMoves := flag.Bool("detect-moves", false, "copy messages moved between folders from the store instead of downloading them")
+	dedupeContent := flag.Bool("dedupe-content", false, "store a body already in the store as a reference to the file holding it")
+	dedupeIDs := flag.Bool("dedupe-message-id", false, "fetch each Message-ID once across folders, accounts of -config, and runs, recorded in .message-ids.jsonl")
+	requireAttach := flag.Bool("require-attachment", false, "only download messages with attachments, recording only the header of the others")
+	limitFolders := flag.Int("limit-folders", 0, "stop after this many folders, 0 for no limit")
+	limitMessages := flag.Int("limit-messages", 0, "stop after downloading this many messages, 0 for no limit")
+	fileMode := flag.String("file-mode", "0600", "octal permissions of files written to the store")
+	dirMode := flag.String("dir-mode", "0700", "octal permissions of directories created in the store")
+	allowWorldWritable := flag.Bool("allow-world-writable", false, "allow -file-mode and -dir-mode to make the store writable by anyone")
+	encrypt := flag.String("encrypt", "", "encrypt stored messages, headers included, to this age recipient (age1...)")
+	plainIndex := flag.Bool("plain-index", false, "with -encrypt, keep message headers in the cleartext index so the store can be searched without the key")
+	keyFile := flag.String("key", "", "age identity file, as written by age-keygen, to read encrypted messages with")
+	jsonl := flag.String("jsonl", "", "write messages as JSON lines to this file, or - for standard output, instead of message files; the store keeps run state")
+	dryRun := flag.Bool("dry-run", false, "report new messages and sizes without downloading")
+	token := flag.String("token", "", "OAuth2 access token, uses XOAUTH2 instead of password login")
+	tokenFile := flag.String("token-file", "", "file containing an OAuth2 access token")
 	s := flag.String("store", "", "dir to store email in")
 	v := flag.Bool("verbose", false, "log events to std out")
+	logFormat := flag.String("log-format", list.LogText, "log format: text or json")
+	tlsMode := flag.String("tls", list.TLSImplicit, "connection security: implicit, starttls, or plain")
+	proxyURL := flag.String("proxy", proxyFromEnv(), "socks5:// or http:// proxy URL, defaults to ALL_PROXY or HTTPS_PROXY")
+	caFile := flag.String("ca-file", "", "PEM file of CA certificates to trust in addition to the system roots")
+	tlsSkipVerify := flag.Bool("tls-skip-verify", false, "do not verify the server certificate, insecure")
+	tlsServerName := flag.String("tls-server-name", "", "expected server certificate name, defaults to the host")
+	verify := flag.Bool("verify", false, "check stored bodies against their recorded hash, then exit")
+	var search stringList
+	flag.Var(&search, "search", "search the local store with key=value (from, subject, folder, since, before), may be repeated")
+	dedupe := flag.Bool("dedupe", false, "replace stored messages with the same body as another with a header pointing to it, then exit; never contacts the server")
+	dedupeRemove := flag.Bool("dedupe-remove", false, "with -dedupe, delete duplicates instead; they are downloaded again while still on the server")
+	manifest := flag.Bool("manifest", false, "write manifest.csv from the store, then exit")
+	rebuildIndex := flag.Bool("rebuild-index", false, "rewrite the store index from the message files, then exit")
+	repair := flag.Bool("repair", false, "match the incremental state and index to the message files in the store, report differences, then exit")
+	watch := flag.Bool("watch", false, "after the backup stay connected and store new messages as they arrive, implies -incremental")
+	var watchFolders stringList
+	flag.Var(&watchFolders, "watch-folder", "folder to keep in sync with -watch, may be repeated, defaults to INBOX")
+	watchInterval := flag.Duration("watch-interval", time.Minute, "how often -watch checks for new mail on a server without IDLE")
+	listFolders := flag.Bool("list-folders", false, "print the folders that would be backed up with message counts, then exit")
+	check := flag.Bool("check", false, "connect, log in, and open INBOX read-only, then print OK and exit; fails if any step does")
+	version := flag.Bool("version", false, "print the version, Go version, and commit of this build, then exit")
+	restore := flag.Bool("restore", false, "upload the store to the IMAP host instead of downloading")
 	flag.Parse()
-	if len(*h) == 0 {
-		return fmt.Errorf("missing host")
+	if *version {
+		fmt.Println(versionString())
+		return nil
 	}
 	if len(*s) == 0 {
 		return fmt.Errorf("missing store")
 	}
-	err := os.MkdirAll(*s, 0700)
+	authMethod := list.AuthLogin
+	if len(*tokenFile) > 0 {
+		b, err := os.ReadFile(*tokenFile)
+		if err != nil {
+			return fmt.Errorf("read token: %w", err)
+		}
+		*token = strings.TrimSpace(string(b))
+	}
+	if len(*token) > 0 {
+		authMethod = list.AuthXOAuth2
+	}
+	var sinceDate, beforeDate time.Time
+	if len(*since) > 0 {
+		t, err := time.Parse(dateLayout, *since)
+		if err != nil {
+			return fmt.Errorf("invalid since: %w", err)
+		}
+		sinceDate = t
+	}
+	if len(*before) > 0 {
+		t, err := time.Parse(dateLayout, *before)
+		if err != nil {
+			return fmt.Errorf("invalid before: %w", err)
+		}
+		beforeDate = t
+	}
+	var folderSettings []list.FolderSettings
+	if len(*foldersFile) > 0 {
+		f, err := os.Open(*foldersFile)
+		if err != nil {
+			return fmt.Errorf("folders file: %w", err)
+		}
+		folderSettings, err = list.ReadFolderSettings(f)
+		f.Close()
+		if err != nil {
+			return fmt.Errorf("%s: %w", *foldersFile, err)
+		}
+		if len(folderSettings) == 0 {
+			return fmt.Errorf("%s lists no folders", *foldersFile)
+		}
+	}
+	tlsConfig, err := loadTLSConfig(*caFile, *tlsServerName, *tlsSkipVerify)
+	if err != nil {
+		return err
+	}
+	if *markSeen {
+		log.Print("WARNING: -mark-seen is set, downloaded messages are marked as read on the server")
+	}
+	var nameFunc func(h list.Header) (string, error)
+	switch *naming {
+	default:
+		return fmt.Errorf("unknown naming %q", *naming)
+	case "hash":
+	case "date-subject":
+		nameFunc = list.NameByDateSubject
+	}
+	fm, err := parseMode(*fileMode)
+	if err != nil {
+		return fmt.Errorf("invalid file-mode: %w", err)
+	}
+	dm, err := parseMode(*dirMode)
+	if err != nil {
+		return fmt.Errorf("invalid dir-mode: %w", err)
+	}
+	var deduper *list.Deduper
+	if *dedupeIDs {
+		deduper, err = list.OpenDeduper(filepath.Join(*s, list.DeduperFile), fm)
+		if err != nil {
+			return err
+		}
+		defer deduper.Close()
+	}
+	var identity string
+	if len(*keyFile) > 0 {
+		b, err := os.ReadFile(*keyFile)
+		if err != nil {
+			return fmt.Errorf("key: %w", err)
+		}
+		identity = string(b)
+	}
+	var sink io.Writer
+	switch *jsonl {
+	case "":
+	case "-":
+		sink = os.Stdout
+	default:
+		f, err := os.OpenFile(*jsonl, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+		if err != nil {
+			return fmt.Errorf("jsonl: %w", err)
+		}
+		defer f.Close()
+		sink = f
+	}
+	opts := []list.Option{
+		list.WithVerbose(*v),
+		list.WithLogFormat(*logFormat, os.Stderr),
+		list.WithTLSMode(*tlsMode),
+		list.WithTLSConfig(tlsConfig),
+		list.WithProxy(*proxyURL),
+		list.WithAuthMethod(authMethod),
+		list.WithLayout(*layout),
+		list.WithFormat(*format),
+		list.WithCompress(*gz),
+		list.WithModes(fm, dm, *allowWorldWritable),
+		list.WithEncrypt(*encrypt, *plainIndex),
+		list.WithIdentity(identity),
+		list.WithReHashExisting(*rehash),
+		list.WithStoreRawHeaders(*rawHeaders),
+		list.WithHashAlgo(*hashAlgo),
+		list.WithSkipBodyHash(*skipHash),
+		list.WithExtractAttachments(*attachments),
+		list.WithExtractText(*extractText),
+		list.WithCompression(*compression),
+		list.WithIncremental(*incremental),
+		list.WithOnlyNewFolders(*onlyNewFolders),
+		list.WithMarkSeen(*markSeen),
+		list.WithDryRun(*dryRun),
+		list.WithLimits(*limitFolders, *limitMessages),
+		list.WithMessageSize(*minSize, *maxSize),
+		list.WithRequireAttachment(*requireAttach),
+		list.WithDetectMoves(*detectMoves),
+		list.WithDedupeByContent(*dedupeContent),
+		list.WithDeduper(deduper),
+		list.WithSink(sink),
+		list.WithConcurrency(*concurrency),
+		list.WithFetchConnections(*fetchConns),
+		list.WithMaxConnections(*maxConns),
+		list.WithMaxBytesPerSec(*maxRate),
+		list.WithTimeouts(*folderTimeout, *opTimeout),
+		list.WithMaxRetries(*retries),
+		list.WithNameFunc(nameFunc),
+		list.WithKeepalive(*keepalive),
+		list.WithBatchSize(*batchSize),
+		list.WithEnvelopeWindow(*envelopeWindow),
+		list.WithMirror(*mirror),
+		list.WithWriteSummary(*writeSummary),
+		list.WithWriteManifest(*writeManifest),
+		list.WithDateRange(sinceDate, beforeDate),
+		list.WithSinceLastRun(*sinceLastRun),
+		list.WithSearchFlags(only),
+		list.WithSkipDeleted(*skipDeleted),
+		list.WithFolders(include, exclude),
+		list.WithFolderSettings(folderSettings),
+		list.WithRootFolder(*rootFolder),
+		list.WithExcludeSpecialUse(excludeUse),
+		list.WithSkipEmptyFolders(*pruneEmpty),
+		list.WithPreferAllMail(*allMail),
+		list.WithWatchFolders(watchFolders, *watchInterval),
+	}
+	w := list.New(*s, opts...)
+	if *repair {
+		return w.Repair(ctx)
+	}
+	if *rebuildIndex {
+		return w.RebuildIndex(ctx)
+	}
+	if *manifest {
+		return w.Manifest(ctx)
+	}
+	if *verify {
+		return w.Verify(ctx)
+	}
+	if *dedupe {
+		return w.Dedupe(ctx, *dedupeRemove)
+	}
+	if len(search) > 0 {
+		return runSearch(ctx, w, search)
+	}
+
+	if len(*configFile) > 0 {
+		if *restore {
+			return fmt.Errorf("-restore does not support -config")
+		}
+		if *watch {
+			return fmt.Errorf("-watch does not support -config")
+		}
+		cfg, err := loadConfig(*configFile)
+		if err != nil {
+			return err
+		}
+		return runAccounts(ctx, cfg, *s, opts)
+	}
+
+	if len(*providerName) > 0 {
+		pv, err := lookupProvider(*providerName)
+		if err != nil {
+			return err
+		}
+		if len(*h) == 0 {
+			*h = pv.Host
+		}
+		log.Print(pv.Hint)
+		if pv.AuthMethod == list.AuthXOAuth2 && authMethod != list.AuthXOAuth2 {
+			return fmt.Errorf("provider %s requires an OAuth2 token: use -token or -token-file", *providerName)
+		}
+	}
+	if len(*h) == 0 {
+		return fmt.Errorf("missing host, or use -provider")
+	}
+	secret := *token
+	if authMethod == list.AuthLogin {
+		passSet := len(*p) > 0 || len(*passFile) > 0 || len(*passEnv) > 0 || *passStdin
+		fromNetrc := false
+		if len(*u) == 0 || !passSet {
+			path, required := *netrcFile, len(*netrcFile) > 0
+			if !required {
+				path = defaultNetrc()
+			}
+			e, ok, err := lookupNetrc(path, *h, *u, required)
+			if err != nil {
+				return err
+			}
+			switch {
+			case ok:
+				if len(*u) == 0 {
+					*u = e.login
+				}
+				if !passSet && len(e.password) > 0 {
+					secret, fromNetrc = e.password, true
+				}
+			case len(*u) == 0 && !passSet:
+				return fmt.Errorf("no credentials for %s: add it to %s or use -user and a -pass flag", *h, path)
+			}
+		}
+		if !fromNetrc {
+			var err error
+			secret, err = readPassword(*p, *passFile, *passEnv, *passStdin)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	if *check {
+		if err := w.Check(ctx, *h, *u, secret); err != nil {
+			return fmt.Errorf("check %s: %w", *h, err)
+		}
+		fmt.Println("OK")
+		return nil
+	}
+	if *listFolders {
+		return runListFolders(ctx, w, *h, *u, secret)
+	}
+	if *restore {
+		return w.Restore(ctx, *h, *u, secret)
+	}
+	if *watch {
+		return w.Watch(ctx, *h, *u, secret)
+	}
+	sum, err := w.List(ctx, *h, *u, secret)
+	log.Print(sum)
+	return err
+}
+
+// proxyFromEnv returns the proxy set in the environment, if any.
+func proxyFromEnv() string {
+	for _, k := range []string{"ALL_PROXY", "all_proxy", "HTTPS_PROXY", "https_proxy"} {
+		if v := os.Getenv(k); len(v) > 0 {
+			return v
+		}
+	}
+	return ""
+}
+
+// loadTLSConfig returns the TLS config from the TLS flags, or nil for the
+// defaults.
+func loadTLSConfig(caFile, serverName string, skipVerify bool) (*tls.Config, error) {
+	if len(caFile) == 0 && len(serverName) == 0 && !skipVerify {
+		return nil, nil
+	}
+	c := &tls.Config{
+		ServerName:         serverName,
+		InsecureSkipVerify: skipVerify,
+	}
+	if skipVerify {
+		log.Print("WARNING: -tls-skip-verify is set, the server certificate is not checked and the connection can be intercepted")
+	}
+	if len(caFile) > 0 {
+		pem, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, fmt.Errorf("read CA file: %w", err)
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", caFile)
+		}
+		c.RootCAs = pool
+	}
+	return c, nil
+}
+
+// readPassword returns the password from exactly one of, in the order
+// checked, -pass, -pass-file, -pass-env, or -pass-stdin.
+func readPassword(pass, file, env string, stdin bool) (string, error) {
+	n := 0
+	for _, set := range []bool{len(pass) > 0, len(file) > 0, len(env) > 0, stdin} {
+		if set {
+			n++
+		}
+	}
+	switch {
+	case n == 0:
+		return "", fmt.Errorf("missing password: use -pass-file, -pass-env, -pass-stdin, or -pass")
+	case n > 1:
+		return "", fmt.Errorf("only one of -pass, -pass-file, -pass-env, -pass-stdin may be set")
+	}
+	switch {
+	case len(pass) > 0:
+		return pass, nil
+	case len(file) > 0:
+		b, err := os.ReadFile(file)
+		if err != nil {
+			return "", fmt.Errorf("read password: %w", err)
+		}
+		return strings.TrimRight(string(b), "\r\n"), nil
+	case len(env) > 0:
+		v, ok := os.LookupEnv(env)
+		if !ok {
+			return "", fmt.Errorf("password variable %s is not set", env)
+		}
+		return v, nil
+	}
+	fd := int(os.Stdin.Fd())
+	if term.IsTerminal(fd) {
+		fmt.Fprint(os.Stderr, "Password: ")
+		b, err := term.ReadPassword(fd)
+		fmt.Fprintln(os.Stderr)
+		if err != nil {
+			return "", fmt.Errorf("read password: %w", err)
+		}
+		return string(b), nil
+	}
+	line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && (err != io.EOF || len(line) == 0) {
+		return "", fmt.Errorf("read password: %w", err)
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+func runListFolders(ctx context.Context, w *list.Worker, server, username, secret string) error {
+	folders, err := w.ListFolders(ctx, server, username, secret)
+	if err != nil {
+		return err
+	}
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "Folder\tRole\tTotal\tUnseen\tSize")
+	for _, f := range folders {
+		if f.NoSelect {
+			fmt.Fprintf(tw, "%s\t%s\t-\t-\t-\n", f.Name, f.SpecialUse)
+			continue
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%d\t%d\t%d\n", f.Name, f.SpecialUse, f.Messages, f.Unseen, f.Size)
+	}
+	return tw.Flush()
+}
+
+func runSearch(ctx context.Context, w *list.Worker, terms []string) error {
+	q := list.SearchQuery{}
+	for _, t := range terms {
+		k, v, ok := strings.Cut(t, "=")
+		if !ok {
+			return fmt.Errorf("search term %q is not key=value", t)
+		}
+		switch k {
+		default:
+			return fmt.Errorf("unknown search key %q", k)
+		case "from":
+			q.From = v
+		case "subject":
+			q.Subject = v
+		case "folder":
+			q.Folder = v
+		case "since", "before":
+			d, err := time.Parse(dateLayout, v)
+			if err != nil {
+				return fmt.Errorf("invalid %s: %w", k, err)
+			}
+			if k == "since" {
+				q.Since = d
+			} else {
+				q.Before = d
+			}
+		}
+	}
+	found, err := w.Search(ctx, q)
 	if err != nil {
 		return err
 	}
-	w := &list.Worker{
-		Verbose: *v,
-		Store:   *s,
+	for _, h := range found {
+		fmt.Printf("%s\t%s\t%s\t%s\t%s\n", h.Date, h.Folder, h.From, h.Subject, h.Key)
 	}
-	return w.List(ctx, *h, *u, *p)
+	return nil
 }
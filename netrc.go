@@ -0,0 +1,128 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// netrcEntry is a machine, or the default, of a netrc file.
+type netrcEntry struct {
+	machine  string // Empty for default.
+	login    string
+	password string
+}
+
+// parseNetrc reads the machine and default entries of a netrc file, as
+// used by ftp and curl. Macro definitions are skipped.
+func parseNetrc(r io.Reader) ([]netrcEntry, error) {
+	var list []netrcEntry
+	var cur *netrcEntry
+	sc := bufio.NewScanner(r)
+	inMacro := false
+	for sc.Scan() {
+		line := sc.Text()
+		if inMacro {
+			// A macro ends at an empty line.
+			inMacro = len(strings.TrimSpace(line)) > 0
+			continue
+		}
+		if strings.HasPrefix(strings.TrimSpace(line), "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		for i := 0; i < len(fields); i++ {
+			value := func() (string, error) {
+				if i+1 >= len(fields) {
+					return "", fmt.Errorf("netrc: %s without a value", fields[i])
+				}
+				i++
+				return fields[i], nil
+			}
+			switch fields[i] {
+			case "machine":
+				v, err := value()
+				if err != nil {
+					return nil, err
+				}
+				list = append(list, netrcEntry{machine: v})
+				cur = &list[len(list)-1]
+			case "default":
+				list = append(list, netrcEntry{})
+				cur = &list[len(list)-1]
+			case "login", "password", "account":
+				v, err := value()
+				if err != nil {
+					return nil, err
+				}
+				if cur == nil {
+					return nil, fmt.Errorf("netrc: %s before machine", fields[i-1])
+				}
+				switch fields[i-1] {
+				case "login":
+					cur.login = v
+				case "password":
+					cur.password = v
+				}
+			case "macdef":
+				inMacro = true
+				i = len(fields)
+			default:
+				return nil, fmt.Errorf("netrc: unknown token %q", fields[i])
+			}
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return nil, fmt.Errorf("netrc: %w", err)
+	}
+	return list, nil
+}
+
+// defaultNetrc returns the netrc file in the home directory.
+func defaultNetrc() string {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(home, ".netrc")
+}
+
+// lookupNetrc returns the entry of the netrc file at path for host, which
+// may include a port, and login if set. A machine entry wins over default.
+// A missing file is only an error if required.
+func lookupNetrc(path, host, login string, required bool) (netrcEntry, bool, error) {
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) && !required {
+		return netrcEntry{}, false, nil
+	}
+	if err != nil {
+		return netrcEntry{}, false, fmt.Errorf("netrc: %w", err)
+	}
+	defer f.Close()
+	list, err := parseNetrc(f)
+	if err != nil {
+		return netrcEntry{}, false, fmt.Errorf("%s: %w", path, err)
+	}
+	names := []string{host}
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		names = append(names, h)
+	}
+	for _, name := range names {
+		for _, e := range list {
+			if e.machine == name && (len(login) == 0 || e.login == login) {
+				return e, true, nil
+			}
+		}
+	}
+	for _, e := range list {
+		if len(e.machine) == 0 && (len(login) == 0 || e.login == login) {
+			return e, true, nil
+		}
+	}
+	return netrcEntry{}, false, nil
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/kardianos/imapdown/list"
+)
+
+// provider holds the connection defaults of a common mail service.
+type provider struct {
+	Host       string // host:port
+	AuthMethod string // list.AuthLogin or list.AuthXOAuth2.
+	Hint       string // Shown when the provider is used.
+}
+
+var providers = map[string]provider{
+	"gmail": {
+		Host:       "imap.gmail.com:993",
+		AuthMethod: list.AuthLogin,
+		Hint:       "Gmail requires an app password, which needs 2-Step Verification, or an OAuth2 token with -token. Consider -gmail-all-mail to avoid storing each label separately.",
+	},
+	"icloud": {
+		Host:       "imap.mail.me.com:993",
+		AuthMethod: list.AuthLogin,
+		Hint:       "iCloud requires an app-specific password from appleid.apple.com; the user is the full iCloud address.",
+	},
+	"outlook": {
+		Host:       "outlook.office365.com:993",
+		AuthMethod: list.AuthXOAuth2,
+		Hint:       "Outlook.com and Microsoft 365 no longer accept passwords; pass an OAuth2 access token with -token or -token-file.",
+	},
+	"yahoo": {
+		Host:       "imap.mail.yahoo.com:993",
+		AuthMethod: list.AuthLogin,
+		Hint:       "Yahoo requires an app password, generated under Account Security.",
+	},
+	"fastmail": {
+		Host:       "imap.fastmail.com:993",
+		AuthMethod: list.AuthLogin,
+		Hint:       "Fastmail requires an app password with IMAP access, created under Settings, Privacy & Security.",
+	},
+}
+
+func providerNames() string {
+	names := make([]string, 0, len(providers))
+	for name := range providers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
+
+// lookupProvider returns the defaults for a -provider name.
+func lookupProvider(name string) (provider, error) {
+	p, ok := providers[strings.ToLower(name)]
+	if !ok {
+		return p, fmt.Errorf("unknown provider %q, known providers: %s", name, providerNames())
+	}
+	return p, nil
+}
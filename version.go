@@ -0,0 +1,41 @@
+package main
+
+import (
+	"fmt"
+	"runtime"
+	"runtime/debug"
+)
+
+// commit is the source revision, set when building with
+// -ldflags "-X main.commit=<rev>". Otherwise the revision go build
+// embeds is used, if any.
+var commit string
+
+// versionString describes the running binary: its module version, the Go
+// version it was built with, and its commit.
+func versionString() string {
+	version, rev, dirty := "(devel)", commit, false
+	if bi, ok := debug.ReadBuildInfo(); ok {
+		if len(bi.Main.Version) > 0 {
+			version = bi.Main.Version
+		}
+		for _, s := range bi.Settings {
+			switch s.Key {
+			case "vcs.revision":
+				if len(rev) == 0 {
+					rev = s.Value
+				}
+			case "vcs.modified":
+				dirty = s.Value == "true" && len(commit) == 0
+			}
+		}
+	}
+	s := fmt.Sprintf("imapdown %s %s", version, runtime.Version())
+	if len(rev) > 0 {
+		s += " commit " + rev
+		if dirty {
+			s += " (modified)"
+		}
+	}
+	return s
+}